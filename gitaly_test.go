@@ -1,8 +1,14 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
@@ -338,6 +344,120 @@ func TestGetBlobProxiedToGitalySuccessfully(t *testing.T) {
 	testhelper.AssertResponseHeader(t, resp, "Content-Length", strconv.Itoa(blobLength))
 }
 
+func TestGetDiffProxiedToGitalySuccessfully(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	gitalyAddress := "unix://" + socketPath
+	leftCommitId := "8a0f2ee90d940bfb0ba1e14e8214b0649056e4ab"
+	rightCommitId := "e395f646b1499e8e0279445fc99a0596a65fab7e"
+	jsonParams := fmt.Sprintf(`{"GitalyServer":{"Address":"%s","Token":""},"ShaFrom":"%s","ShaTo":"%s","CommitDiffRequest":{"repository":{"storage_name":"default","relative_path":"foo/bar.git"}}}`,
+		gitalyAddress, leftCommitId, rightCommitId)
+	expectedBody := fmt.Sprintf("diff --git a/README.md b/README.md\nindex %s..%s 100644\n--- a/README.md\n+++ b/README.md\n%s",
+		leftCommitId, rightCommitId, testhelper.GitalyCommitDiffPatchMock)
+
+	resp, body, err := doSendDataRequest("/something", "git-diff", jsonParams)
+	require.NoError(t, err)
+
+	assert.Equal(t, 200, resp.StatusCode, "GET %q: status code", resp.Request.URL)
+	assert.Equal(t, expectedBody, string(body), "GET %q: response body", resp.Request.URL)
+}
+
+func TestGetTreeProxiedToGitalySuccessfully(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	gitalyAddress := "unix://" + socketPath
+	jsonParams := fmt.Sprintf(`{"GitalyServer":{"Address":"%s","Token":""},"GetTreeEntriesRequest":{"repository":{"storage_name":"default","relative_path":"foo/bar.git"},"revision":"%s","path":"%s"}}`,
+		gitalyAddress, base64.StdEncoding.EncodeToString([]byte("master")), base64.StdEncoding.EncodeToString([]byte(".")))
+
+	resp, body, err := doSendDataRequest("/something", "git-tree", jsonParams)
+	require.NoError(t, err)
+
+	assert.Equal(t, 200, resp.StatusCode, "GET %q: status code", resp.Request.URL)
+	testhelper.AssertResponseHeader(t, resp, "Content-Type", "application/x-ndjson")
+
+	var paths, types, modes []string
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for decoder.More() {
+		var entry struct{ Path, Type, Mode string }
+		require.NoError(t, decoder.Decode(&entry))
+		paths = append(paths, entry.Path)
+		types = append(types, entry.Type)
+		modes = append(modes, entry.Mode)
+	}
+
+	assert.Equal(t, []string{"README.md", "doc", "doc/api", "doc/api/tree.md", "doc/index.md", "run.sh"}, paths, "GET %q: paths", resp.Request.URL)
+	assert.Equal(t, []string{"blob", "tree", "tree", "blob", "blob", "blob"}, types, "GET %q: types", resp.Request.URL)
+	assert.Equal(t, []string{"100644", "040000", "040000", "100644", "100644", "100755"}, modes, "GET %q: modes", resp.Request.URL)
+}
+
+func TestGetBlobsProxiedToGitalySuccessfully(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	gitalyAddress := "unix://" + socketPath
+	expectedFiles := map[string]string{}
+	for _, mock := range testhelper.GitalyTreeMock {
+		if strings.HasPrefix(mock.Path, "doc/") || mock.Path == "run.sh" {
+			expectedFiles[mock.Path] = mock.Data
+		}
+	}
+
+	for _, format := range []string{"tar", "zip"} {
+		jsonParams := fmt.Sprintf(`{"GitalyServer":{"Address":"%s","Token":""},"Repository":{"storage_name":"default","relative_path":"foo/bar.git"},"Revision":"master","Paths":["doc","run.sh","doc/index.md"],"Format":"%s"}`,
+			gitalyAddress, format)
+
+		resp, body, err := doSendDataRequest("/something", "git-blobs", jsonParams)
+		require.NoError(t, err)
+
+		assert.Equal(t, 200, resp.StatusCode, "GET %q: status code", resp.Request.URL)
+		testhelper.AssertResponseHeader(t, resp, "Content-Disposition", fmt.Sprintf(`attachment; filename="blobs.%s"`, format))
+
+		files := map[string]string{}
+		if format == "tar" {
+			tr := tar.NewReader(bytes.NewReader(body))
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				data, err := ioutil.ReadAll(tr)
+				require.NoError(t, err)
+				files[header.Name] = string(data)
+			}
+		} else {
+			zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+			require.NoError(t, err)
+			for _, file := range zr.File {
+				rc, err := file.Open()
+				require.NoError(t, err)
+				data, err := ioutil.ReadAll(rc)
+				rc.Close()
+				require.NoError(t, err)
+				files[file.Name] = string(data)
+			}
+		}
+
+		assert.Equal(t, expectedFiles, files, "GET %q: %s contents", resp.Request.URL, format)
+	}
+}
+
+func TestGetBlobsProxiedToGitalyNotFound(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	gitalyAddress := "unix://" + socketPath
+	jsonParams := fmt.Sprintf(`{"GitalyServer":{"Address":"%s","Token":""},"Repository":{"storage_name":"default","relative_path":"foo/bar.git"},"Revision":"master","Paths":["README.md","does-not-exist"]}`,
+		gitalyAddress)
+
+	resp, _, err := doSendDataRequest("/something", "git-blobs", jsonParams)
+	require.NoError(t, err)
+
+	assert.Equal(t, 404, resp.StatusCode, "GET %q: status code", resp.Request.URL)
+}
+
 func TestGetBlobProxiedToGitalyInterruptedStream(t *testing.T) {
 	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
 	defer gitalyServer.Stop()
@@ -386,6 +506,8 @@ func startGitalyServer(t *testing.T, finalMessageCode codes.Code) (*combinedServ
 	gitalyServer := testhelper.NewGitalyServer(finalMessageCode)
 	pb.RegisterSmartHTTPServiceServer(server, gitalyServer)
 	pb.RegisterBlobServiceServer(server, gitalyServer)
+	pb.RegisterDiffServiceServer(server, gitalyServer)
+	pb.RegisterCommitServiceServer(server, gitalyServer)
 
 	go server.Serve(listener)
 
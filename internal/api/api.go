@@ -34,6 +34,9 @@ type API struct {
 	Client  *http.Client
 	URL     *url.URL
 	Version string
+	// AuthorizationCache is optional; if set, successful authorizations
+	// of Git fetches are reused for a short time.
+	AuthorizationCache *AuthorizationCache
 }
 
 var (
@@ -110,6 +113,9 @@ type Response struct {
 	// Repository object for making gRPC requests to Gitaly. This will
 	// eventually replace the RepoPath field.
 	Repository pb.Repository
+	// MaxPushSize is the largest 'git push' request body in bytes we accept
+	// for this project. Overrides -maxPushSize if set.
+	MaxPushSize int64
 }
 
 // singleJoiningSlash is taken from reverseproxy.go:NewSingleHostReverseProxy
@@ -234,6 +240,23 @@ func (api *API) PreAuthorize(suffix string, r *http.Request) (httpResponse *http
 
 func (api *API) PreAuthorizeHandler(next HandleFunc, suffix string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheKey, cacheable := api.authorizationCacheKey(r, suffix)
+		project, action := api.authorizationCacheProject(r, suffix)
+		if action == "git-receive-pack" {
+			// Pushes are always authorized by the backend. Have the
+			// fetches that follow a push, typically by CI, be authorized
+			// again as well, so that permission changes take effect no
+			// later than the next push.
+			api.AuthorizationCache.invalidate(project)
+		}
+
+		if cacheable {
+			if authResponse := api.AuthorizationCache.get(cacheKey); authResponse != nil {
+				next(w, r, authResponse)
+				return
+			}
+		}
+
 		httpResponse, authResponse, err := api.PreAuthorize(suffix, r)
 		if httpResponse != nil {
 			defer httpResponse.Body.Close()
@@ -247,6 +270,14 @@ func (api *API) PreAuthorizeHandler(next HandleFunc, suffix string) http.Handler
 		// The response couldn't be interpreted as a valid auth response, so
 		// pass it back (mostly) unmodified
 		if httpResponse != nil && authResponse == nil {
+			switch {
+			case project != "" && (httpResponse.StatusCode == http.StatusUnauthorized || httpResponse.StatusCode == http.StatusForbidden):
+				// Access to the project may have been revoked for other
+				// credentials as well
+				api.AuthorizationCache.invalidate(project)
+			case cacheable:
+				api.AuthorizationCache.delete(cacheKey)
+			}
 			passResponseBack(httpResponse, w, r)
 			return
 		}
@@ -255,10 +286,38 @@ func (api *API) PreAuthorizeHandler(next HandleFunc, suffix string) http.Handler
 
 		copyAuthHeader(httpResponse, w)
 
+		// A WWW-Authenticate header on success is specific to this request
+		if cacheable && !hasAuthHeader(httpResponse) {
+			api.AuthorizationCache.set(cacheKey, authResponse)
+		}
+
 		next(w, r, authResponse)
 	})
 }
 
+func (api *API) authorizationCacheKey(r *http.Request, suffix string) (authorizationCacheKey, bool) {
+	if api.AuthorizationCache == nil || suffix != "" {
+		return authorizationCacheKey{}, false
+	}
+
+	return newAuthorizationCacheKey(r)
+}
+
+// authorizationCacheProject returns the project and service of r if
+// cached authorizations for that project may have to be invalidated.
+func (api *API) authorizationCacheProject(r *http.Request, suffix string) (string, string) {
+	if api.AuthorizationCache == nil || suffix != "" {
+		return "", ""
+	}
+
+	project, action := gitProject(r)
+	if project == "" {
+		return "", ""
+	}
+
+	return project, action
+}
+
 func (api *API) doRequestWithoutRedirects(authReq *http.Request) (*http.Response, error) {
 	return api.Client.Transport.RoundTrip(authReq)
 }
@@ -274,6 +333,15 @@ func copyAuthHeader(httpResponse *http.Response, w http.ResponseWriter) {
 	}
 }
 
+func hasAuthHeader(httpResponse *http.Response) bool {
+	for k := range httpResponse.Header {
+		if strings.EqualFold(k, "WWW-Authenticate") {
+			return true
+		}
+	}
+	return false
+}
+
 func passResponseBack(httpResponse *http.Response, w http.ResponseWriter, r *http.Request) {
 	// NGINX response buffering is disabled on this path (with
 	// X-Accel-Buffering: no) but we still want to free up the Unicorn worker
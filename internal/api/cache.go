@@ -0,0 +1,168 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The only action whose authorization we are willing to cache. Pushes and
+// other requests must always be authorized by the backend.
+const cacheableAction = "git-upload-pack"
+
+var (
+	authorizationCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_internal_api_authorization_cache",
+			Help: "How many cacheable internal API authorization requests have been served from the cache, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+	authorizationCacheInvalidations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_internal_api_authorization_cache_invalidations",
+			Help: "How many internal API authorization cache entries have been invalidated before they expired.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(authorizationCacheRequests)
+	prometheus.MustRegister(authorizationCacheInvalidations)
+}
+
+type authorizationCacheKey struct {
+	credentials string
+	project     string
+	action      string
+}
+
+type authorizationCacheEntry struct {
+	response Response
+	expires  time.Time
+}
+
+// AuthorizationCache remembers successful PreAuthorize responses for Git
+// fetches for a short time, so that the info/refs and git-upload-pack
+// requests of a single 'git fetch' cost only one backend request.
+type AuthorizationCache struct {
+	sync.Mutex
+	ttl       time.Duration
+	entries   map[authorizationCacheKey]*authorizationCacheEntry
+	lastSweep time.Time
+}
+
+func NewAuthorizationCache(ttl time.Duration) *AuthorizationCache {
+	return &AuthorizationCache{
+		ttl:     ttl,
+		entries: make(map[authorizationCacheKey]*authorizationCacheEntry),
+	}
+}
+
+func (c *AuthorizationCache) get(key authorizationCacheKey) *Response {
+	c.Lock()
+	defer c.Unlock()
+
+	entry := c.entries[key]
+	if entry == nil || time.Now().After(entry.expires) {
+		authorizationCacheRequests.WithLabelValues("miss").Inc()
+		return nil
+	}
+
+	authorizationCacheRequests.WithLabelValues("hit").Inc()
+	response := entry.response
+	return &response
+}
+
+func (c *AuthorizationCache) set(key authorizationCacheKey, response *Response) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.entries[key] = &authorizationCacheEntry{response: *response, expires: now.Add(c.ttl)}
+
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.lastSweep = now
+}
+
+func (c *AuthorizationCache) delete(key authorizationCacheKey) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		authorizationCacheInvalidations.Inc()
+	}
+}
+
+// invalidate drops all cached authorizations for the project at
+// projectPath, e.g. "/group/project.git".
+func (c *AuthorizationCache) invalidate(projectPath string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for key := range c.entries {
+		if key.project == projectPath {
+			delete(c.entries, key)
+			authorizationCacheInvalidations.Inc()
+		}
+	}
+}
+
+// gitProject returns the project path, e.g. "/group/project.git", and
+// the service of a Git HTTP request. The project path is empty for other
+// requests.
+func gitProject(r *http.Request) (project string, action string) {
+	switch {
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/info/refs"):
+		return strings.TrimSuffix(r.URL.Path, "/info/refs"), r.URL.Query().Get("service")
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
+		return strings.TrimSuffix(r.URL.Path, "/git-upload-pack"), "git-upload-pack"
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/git-receive-pack"):
+		return strings.TrimSuffix(r.URL.Path, "/git-receive-pack"), "git-receive-pack"
+	}
+
+	return "", ""
+}
+
+// newAuthorizationCacheKey tells if the authorization of r may be cached,
+// and under what key.
+func newAuthorizationCacheKey(r *http.Request) (authorizationCacheKey, bool) {
+	project, action := gitProject(r)
+	if action != cacheableAction || project == "" {
+		return authorizationCacheKey{}, false
+	}
+
+	// The backend may also look at the client IP address when deciding
+	// whether to authorize a request.
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+	credentials := sha256.New()
+	for _, s := range []string{
+		r.Header.Get("Authorization"),
+		strings.Join(r.Header["X-Forwarded-For"], ", "),
+		clientIP,
+	} {
+		credentials.Write([]byte(s))
+		credentials.Write([]byte{0})
+	}
+
+	return authorizationCacheKey{
+		credentials: hex.EncodeToString(credentials.Sum(nil)),
+		project:     project,
+		action:      action,
+	}, true
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/badgateway"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func cacheRequest(t *testing.T, method, url string, authorization string) *http.Request {
+	r, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RemoteAddr = "10.0.0.1:1234"
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return r
+}
+
+func TestAuthorizationCacheKey(t *testing.T) {
+	testCases := []struct {
+		method    string
+		url       string
+		cacheable bool
+	}{
+		{"GET", "http://localhost/group/project.git/info/refs?service=git-upload-pack", true},
+		{"POST", "http://localhost/group/project.git/git-upload-pack", true},
+		{"GET", "http://localhost/group/project.git/info/refs?service=git-receive-pack", false},
+		{"POST", "http://localhost/group/project.git/git-receive-pack", false},
+		{"GET", "http://localhost/group/project.git/info/refs", false},
+		{"GET", "http://localhost/group/project.git/git-upload-pack", false},
+		{"POST", "http://localhost/git-upload-pack", false},
+	}
+
+	for _, tc := range testCases {
+		_, cacheable := newAuthorizationCacheKey(cacheRequest(t, tc.method, tc.url, ""))
+		if cacheable != tc.cacheable {
+			t.Errorf("%s %s: expected cacheable=%v, got %v", tc.method, tc.url, tc.cacheable, cacheable)
+		}
+	}
+}
+
+func TestAuthorizationCacheKeySharedByFetch(t *testing.T) {
+	infoRefs, _ := newAuthorizationCacheKey(cacheRequest(t, "GET", "http://localhost/group/project.git/info/refs?service=git-upload-pack", "Basic Zm9vOmJhcg=="))
+	uploadPack, _ := newAuthorizationCacheKey(cacheRequest(t, "POST", "http://localhost/group/project.git/git-upload-pack", "Basic Zm9vOmJhcg=="))
+	if infoRefs != uploadPack {
+		t.Fatalf("expected info/refs and git-upload-pack to share a key: %v != %v", infoRefs, uploadPack)
+	}
+
+	otherUser, _ := newAuthorizationCacheKey(cacheRequest(t, "POST", "http://localhost/group/project.git/git-upload-pack", "Basic YmF6OnF1eA=="))
+	if otherUser == uploadPack {
+		t.Fatal("expected different credentials to have different keys")
+	}
+}
+
+func TestAuthorizationCacheExpiry(t *testing.T) {
+	cache := NewAuthorizationCache(20 * time.Millisecond)
+	key, _ := newAuthorizationCacheKey(cacheRequest(t, "POST", "http://localhost/group/project.git/git-upload-pack", ""))
+
+	cache.set(key, &Response{RepoPath: "/repos/project.git"})
+	if response := cache.get(key); response == nil || response.RepoPath != "/repos/project.git" {
+		t.Fatalf("expected cache hit, got %v", response)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if response := cache.get(key); response != nil {
+		t.Fatalf("expected expired entry, got %v", response)
+	}
+}
+
+func TestAuthorizationCacheInvalidate(t *testing.T) {
+	cache := NewAuthorizationCache(time.Minute)
+	key, _ := newAuthorizationCacheKey(cacheRequest(t, "POST", "http://localhost/group/project.git/git-upload-pack", ""))
+	otherKey, _ := newAuthorizationCacheKey(cacheRequest(t, "POST", "http://localhost/group/other.git/git-upload-pack", ""))
+
+	cache.set(key, &Response{})
+	cache.set(otherKey, &Response{})
+	cache.invalidate("/group/project.git")
+
+	if cache.get(key) != nil {
+		t.Fatal("expected entry to be invalidated")
+	}
+	if cache.get(otherKey) == nil {
+		t.Fatal("expected entry for other project to survive")
+	}
+}
+
+// countingRails answers authorization requests with status and counts
+// them.
+func countingRails(t *testing.T, status int) (*API, *int32, func()) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", ResponseContentType)
+		w.Write([]byte(`{"RepoPath": "/repos/project.git"}`))
+	}))
+
+	railsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhelper.ConfigureSecret()
+	api := NewAPI(railsURL, "123", badgateway.TestRoundTripper(railsURL))
+	api.AuthorizationCache = NewAuthorizationCache(time.Minute)
+
+	return api, &calls, ts.Close
+}
+
+func TestPreAuthorizeHandlerCachesFetches(t *testing.T) {
+	api, calls, stop := countingRails(t, http.StatusOK)
+	defer stop()
+
+	handler := api.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *Response) {}, "")
+	for _, request := range []struct{ method, url string }{
+		{"GET", "http://localhost/group/project.git/info/refs?service=git-upload-pack"},
+		{"POST", "http://localhost/group/project.git/git-upload-pack"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), cacheRequest(t, request.method, request.url, "Basic Zm9vOmJhcg=="))
+	}
+
+	if *calls != 1 {
+		t.Fatalf("expected one authorization request, got %d", *calls)
+	}
+}
+
+func TestPreAuthorizeHandlerDoesNotCacheDenials(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		api, calls, stop := countingRails(t, status)
+
+		handler := api.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *Response) {
+			t.Errorf("%d: expected the request to be denied", status)
+		}, "")
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, cacheRequest(t, "POST", "http://localhost/group/project.git/git-upload-pack", "Basic Zm9vOmJhcg=="))
+			if w.Code != status {
+				t.Errorf("%d: expected status to be passed back, got %d", status, w.Code)
+			}
+		}
+
+		if *calls != 2 {
+			t.Errorf("%d: expected every request to be authorized, got %d authorization requests", status, *calls)
+		}
+		stop()
+	}
+}
+
+func TestPreAuthorizeHandlerDoesNotCachePushes(t *testing.T) {
+	api, calls, stop := countingRails(t, http.StatusOK)
+	defer stop()
+
+	handler := api.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *Response) {}, "")
+	for _, request := range []struct{ method, url string }{
+		{"GET", "http://localhost/group/project.git/info/refs?service=git-receive-pack"},
+		{"POST", "http://localhost/group/project.git/git-receive-pack"},
+		{"POST", "http://localhost/group/project.git/git-receive-pack"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), cacheRequest(t, request.method, request.url, "Basic Zm9vOmJhcg=="))
+	}
+
+	if *calls != 3 {
+		t.Fatalf("expected every push request to be authorized, got %d authorization requests", *calls)
+	}
+}
+
+func TestPreAuthorizeHandlerInvalidatesOnPush(t *testing.T) {
+	api, calls, stop := countingRails(t, http.StatusOK)
+	defer stop()
+
+	handler := api.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *Response) {}, "")
+	for _, request := range []struct{ method, url string }{
+		{"POST", "http://localhost/group/project.git/git-upload-pack"},
+		{"POST", "http://localhost/group/project.git/git-receive-pack"},
+		{"POST", "http://localhost/group/project.git/git-upload-pack"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), cacheRequest(t, request.method, request.url, "Basic Zm9vOmJhcg=="))
+	}
+
+	if *calls != 3 {
+		t.Fatalf("expected the fetch after the push to be authorized again, got %d authorization requests", *calls)
+	}
+}
+
+func TestPreAuthorizeHandlerInvalidatesOnDenial(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		api, _, stop := countingRails(t, status)
+
+		fetch := cacheRequest(t, "POST", "http://localhost/group/project.git/git-upload-pack", "Basic Zm9vOmJhcg==")
+		key, _ := newAuthorizationCacheKey(fetch)
+		api.AuthorizationCache.set(key, &Response{})
+
+		// Another user is denied access to the same project
+		handler := api.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *Response) {
+			t.Errorf("%d: expected the request to be denied", status)
+		}, "")
+		handler.ServeHTTP(httptest.NewRecorder(), cacheRequest(t, "GET", "http://localhost/group/project.git/info/refs?service=git-upload-pack", "Basic YmF6OnF1eA=="))
+
+		if api.AuthorizationCache.get(key) != nil {
+			t.Errorf("%d: expected cached authorizations for the project to be invalidated", status)
+		}
+		stop()
+	}
+}
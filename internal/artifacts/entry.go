@@ -13,6 +13,7 @@ import (
 	"strings"
 	"syscall"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
@@ -38,6 +39,16 @@ func (e *entry) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 		return
 	}
 
+	// Remote archives are fetched by gitlab-zip-cat over HTTP
+	if !isURL(params.Archive) {
+		archive, err := confinement.Resolve(params.Archive)
+		if err != nil {
+			confinement.Fail(w, r, "SendEntry", err)
+			return
+		}
+		params.Archive = archive
+	}
+
 	err := unpackFileFromZip(params.Archive, params.Entry, w.Header(), w)
 
 	if os.IsNotExist(err) {
@@ -113,3 +124,7 @@ func waitCatFile(cmd *exec.Cmd) error {
 	return fmt.Errorf("wait for %v to finish: %v", cmd.Args, err)
 
 }
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
@@ -0,0 +1,84 @@
+/*
+Package audit writes records of security relevant events, one JSON object
+per line, to a log of their own.
+*/
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	auditRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_audit_records",
+			Help: "How many audit records have been written, partitioned by event.",
+		},
+		[]string{"event"},
+	)
+
+	output      io.Writer
+	outputMutex sync.Mutex
+)
+
+func init() {
+	prometheus.MustRegister(auditRecords)
+}
+
+// SetOutput sends audit records to w. Without an output, audit records
+// are dropped.
+func SetOutput(w io.Writer) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	output = w
+}
+
+// Enabled tells whether there is an output for audit records, so callers
+// can skip collecting information nobody will see.
+func Enabled() bool {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	return output != nil
+}
+
+// Log writes record, which must marshal to a JSON object, with the
+// current time and event added.
+func Log(event string, record interface{}) {
+	fields, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("audit.Log: marshal %s record: %v", event, err)
+		return
+	}
+
+	header, _ := json.Marshal(struct {
+		Time  string `json:"time"`
+		Event string `json:"event"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), event})
+
+	// Splice the header fields into the record object
+	line := append(header[:len(header)-1], ',')
+	if len(fields) > 2 {
+		line = append(line, fields[1:]...)
+	} else {
+		line = append(line[:len(line)-1], '}')
+	}
+	line = append(line, '\n')
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	if output == nil {
+		return
+	}
+
+	if _, err := output.Write(line); err != nil {
+		log.Printf("audit.Log: write %s record: %v", event, err)
+		return
+	}
+	auditRecords.WithLabelValues(event).Inc()
+}
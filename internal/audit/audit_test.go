@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(nil)
+
+	Log("test", struct {
+		Foo string `json:"foo"`
+	}{"bar"})
+	Log("empty", struct{}{})
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+
+	var record map[string]string
+	if err := json.Unmarshal(lines[0], &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["event"] != "test" || record["foo"] != "bar" || record["time"] == "" {
+		t.Fatalf("unexpected record %v", record)
+	}
+
+	record = nil
+	if err := json.Unmarshal(lines[1], &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["event"] != "empty" {
+		t.Fatalf("unexpected record %v", record)
+	}
+}
+
+func TestLogWithoutOutput(t *testing.T) {
+	if Enabled() {
+		t.Fatal("expected audit log to be disabled")
+	}
+
+	// Must not panic
+	Log("test", struct{}{})
+}
@@ -21,7 +21,7 @@ type TomlDuration struct {
 	time.Duration
 }
 
-func (d *TomlDuration) UnmarshalTest(text []byte) error {
+func (d *TomlDuration) UnmarshalText(text []byte) error {
 	temp, err := time.ParseDuration(string(text))
 	d.Duration = temp
 	return err
@@ -40,18 +40,99 @@ type RedisConfig struct {
 	MaxActive       *int
 }
 
+type RequestSpoolingConfig struct {
+	MemoryLimit int64
+	MaxSize     int64
+	ReadTimeout *TomlDuration
+	Routes      []RequestSpoolingRoute
+}
+
+// RequestSpoolingRoute overrides the spooling limits for request paths
+// matching Pattern
+type RequestSpoolingRoute struct {
+	Pattern     string
+	MaxSize     int64
+	ReadTimeout *TomlDuration
+}
+
+type ResponseSpoolingConfig struct {
+	MemoryLimit int64
+	MaxSize     int64
+	// Bypass lists request path patterns whose responses are always streamed
+	Bypass []string
+}
+
+// AllowedPathsConfig lists the directories that gitlab-workhorse may open
+// files in on behalf of Rails
+type AllowedPathsConfig struct {
+	Repositories []string
+	Shared       []string
+	Artifacts    []string
+	Uploads      []string
+	ArchiveCache []string
+}
+
+func (c *AllowedPathsConfig) Roots() []string {
+	var roots []string
+	for _, dirs := range [][]string{c.Repositories, c.Shared, c.Artifacts, c.Uploads, c.ArchiveCache} {
+		roots = append(roots, dirs...)
+	}
+	return roots
+}
+
+// UploadPackCacheConfig enables caching of git-upload-pack responses for
+// clones in Dir
+type UploadPackCacheConfig struct {
+	Dir     string
+	MaxSize int64
+	TTL     *TomlDuration
+}
+
+// ArchiveConfig tunes the compression of 'git archive' downloads. Zero
+// values keep the defaults. With CacheDir set, gitlab-workhorse evicts
+// archives from the cache in CacheDir itself.
+type ArchiveConfig struct {
+	GzipLevel    int
+	Bzip2Level   int
+	XzLevel      int
+	ZstdLevel    int
+	Concurrency  int
+	CacheDir     string
+	CacheMaxSize int64
+	CacheMaxAge  *TomlDuration
+}
+
+// InfoRefsCacheConfig enables caching of info/refs responses in memory
+type InfoRefsCacheConfig struct {
+	MaxSize int64
+	TTL     *TomlDuration
+}
+
 type Config struct {
-	Redis                    *RedisConfig  `toml:"redis"`
-	Backend                  *url.URL      `toml:"-"`
-	Version                  string        `toml:"-"`
-	DocumentRoot             string        `toml:"-"`
-	DevelopmentMode          bool          `toml:"-"`
-	Socket                   string        `toml:"-"`
-	ProxyHeadersTimeout      time.Duration `toml:"-"`
-	APILimit                 uint          `toml:"-"`
-	APIQueueLimit            uint          `toml:"-"`
-	APIQueueTimeout          time.Duration `toml:"-"`
-	APICILongPollingDuration time.Duration `toml:"-"`
+	Redis                    *RedisConfig            `toml:"redis"`
+	RequestSpooling          *RequestSpoolingConfig  `toml:"request_spooling"`
+	ResponseSpooling         *ResponseSpoolingConfig `toml:"response_spooling"`
+	AllowedPaths             *AllowedPathsConfig     `toml:"allowed_paths"`
+	UploadPackCache          *UploadPackCacheConfig  `toml:"upload_pack_cache"`
+	InfoRefsCache            *InfoRefsCacheConfig    `toml:"info_refs_cache"`
+	Archive                  *ArchiveConfig          `toml:"archive"`
+	Backend                  *url.URL                `toml:"-"`
+	Version                  string                  `toml:"-"`
+	DocumentRoot             string                  `toml:"-"`
+	DevelopmentMode          bool                    `toml:"-"`
+	Socket                   string                  `toml:"-"`
+	ProxyHeadersTimeout      time.Duration           `toml:"-"`
+	APILimit                 uint                    `toml:"-"`
+	APIQueueLimit            uint                    `toml:"-"`
+	APIQueueTimeout          time.Duration           `toml:"-"`
+	APICILongPollingDuration time.Duration           `toml:"-"`
+	APIAuthorizationCacheTTL time.Duration           `toml:"-"`
+	UploadPackLimit          uint                    `toml:"-"`
+	UploadPackQueueLimit     uint                    `toml:"-"`
+	UploadPackQueueTimeout   time.Duration           `toml:"-"`
+	GitDumbHTTP              bool                    `toml:"-"`
+	MaxDecompressedSize      int64                   `toml:"-"`
+	MaxPushSize              int64                   `toml:"-"`
 }
 
 // LoadConfig from a file
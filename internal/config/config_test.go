@@ -0,0 +1,48 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDurations(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	contents := `
+[request_spooling]
+ReadTimeout = "30s"
+
+[upload_pack_cache]
+Dir = "/tmp/upload-pack-cache"
+TTL = "5m"
+`
+	if _, err := file.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	cfg, err := LoadConfig(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if timeout := cfg.RequestSpooling.ReadTimeout; timeout == nil || timeout.Duration != 30*time.Second {
+		t.Errorf("expected ReadTimeout of 30s, got %v", timeout)
+	}
+	if ttl := cfg.UploadPackCache.TTL; ttl == nil || ttl.Duration != 5*time.Minute {
+		t.Errorf("expected TTL of 5m, got %v", ttl)
+	}
+}
+
+func TestTomlDurationInvalid(t *testing.T) {
+	var d TomlDuration
+	if err := d.UnmarshalText([]byte("five minutes")); err == nil {
+		t.Fatal("expected invalid duration to be rejected")
+	}
+}
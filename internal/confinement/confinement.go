@@ -0,0 +1,122 @@
+/*
+Package confinement makes sure that the paths we get from Rails, in
+X-Sendfile headers and senddata parameters, point into one of the
+directories we expect GitLab data to live in.
+*/
+package confinement
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// ViolationError is returned for paths outside the allowed roots.
+type ViolationError struct {
+	Path     string
+	Resolved string
+}
+
+func (e *ViolationError) Error() string {
+	return fmt.Sprintf("path %q (resolved to %q) is outside the allowed roots", e.Path, e.Resolved)
+}
+
+var (
+	allowedRoots []string
+	rootsMutex   sync.RWMutex
+)
+
+// SetAllowedRoots configures the directories that files may be served
+// from. With no roots configured, all paths are allowed.
+func SetAllowedRoots(roots []string) error {
+	var resolvedRoots []string
+	for _, root := range roots {
+		resolved, err := resolve(root)
+		if err != nil {
+			return fmt.Errorf("confinement.SetAllowedRoots: %v", err)
+		}
+		resolvedRoots = append(resolvedRoots, resolved)
+	}
+
+	rootsMutex.Lock()
+	defer rootsMutex.Unlock()
+	allowedRoots = resolvedRoots
+	return nil
+}
+
+// Resolve makes path absolute, follows its symlinks and checks that it
+// lies in one of the allowed roots. The resolved path is what the caller
+// should open. Paths that do not exist yet are resolved as far as their
+// parent directories exist.
+func Resolve(path string) (string, error) {
+	rootsMutex.RLock()
+	roots := allowedRoots
+	rootsMutex.RUnlock()
+
+	if len(roots) == 0 {
+		return path, nil
+	}
+
+	resolved, err := resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range roots {
+		if resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", &ViolationError{Path: path, Resolved: resolved}
+}
+
+// IsViolation tells whether err was caused by a path outside the allowed
+// roots.
+func IsViolation(err error) bool {
+	_, ok := err.(*ViolationError)
+	return ok
+}
+
+func resolve(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Walk up until we find something that exists, then put the missing
+	// components back on.
+	existing, missing := absPath, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return absPath, nil
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = parent
+	}
+}
+
+// Fail responds with 403 Forbidden to a confinement violation and with a
+// 500 error to any other problem resolving a path.
+func Fail(w http.ResponseWriter, r *http.Request, caller string, err error) {
+	if !IsViolation(err) {
+		helper.Fail500(w, r, fmt.Errorf("%s: %v", caller, err))
+		return
+	}
+
+	helper.Forbidden(w, r, fmt.Errorf("%s: %v", caller, err))
+}
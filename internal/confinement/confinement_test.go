@@ -0,0 +1,83 @@
+package confinement
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func setupRoots(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "confinement-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sub := range []string{"repositories/group", "shared", "outside"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(dir, "shared", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "shared"), filepath.Join(dir, "repositories", "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAllowedRoots([]string{filepath.Join(dir, "repositories"), filepath.Join(dir, "shared")}); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() {
+		SetAllowedRoots(nil)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir, cleanup := setupRoots(t)
+	defer cleanup()
+
+	testCases := []struct {
+		path    string
+		allowed bool
+	}{
+		{"repositories/group/project.git", true},
+		{"shared/cache/archive.zip", true},
+		{"repositories/inside/file", true},
+		{"repositories/../outside/file", false},
+		{"shared/escape/file", false},
+		{"repositories-backup/file", false},
+		{"outside", false},
+	}
+
+	for _, tc := range testCases {
+		_, err := Resolve(filepath.Join(dir, tc.path))
+		if tc.allowed && err != nil {
+			t.Errorf("%s: expected path to be allowed, got %v", tc.path, err)
+		}
+		if !tc.allowed && !IsViolation(err) {
+			t.Errorf("%s: expected violation, got %v", tc.path, err)
+		}
+	}
+
+	if _, err := Resolve("/etc/passwd"); !IsViolation(err) {
+		t.Errorf("expected /etc/passwd to be a violation, got %v", err)
+	}
+}
+
+func TestResolveWithoutRoots(t *testing.T) {
+	if resolved, err := Resolve("/etc/passwd"); err != nil || resolved != "/etc/passwd" {
+		t.Fatalf("expected path to be passed through, got %q, %v", resolved, err)
+	}
+}
+
+func TestFailViolation(t *testing.T) {
+	w := httptest.NewRecorder()
+	Fail(w, httptest.NewRequest("GET", "/file", nil), "test", &ViolationError{Path: "/etc/passwd", Resolved: "/etc/passwd"})
+	testhelper.AssertResponseCode(t, w, 403)
+}
@@ -0,0 +1,257 @@
+/*
+In this file we keep the size of the archive cache in check
+*/
+
+package git
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	// Tempfiles of archive generations start with this prefix
+	archiveTempfilePrefix = ".tmp-"
+
+	// Tempfiles that no generation owns are removed once they have not
+	// been written to for this long
+	archiveTempfileGracePeriod = 10 * time.Minute
+
+	archiveCacheScanInterval = time.Minute
+)
+
+var (
+	archiveCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_archive_cache_size_bytes",
+			Help: "Total size of the archives in the archive cache.",
+		},
+	)
+	archiveCacheFiles = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_archive_cache_files",
+			Help: "How many archives are in the archive cache.",
+		},
+	)
+	archiveCacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_archive_cache_evictions",
+			Help: "How many files have been removed from the archive cache, partitioned by reason (age, size, tempfile).",
+		},
+		[]string{"reason"},
+	)
+	archiveCacheHitRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_archive_cache_hit_ratio",
+			Help: "Share of archive requests served from the archive cache since startup.",
+		},
+	)
+
+	archiveCacheRequests int64
+	archiveCacheHits     int64
+)
+
+func init() {
+	prometheus.MustRegister(archiveCacheSize)
+	prometheus.MustRegister(archiveCacheFiles)
+	prometheus.MustRegister(archiveCacheEvictions)
+	prometheus.MustRegister(archiveCacheHitRatio)
+}
+
+// ArchiveCacheManager evicts archives from the cache directory that
+// finalizeCachedArchive links them into. Archives older than the maximum
+// age go first, then the least recently used ones until the cache fits
+// in its maximum size. It also removes tempfiles that failed generations
+// left behind.
+type ArchiveCacheManager struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	sync.Mutex
+	// Last cache hits by path. Archives that have not been hit since
+	// startup count as used when they were created.
+	lastUsed map[string]time.Time
+}
+
+var archiveCacheManager *ArchiveCacheManager
+
+// StartArchiveCacheManager starts evicting archives in the background if
+// cfg sets CacheDir.
+func StartArchiveCacheManager(cfg *config.ArchiveConfig) error {
+	m, err := NewArchiveCacheManager(cfg)
+	if err != nil || m == nil {
+		return err
+	}
+
+	archiveCacheManager = m
+	go m.run()
+	return nil
+}
+
+// NewArchiveCacheManager returns nil if cfg does not set CacheDir. A zero
+// CacheMaxSize or CacheMaxAge means no limit.
+func NewArchiveCacheManager(cfg *config.ArchiveConfig) (*ArchiveCacheManager, error) {
+	if cfg == nil || cfg.CacheDir == "" {
+		return nil, nil
+	}
+
+	// Archive paths from Rails have their symlinks resolved, so the
+	// paths we find in the cache directory must too
+	dir, err := filepath.EvalSymlinks(cfg.CacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("NewArchiveCacheManager: %v", err)
+	}
+	if cfg.CacheMaxSize < 0 {
+		return nil, fmt.Errorf("NewArchiveCacheManager: invalid maximum size %d", cfg.CacheMaxSize)
+	}
+
+	m := &ArchiveCacheManager{
+		dir:      dir,
+		maxSize:  cfg.CacheMaxSize,
+		lastUsed: make(map[string]time.Time),
+	}
+	if cfg.CacheMaxAge != nil {
+		m.maxAge = cfg.CacheMaxAge.Duration
+	}
+
+	return m, nil
+}
+
+func (m *ArchiveCacheManager) run() {
+	for {
+		if err := m.scan(time.Now()); err != nil {
+			log.Printf("ArchiveCacheManager: %v", err)
+		}
+		time.Sleep(archiveCacheScanInterval)
+	}
+}
+
+// used records a cache hit for path.
+func (m *ArchiveCacheManager) used(path string) {
+	m.Lock()
+	defer m.Unlock()
+	m.lastUsed[path] = time.Now()
+}
+
+type archiveCacheFile struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// scan evicts archives and removes leftover tempfiles as of now.
+func (m *ArchiveCacheManager) scan(now time.Time) error {
+	active := activeArchiveTempfiles()
+
+	var files []*archiveCacheFile
+	err := filepath.Walk(m.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Rails may remove directories while we walk them
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), archiveTempfilePrefix) {
+			if !active[path] && now.Sub(info.ModTime()) > archiveTempfileGracePeriod {
+				m.remove(path, "tempfile")
+			}
+			return nil
+		}
+
+		if m.maxAge > 0 && now.Sub(info.ModTime()) > m.maxAge {
+			m.remove(path, "age")
+			return nil
+		}
+
+		files = append(files, &archiveCacheFile{path: path, size: info.Size(), lastUsed: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("scan %s: %v", m.dir, err)
+	}
+
+	m.Lock()
+	lastUsed := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		if t, ok := m.lastUsed[f.path]; ok && t.After(f.lastUsed) {
+			f.lastUsed = t
+			lastUsed[f.path] = t
+		}
+	}
+	// Forget about archives that are gone
+	m.lastUsed = lastUsed
+	m.Unlock()
+
+	var totalSize int64
+	for _, f := range files {
+		totalSize += f.size
+	}
+
+	if m.maxSize > 0 && totalSize > m.maxSize {
+		sort.Slice(files, func(i, j int) bool { return files[i].lastUsed.Before(files[j].lastUsed) })
+		for len(files) > 0 && totalSize > m.maxSize {
+			m.remove(files[0].path, "size")
+			totalSize -= files[0].size
+			files = files[1:]
+		}
+	}
+
+	archiveCacheSize.Set(float64(totalSize))
+	archiveCacheFiles.Set(float64(len(files)))
+	return nil
+}
+
+func (m *ArchiveCacheManager) remove(path string, reason string) {
+	// Requests that are serving the file keep it open, so they are not
+	// affected
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("ArchiveCacheManager: %v", err)
+		return
+	}
+	archiveCacheEvictions.WithLabelValues(reason).Inc()
+}
+
+// activeArchiveTempfiles returns the tempfiles of running generations.
+func activeArchiveTempfiles() map[string]bool {
+	generationsMutex.Lock()
+	defer generationsMutex.Unlock()
+
+	active := make(map[string]bool, len(generations))
+	for _, gen := range generations {
+		active[gen.tempPath] = true
+	}
+	return active
+}
+
+// recordArchiveCacheRequest counts an archive request by result (hit,
+// miss, coalesced).
+func recordArchiveCacheRequest(result string, archivePath string) {
+	gitArchiveCache.WithLabelValues(result).Inc()
+
+	requests := atomic.AddInt64(&archiveCacheRequests, 1)
+	hits := atomic.LoadInt64(&archiveCacheHits)
+	if result == "hit" {
+		hits = atomic.AddInt64(&archiveCacheHits, 1)
+		if archiveCacheManager != nil {
+			archiveCacheManager.used(archivePath)
+		}
+	}
+	archiveCacheHitRatio.Set(float64(hits) / float64(requests))
+}
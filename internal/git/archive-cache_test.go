@@ -0,0 +1,125 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func testArchiveCacheManager(t *testing.T, cfg config.ArchiveConfig) (*ArchiveCacheManager, string) {
+	dir, err := ioutil.TempDir("", "archive-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.CacheDir = dir
+	m, err := NewArchiveCacheManager(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, m.dir
+}
+
+func writeArchiveCacheFile(t *testing.T, path string, size int, modTime time.Time) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertArchiveCacheFiles(t *testing.T, present []string, absent []string) {
+	for _, path := range present {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+	for _, path := range absent {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestArchiveCacheManagerDisabled(t *testing.T) {
+	m, err := NewArchiveCacheManager(&config.ArchiveConfig{})
+	if err != nil || m != nil {
+		t.Fatalf("expected no manager without CacheDir, got %v, %v", m, err)
+	}
+}
+
+func TestArchiveCacheManagerMaxAge(t *testing.T) {
+	m, dir := testArchiveCacheManager(t, config.ArchiveConfig{CacheMaxAge: &config.TomlDuration{Duration: time.Hour}})
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	old := filepath.Join(dir, "project-1", "old.tar.gz")
+	recent := filepath.Join(dir, "project-1", "recent.tar.gz")
+	writeArchiveCacheFile(t, old, 10, now.Add(-2*time.Hour))
+	writeArchiveCacheFile(t, recent, 10, now.Add(-time.Minute))
+
+	// Being used does not keep an archive beyond its maximum age
+	m.used(old)
+
+	if err := m.scan(now); err != nil {
+		t.Fatal(err)
+	}
+	assertArchiveCacheFiles(t, []string{recent}, []string{old})
+}
+
+func TestArchiveCacheManagerMaxSize(t *testing.T) {
+	m, dir := testArchiveCacheManager(t, config.ArchiveConfig{CacheMaxSize: 25})
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	oldest := filepath.Join(dir, "project-1", "a.tar.gz")
+	older := filepath.Join(dir, "project-1", "b.tar.gz")
+	newest := filepath.Join(dir, "project-2", "c.zip")
+	writeArchiveCacheFile(t, oldest, 10, now.Add(-3*time.Hour))
+	writeArchiveCacheFile(t, older, 10, now.Add(-2*time.Hour))
+	writeArchiveCacheFile(t, newest, 10, now.Add(-time.Hour))
+
+	// A cache hit makes the oldest archive the most recently used one
+	m.used(oldest)
+
+	if err := m.scan(now); err != nil {
+		t.Fatal(err)
+	}
+	assertArchiveCacheFiles(t, []string{oldest, newest}, []string{older})
+}
+
+func TestArchiveCacheManagerTempfiles(t *testing.T) {
+	m, dir := testArchiveCacheManager(t, config.ArchiveConfig{})
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	leftover := filepath.Join(dir, "project-1", archiveTempfilePrefix+"archive.tar.gz123")
+	fresh := filepath.Join(dir, "project-1", archiveTempfilePrefix+"archive.tar.gz456")
+	active := filepath.Join(dir, "project-1", archiveTempfilePrefix+"archive.tar.gz789")
+	writeArchiveCacheFile(t, leftover, 10, now.Add(-time.Hour))
+	writeArchiveCacheFile(t, fresh, 10, now)
+	writeArchiveCacheFile(t, active, 10, now.Add(-time.Hour))
+
+	archivePath := filepath.Join(dir, "project-1", "archive.tar.gz")
+	generationsMutex.Lock()
+	generations[archivePath] = newGeneration(active, func() {})
+	generationsMutex.Unlock()
+	defer func() {
+		generationsMutex.Lock()
+		delete(generations, archivePath)
+		generationsMutex.Unlock()
+	}()
+
+	if err := m.scan(now); err != nil {
+		t.Fatal(err)
+	}
+	assertArchiveCacheFiles(t, []string{fresh, active}, []string{leftover})
+}
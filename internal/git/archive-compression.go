@@ -0,0 +1,162 @@
+/*
+In this file we compress 'git archive' output in-process
+*/
+
+package git
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	DefaultArchiveGzipLevel  = 6
+	DefaultArchiveBzip2Level = 9
+	DefaultArchiveXzLevel    = 6
+	DefaultArchiveZstdLevel  = 3
+)
+
+// pgzip splits its input into blocks of this size to compress them
+// concurrently
+const archiveGzipBlockSize = 1024 * 1024
+
+// Dictionary sizes of the 'xz -0' to 'xz -9' presets
+var archiveXzDictCaps = []int{
+	256 * 1024,
+	1024 * 1024,
+	2 * 1024 * 1024,
+	4 * 1024 * 1024,
+	4 * 1024 * 1024,
+	8 * 1024 * 1024,
+	8 * 1024 * 1024,
+	16 * 1024 * 1024,
+	32 * 1024 * 1024,
+	64 * 1024 * 1024,
+}
+
+var (
+	archiveCompression      = defaultArchiveCompression()
+	archiveCompressionMutex sync.RWMutex
+)
+
+func defaultArchiveCompression() config.ArchiveConfig {
+	return config.ArchiveConfig{
+		GzipLevel:   DefaultArchiveGzipLevel,
+		Bzip2Level:  DefaultArchiveBzip2Level,
+		XzLevel:     DefaultArchiveXzLevel,
+		ZstdLevel:   DefaultArchiveZstdLevel,
+		Concurrency: 1,
+	}
+}
+
+// SetArchiveCompression configures the compressors for archive downloads.
+// Zero values keep the defaults.
+func SetArchiveCompression(cfg *config.ArchiveConfig) error {
+	c := defaultArchiveCompression()
+	if cfg.GzipLevel != 0 {
+		c.GzipLevel = cfg.GzipLevel
+	}
+	if cfg.Bzip2Level != 0 {
+		c.Bzip2Level = cfg.Bzip2Level
+	}
+	if cfg.XzLevel != 0 {
+		c.XzLevel = cfg.XzLevel
+	}
+	if cfg.ZstdLevel != 0 {
+		c.ZstdLevel = cfg.ZstdLevel
+	}
+	if cfg.Concurrency != 0 {
+		c.Concurrency = cfg.Concurrency
+	}
+
+	if c.GzipLevel < 1 || c.GzipLevel > 9 {
+		return fmt.Errorf("SetArchiveCompression: invalid gzip level %d", c.GzipLevel)
+	}
+	if c.Bzip2Level < 1 || c.Bzip2Level > 9 {
+		return fmt.Errorf("SetArchiveCompression: invalid bzip2 level %d", c.Bzip2Level)
+	}
+	if c.XzLevel < 0 || c.XzLevel >= len(archiveXzDictCaps) {
+		return fmt.Errorf("SetArchiveCompression: invalid xz level %d", c.XzLevel)
+	}
+	if c.ZstdLevel < 1 || c.ZstdLevel > 22 {
+		return fmt.Errorf("SetArchiveCompression: invalid zstd level %d", c.ZstdLevel)
+	}
+	if c.Concurrency < 1 {
+		return fmt.Errorf("SetArchiveCompression: invalid concurrency %d", c.Concurrency)
+	}
+
+	archiveCompressionMutex.Lock()
+	defer archiveCompressionMutex.Unlock()
+	archiveCompression = c
+
+	return nil
+}
+
+func getArchiveCompression() config.ArchiveConfig {
+	archiveCompressionMutex.RLock()
+	defer archiveCompressionMutex.RUnlock()
+	return archiveCompression
+}
+
+// compressorFunc returns a writer that compresses to w. Closing it
+// flushes the compressor but does not close w.
+type compressorFunc func(w io.Writer) (io.WriteCloser, error)
+
+func newGzipCompressor(w io.Writer) (io.WriteCloser, error) {
+	c := getArchiveCompression()
+
+	// Like 'gzip -n', pgzip leaves out the file name and timestamp
+	gz, err := pgzip.NewWriterLevel(w, c.GzipLevel)
+	if err != nil {
+		return nil, err
+	}
+	if err := gz.SetConcurrency(archiveGzipBlockSize, c.Concurrency); err != nil {
+		return nil, err
+	}
+
+	return gz, nil
+}
+
+func newBzip2Compressor(w io.Writer) (io.WriteCloser, error) {
+	return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: getArchiveCompression().Bzip2Level})
+}
+
+func newXzCompressor(w io.Writer) (io.WriteCloser, error) {
+	return xz.WriterConfig{DictCap: archiveXzDictCaps[getArchiveCompression().XzLevel]}.NewWriter(w)
+}
+
+func newZstdCompressor(w io.Writer) (io.WriteCloser, error) {
+	c := getArchiveCompression()
+
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.ZstdLevel)),
+		zstd.WithEncoderConcurrency(c.Concurrency),
+	)
+}
+
+// compressArchive copies r to w through compressor
+func compressArchive(newCompressor compressorFunc, w io.Writer, r io.Reader) error {
+	compressor, err := newCompressor(w)
+	if err != nil {
+		return fmt.Errorf("create compressor: %v", err)
+	}
+
+	if _, err := io.Copy(compressor, r); err != nil {
+		compressor.Close()
+		return fmt.Errorf("compress: %v", err)
+	}
+
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("close compressor: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestCompressArchive(t *testing.T) {
+	data := strings.Repeat("gitlab-workhorse archive ", 100000)
+
+	for _, testCase := range []struct {
+		desc          string
+		newCompressor compressorFunc
+		newReader     func(io.Reader) (io.Reader, error)
+	}{
+		{
+			desc:          "gzip",
+			newCompressor: newGzipCompressor,
+			newReader:     func(r io.Reader) (io.Reader, error) { return pgzip.NewReader(r) },
+		},
+		{
+			desc:          "bzip2",
+			newCompressor: newBzip2Compressor,
+			newReader:     func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r, nil) },
+		},
+		{
+			desc:          "xz",
+			newCompressor: newXzCompressor,
+			newReader:     func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+		},
+		{
+			desc:          "zstd",
+			newCompressor: newZstdCompressor,
+			newReader:     func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		},
+	} {
+		t.Run(testCase.desc, func(t *testing.T) {
+			var compressed bytes.Buffer
+			if err := compressArchive(testCase.newCompressor, &compressed, strings.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if compressed.Len() >= len(data) {
+				t.Fatalf("expected output to be compressed, got %d bytes", compressed.Len())
+			}
+
+			r, err := testCase.newReader(&compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != data {
+				t.Fatal("decompressed output does not match input")
+			}
+		})
+	}
+}
+
+func TestSetArchiveCompression(t *testing.T) {
+	defer SetArchiveCompression(&config.ArchiveConfig{})
+
+	if err := SetArchiveCompression(&config.ArchiveConfig{GzipLevel: 1, ZstdLevel: 19, Concurrency: 4}); err != nil {
+		t.Fatal(err)
+	}
+	c := getArchiveCompression()
+	if c.GzipLevel != 1 || c.ZstdLevel != 19 || c.Concurrency != 4 {
+		t.Fatalf("unexpected configuration %+v", c)
+	}
+	if c.Bzip2Level != DefaultArchiveBzip2Level || c.XzLevel != DefaultArchiveXzLevel {
+		t.Fatalf("expected defaults for unset levels, got %+v", c)
+	}
+
+	for _, cfg := range []config.ArchiveConfig{
+		{GzipLevel: 10},
+		{Bzip2Level: -1},
+		{XzLevel: 10},
+		{ZstdLevel: 23},
+		{Concurrency: -1},
+	} {
+		if err := SetArchiveCompression(&cfg); err == nil {
+			t.Fatalf("expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -5,6 +5,9 @@ In this file we handle 'git archive' downloads
 package git
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,8 +15,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 
@@ -26,6 +32,8 @@ type archiveParams struct {
 	ArchivePath   string
 	ArchivePrefix string
 	CommitId      string
+	// Path optionally limits the archive to these pathspecs
+	Path []string
 }
 
 var (
@@ -50,6 +58,24 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 		return
 	}
 
+	var err error
+	if params.RepoPath, err = confinement.Resolve(params.RepoPath); err != nil {
+		confinement.Fail(w, r, "SendArchive", err)
+		return
+	}
+	if params.ArchivePath, err = confinement.Resolve(params.ArchivePath); err != nil {
+		confinement.Fail(w, r, "SendArchive", err)
+		return
+	}
+
+	for _, p := range params.Path {
+		if p == "" {
+			helper.Fail500(w, r, fmt.Errorf("SendArchive: empty path"))
+			return
+		}
+	}
+	params.ArchivePath = archiveCachePath(params.ArchivePath, params.Path)
+
 	urlPath := r.URL.Path
 	format, ok := parseBasename(filepath.Base(urlPath))
 	if !ok {
@@ -61,7 +87,7 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 
 	if cachedArchive, err := os.Open(params.ArchivePath); err == nil {
 		defer cachedArchive.Close()
-		gitArchiveCache.WithLabelValues("hit").Inc()
+		recordArchiveCacheRequest("hit", params.ArchivePath)
 		setArchiveHeaders(w, format, archiveFilename)
 		// Even if somebody deleted the cachedArchive from disk since we opened
 		// the file, Unix file semantics guarantee we can still read from the
@@ -70,40 +96,34 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 		return
 	}
 
-	gitArchiveCache.WithLabelValues("miss").Inc()
-
-	// We assume the tempFile has a unique name so that concurrent requests are
-	// safe. We create the tempfile in the same directory as the final cached
-	// archive we want to create so that we can use an atomic link(2) operation
-	// to finalize the cached archive.
-	tempFile, err := prepareArchiveTempfile(path.Dir(params.ArchivePath), archiveFilename)
+	// Concurrent requests for the same archive share one 'git archive'
+	follower, started, err := followGeneration(r.Context(), params.ArchivePath, func(ctx context.Context) (io.Reader, error) {
+		return newArchiveReader(ctx, params.RepoPath, format, params.ArchivePrefix, params.CommitId, params.Path)
+	})
 	if err != nil {
-		helper.Fail500(w, r, fmt.Errorf("SendArchive: create tempfile: %v", err))
+		helper.Fail500(w, r, fmt.Errorf("SendArchive: %v", err))
 		return
 	}
-	defer tempFile.Close()
-	defer os.Remove(tempFile.Name())
+	defer follower.Close()
 
-	archiveReader, err := newArchiveReader(r.Context(), params.RepoPath, format, params.ArchivePrefix, params.CommitId)
-	if err != nil {
-		helper.Fail500(w, r, err)
-		return
+	if started {
+		recordArchiveCacheRequest("miss", params.ArchivePath)
+	} else {
+		recordArchiveCacheRequest("coalesced", params.ArchivePath)
 	}
 
-	reader := io.TeeReader(archiveReader, tempFile)
+	if err := follower.ready(); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendArchive: generate archive: %v", err))
+		return
+	}
 
 	// Start writing the response
 	setArchiveHeaders(w, format, archiveFilename)
 	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
-	if _, err := io.Copy(w, reader); err != nil {
+	if _, err := io.Copy(w, follower); err != nil {
 		helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy 'git archive' output: %v", err)})
 		return
 	}
-
-	if err := finalizeCachedArchive(tempFile, params.ArchivePath); err != nil {
-		helper.LogError(r, fmt.Errorf("SendArchive: finalize cached archive: %v", err))
-		return
-	}
 }
 
 func setArchiveHeaders(w http.ResponseWriter, format ArchiveFormat, archiveFilename string) {
@@ -122,7 +142,7 @@ func prepareArchiveTempfile(dir string, prefix string) (*os.File, error) {
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
-	return ioutil.TempFile(dir, prefix)
+	return ioutil.TempFile(dir, archiveTempfilePrefix+prefix)
 }
 
 func finalizeCachedArchive(tempFile *os.File, archivePath string) error {
@@ -136,6 +156,22 @@ func finalizeCachedArchive(tempFile *os.File, archivePath string) error {
 	return nil
 }
 
+// archiveCachePath returns where the archive limited to paths is cached.
+// Filtered archives go into a subdirectory of the directory of the full
+// archive, named after the paths, so that they keep its file name.
+func archiveCachePath(archivePath string, paths []string) string {
+	if len(paths) == 0 {
+		return archivePath
+	}
+
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\x00")))
+	filtered := "filtered-" + hex.EncodeToString(sum[:])
+
+	return path.Join(path.Dir(archivePath), filtered, path.Base(archivePath))
+}
+
 func parseBasename(basename string) (ArchiveFormat, bool) {
 	var format ArchiveFormat
 
@@ -148,6 +184,10 @@ func parseBasename(basename string) (ArchiveFormat, bool) {
 		format = TarGzFormat
 	case "archive.tar.bz2", "archive.tbz", "archive.tbz2", "archive.tb2", "archive.bz2":
 		format = TarBz2Format
+	case "archive.tar.xz", "archive.txz":
+		format = TarXzFormat
+	case "archive.tar.zst":
+		format = TarZstdFormat
 	default:
 		return InvalidFormat, false
 	}
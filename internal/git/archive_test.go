@@ -1,8 +1,15 @@
 package git
 
 import (
+	"archive/tar"
+	"context"
+	"io"
 	"io/ioutil"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
 	"testing"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
@@ -22,6 +29,9 @@ func TestParseBasename(t *testing.T) {
 		{".tbz2", TarBz2Format},
 		{".tb2", TarBz2Format},
 		{".bz2", TarBz2Format},
+		{".tar.xz", TarXzFormat},
+		{".txz", TarXzFormat},
+		{".tar.zst", TarZstdFormat},
 	} {
 		basename := "archive" + testCase.in
 		out, ok := parseBasename(basename)
@@ -35,6 +45,83 @@ func TestParseBasename(t *testing.T) {
 	}
 }
 
+func TestArchiveCachePath(t *testing.T) {
+	archivePath := "/cache/project-1/abc/gitlab-abc.tar.gz"
+
+	if out := archiveCachePath(archivePath, nil); out != archivePath {
+		t.Fatalf("expected full archive at %q, got %q", archivePath, out)
+	}
+
+	docs := archiveCachePath(archivePath, []string{"docs", "README.md"})
+	if filepath.Dir(filepath.Dir(docs)) != filepath.Dir(archivePath) || filepath.Base(docs) != filepath.Base(archivePath) {
+		t.Fatalf("expected filtered archive next to full archive, got %q", docs)
+	}
+	if out := archiveCachePath(archivePath, []string{"README.md", "docs"}); out != docs {
+		t.Fatalf("expected order of paths not to matter, got %q and %q", docs, out)
+	}
+	if out := archiveCachePath(archivePath, []string{"docs"}); out == docs {
+		t.Fatalf("expected different paths to be cached separately, got %q", out)
+	}
+}
+
+func TestArchiveReaderPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-paths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"docs/index.md", "src/main.go", "README.md"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "test"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	r, err := newArchiveReader(context.Background(), filepath.Join(dir, ".git"), TarFormat, "project", "HEAD", []string{"docs", "README.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			files = append(files, header.Name)
+		}
+	}
+	// Drain the rest so that git exits
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(files)
+	if len(files) != 2 || files[0] != "project/README.md" || files[1] != "project/docs/index.md" {
+		t.Fatalf("unexpected files in archive: %v", files)
+	}
+}
+
 func TestFinalizeArchive(t *testing.T) {
 	tempFile, err := ioutil.TempFile("", "gitlab-workhorse-test")
 	if err != nil {
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
-	"syscall"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
@@ -18,16 +17,22 @@ const (
 	TarFormat
 	TarGzFormat
 	TarBz2Format
+	TarXzFormat
+	TarZstdFormat
 )
 
-func parseArchiveFormat(format ArchiveFormat) (*exec.Cmd, string) {
+func parseArchiveFormat(format ArchiveFormat) (compressorFunc, string) {
 	switch format {
 	case TarFormat:
 		return nil, "tar"
 	case TarGzFormat:
-		return exec.Command("gzip", "-c", "-n"), "tar"
+		return newGzipCompressor, "tar"
 	case TarBz2Format:
-		return exec.Command("bzip2", "-c"), "tar"
+		return newBzip2Compressor, "tar"
+	case TarXzFormat:
+		return newXzCompressor, "tar"
+	case TarZstdFormat:
+		return newZstdCompressor, "tar"
 	case ZipFormat:
 		return nil, "zip"
 	default:
@@ -70,16 +75,21 @@ func (a *archiveReader) wait() error {
 	return nil
 }
 
-func newArchiveReader(ctx context.Context, repoPath string, format ArchiveFormat, archivePrefix string, commitId string) (a *archiveReader, err error) {
+func newArchiveReader(ctx context.Context, repoPath string, format ArchiveFormat, archivePrefix string, commitId string, paths []string) (a *archiveReader, err error) {
 	a = &archiveReader{}
 
-	compressCmd, formatArg := parseArchiveFormat(format)
-	archiveCmd := gitCommand("", "", "git", "--git-dir="+repoPath, "archive", "--format="+formatArg, "--prefix="+archivePrefix+"/", commitId)
+	newCompressor, formatArg := parseArchiveFormat(format)
+	args := []string{"--git-dir=" + repoPath, "archive", "--format=" + formatArg, "--prefix=" + archivePrefix + "/", commitId}
+	if len(paths) > 0 {
+		args = append(args, "--")
+		args = append(args, paths...)
+	}
+	archiveCmd := gitCommand("", "", "git", args...)
 
 	var archiveStdout io.ReadCloser
 	archiveStdout, err = archiveCmd.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("SendArchive: archive stdout: %v", err)
+		return nil, fmt.Errorf("archive stdout: %v", err)
 	}
 	defer func() {
 		if err != nil {
@@ -89,34 +99,22 @@ func newArchiveReader(ctx context.Context, repoPath string, format ArchiveFormat
 
 	a.stdout = archiveStdout
 
-	if compressCmd != nil {
-		compressCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-		compressCmd.Stdin = archiveStdout
-
-		var compressStdout io.ReadCloser
-		compressStdout, err = compressCmd.StdoutPipe()
-		if err != nil {
-			return nil, fmt.Errorf("SendArchive: compress stdout: %v", err)
-		}
-		defer func() {
-			if err != nil {
-				compressStdout.Close()
-			}
+	if newCompressor != nil {
+		compressedReader, compressedWriter := io.Pipe()
+		go func() {
+			compressedWriter.CloseWithError(compressArchive(newCompressor, compressedWriter, archiveStdout))
+		}()
+		go func() {
+			// Unblock the compressor if nobody reads its output any more
+			<-ctx.Done()
+			compressedReader.CloseWithError(ctx.Err())
 		}()
 
-		if err := compressCmd.Start(); err != nil {
-			return nil, fmt.Errorf("SendArchive: start %v: %v", compressCmd.Args, err)
-		}
-
-		go ctxKill(ctx, compressCmd)
-		a.waitCmds = append(a.waitCmds, compressCmd)
-
-		a.stdout = compressStdout
-		archiveStdout.Close()
+		a.stdout = compressedReader
 	}
 
 	if err := archiveCmd.Start(); err != nil {
-		return nil, fmt.Errorf("SendArchive: start %v: %v", archiveCmd.Args, err)
+		return nil, fmt.Errorf("start %v: %v", archiveCmd.Args, err)
 	}
 
 	go ctxKill(ctx, archiveCmd)
@@ -0,0 +1,228 @@
+/*
+In this file we serve the object an LFS pointer blob points to
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// Git LFS does not consider larger blobs to be pointers
+const lfsPointerMaxSize = 1024
+
+var (
+	lfsPointerVersions = []string{
+		"https://git-lfs.github.com/spec/v1",
+		"https://hawser.github.com/spec/v1",
+	}
+	lfsOidPattern = regexp.MustCompile(`\Asha256:([0-9a-f]{64})\z`)
+)
+
+// blobLfsParams lets SendBlob serve LFS objects instead of their
+// pointers. Rails lists the objects that are linked to the project, so a
+// pointer cannot give access to the objects of other projects.
+type blobLfsParams struct {
+	// StorePath is the root of the local LFS store
+	StorePath string
+	// Objects maps oids to pre-signed object storage URLs, or to "" for
+	// objects in StorePath
+	Objects map[string]string
+}
+
+type lfsPointer struct {
+	oid  string
+	size int64
+}
+
+// parseLfsPointer returns nil if data is not an LFS pointer.
+func parseLfsPointer(data []byte) *lfsPointer {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "version ") {
+		return nil
+	}
+	version := strings.TrimPrefix(scanner.Text(), "version ")
+	known := false
+	for _, v := range lfsPointerVersions {
+		known = known || version == v
+	}
+	if !known {
+		return nil
+	}
+
+	pointer := &lfsPointer{size: -1}
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil
+		}
+
+		switch fields[0] {
+		case "oid":
+			match := lfsOidPattern.FindStringSubmatch(fields[1])
+			if match == nil {
+				return nil
+			}
+			pointer.oid = match[1]
+		case "size":
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || size < 0 {
+				return nil
+			}
+			pointer.size = size
+		}
+	}
+
+	if pointer.oid == "" || pointer.size < 0 {
+		return nil
+	}
+	return pointer
+}
+
+// serveBlobContent is serveBlob, except that with params.Lfs set small
+// blobs are checked for being LFS pointers first.
+func serveBlobContent(w http.ResponseWriter, r *http.Request, params *blobParams, size int64, reader io.Reader) bool {
+	if params.Lfs == nil || size >= lfsPointerMaxSize {
+		return serveBlob(w, r, size, reader)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, size))
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: read blob: %v", err))
+		return false
+	}
+
+	if pointer := parseLfsPointer(data); pointer != nil {
+		if location, ok := params.Lfs.Objects[pointer.oid]; ok {
+			serveLfsObject(w, r, params.Lfs, pointer, location)
+			return int64(len(data)) == size
+		}
+		log.Printf("SendBlob: LFS object %s is not linked to the project of %q", pointer.oid, r.URL.Path)
+	}
+
+	return serveBlob(w, r, size, bytes.NewReader(data))
+}
+
+func serveLfsObject(w http.ResponseWriter, r *http.Request, lfs *blobLfsParams, pointer *lfsPointer, location string) {
+	if location != "" {
+		serveRemoteLfsObject(w, r, pointer, location)
+		return
+	}
+
+	if lfs.StorePath == "" {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: LFS object %s is in the local store, but StorePath is empty", pointer.oid))
+		return
+	}
+
+	// This is how Rails lays out the LFS store
+	path := filepath.Join(lfs.StorePath, pointer.oid[0:2], pointer.oid[2:4], pointer.oid[4:])
+	path, err := confinement.Resolve(path)
+	if err != nil {
+		confinement.Fail(w, r, "SendBlob", err)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: open LFS object: %v", err))
+		return
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: stat LFS object: %v", err))
+		return
+	}
+	if fi.Size() != pointer.size {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: LFS object %s has size %d, pointer says %d", pointer.oid, fi.Size(), pointer.size))
+		return
+	}
+
+	serveBlob(w, r, pointer.size, file)
+}
+
+func serveRemoteLfsObject(w http.ResponseWriter, r *http.Request, pointer *lfsPointer, url string) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: LFS object request: %v", err))
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: get LFS object: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: get LFS object: %s", resp.Status))
+		return
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != pointer.size {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: LFS object %s has size %d, pointer says %d", pointer.oid, resp.ContentLength, pointer.size))
+		return
+	}
+
+	// Without a Content-Length we only find out while copying that the
+	// object does not match the pointer. By then the client has the
+	// status and the length from the pointer, so all we can do is to
+	// break the connection instead of ending the response normally.
+	body := &lfsObjectReader{r: resp.Body, remaining: pointer.size}
+	serveBlob(w, r, pointer.size, body)
+	if body.mismatch != nil {
+		helper.LogError(r, fmt.Errorf("SendBlob: LFS object %s: %v", pointer.oid, body.mismatch))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// lfsObjectReader fails if the object it reads is not exactly remaining
+// bytes long.
+type lfsObjectReader struct {
+	r         io.Reader
+	remaining int64
+	mismatch  error
+}
+
+func (l *lfsObjectReader) Read(p []byte) (int, error) {
+	if l.mismatch != nil {
+		return 0, l.mismatch
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+
+	switch {
+	case l.remaining < 0:
+		l.mismatch = fmt.Errorf("object is longer than the pointer says")
+	case err == io.EOF && l.remaining > 0:
+		l.mismatch = fmt.Errorf("object is %d bytes shorter than the pointer says", l.remaining)
+	case l.remaining == 0 && err == nil:
+		// Make sure nothing follows
+		var extra [1]byte
+		if m, _ := io.ReadFull(l.r, extra[:]); m > 0 {
+			l.mismatch = fmt.Errorf("object is longer than the pointer says")
+		}
+	}
+
+	if l.mismatch != nil {
+		return n, l.mismatch
+	}
+	return n, err
+}
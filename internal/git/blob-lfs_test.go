@@ -0,0 +1,205 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testLfsPointer(oid string, size int) string {
+	return fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", oid, size)
+}
+
+func testLfsOid(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseLfsPointer(t *testing.T) {
+	oid := testLfsOid("content")
+
+	for _, testCase := range []struct {
+		desc    string
+		data    string
+		pointer *lfsPointer
+	}{
+		{desc: "pointer", data: testLfsPointer(oid, 7), pointer: &lfsPointer{oid: oid, size: 7}},
+		{
+			desc:    "pointer with extensions",
+			data:    "version https://git-lfs.github.com/spec/v1\next-0-foo sha256:" + oid + "\noid sha256:" + oid + "\nsize 7\n",
+			pointer: &lfsPointer{oid: oid, size: 7},
+		},
+		{desc: "unknown version", data: "version https://example.com/spec/v9\noid sha256:" + oid + "\nsize 7\n"},
+		{desc: "no size", data: "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\n"},
+		{desc: "invalid oid", data: "version https://git-lfs.github.com/spec/v1\noid sha256:../../etc/passwd\nsize 7\n"},
+		{desc: "text", data: "just some text\n"},
+	} {
+		t.Run(testCase.desc, func(t *testing.T) {
+			pointer := parseLfsPointer([]byte(testCase.data))
+			if (pointer == nil) != (testCase.pointer == nil) || (pointer != nil && *pointer != *testCase.pointer) {
+				t.Fatalf("expected %v, got %v", testCase.pointer, pointer)
+			}
+		})
+	}
+}
+
+func TestServeBlobContentLfs(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "lfs-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	content := "\x89PNG\x0D\x0A\x1A\x0A a picture"
+	oid := testLfsOid(content)
+	objectPath := filepath.Join(storePath, oid[0:2], oid[2:4], oid[4:])
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(objectPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/signed" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer remote.Close()
+
+	otherOid := testLfsOid("another project's secret")
+
+	for _, testCase := range []struct {
+		desc    string
+		pointer string
+		objects map[string]string
+		code    int
+		body    string
+	}{
+		{desc: "local store", pointer: testLfsPointer(oid, len(content)), objects: map[string]string{oid: ""}, code: 200, body: content},
+		{desc: "object storage", pointer: testLfsPointer(oid, len(content)), objects: map[string]string{oid: remote.URL + "/signed"}, code: 200, body: content},
+		{desc: "object storage error", pointer: testLfsPointer(oid, len(content)), objects: map[string]string{oid: remote.URL + "/expired"}, code: 500},
+		{desc: "size mismatch", pointer: testLfsPointer(oid, 3), objects: map[string]string{oid: ""}, code: 500},
+		{desc: "not linked to the project", pointer: testLfsPointer(otherOid, 10), objects: map[string]string{oid: ""}, code: 200, body: testLfsPointer(otherOid, 10)},
+	} {
+		t.Run(testCase.desc, func(t *testing.T) {
+			params := &blobParams{Lfs: &blobLfsParams{StorePath: storePath, Objects: testCase.objects}}
+			r := httptest.NewRequest("GET", "/raw/master/picture.png", nil)
+			w := httptest.NewRecorder()
+
+			serveBlobContent(w, r, params, int64(len(testCase.pointer)), bytes.NewReader([]byte(testCase.pointer)))
+
+			if w.Code != testCase.code {
+				t.Fatalf("expected status %d, got %d", testCase.code, w.Code)
+			}
+			if testCase.code == 200 && w.Body.String() != testCase.body {
+				t.Fatalf("expected body %q, got %q", testCase.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeBlobContentLfsRange(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "lfs-objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	content := strings.Repeat("0123456789", 100)
+	oid := testLfsOid(content)
+	objectPath := filepath.Join(storePath, oid[0:2], oid[2:4], oid[4:])
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(objectPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pointer := testLfsPointer(oid, len(content))
+	params := &blobParams{Lfs: &blobLfsParams{StorePath: storePath, Objects: map[string]string{oid: ""}}}
+	r := httptest.NewRequest("GET", "/raw/master/digits.txt", nil)
+	r.Header.Set("Range", "bytes=995-")
+	w := httptest.NewRecorder()
+
+	serveBlobContent(w, r, params, int64(len(pointer)), bytes.NewReader([]byte(pointer)))
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d", w.Code)
+	}
+	if w.Body.String() != "56789" {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+}
+
+func TestServeBlobContentLfsWithoutStorePath(t *testing.T) {
+	oid := testLfsOid("content")
+	pointer := testLfsPointer(oid, 7)
+
+	params := &blobParams{Lfs: &blobLfsParams{Objects: map[string]string{oid: ""}}}
+	r := httptest.NewRequest("GET", "/raw/master/file", nil)
+	w := httptest.NewRecorder()
+	serveBlobContent(w, r, params, int64(len(pointer)), bytes.NewReader([]byte(pointer)))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", w.Code)
+	}
+}
+
+func TestServeBlobContentRemoteLfsSizeMismatch(t *testing.T) {
+	content := "\x89PNG\x0D\x0A\x1A\x0A a picture"
+	oid := testLfsOid(content)
+
+	for _, testCase := range []struct {
+		desc string
+		body string
+	}{
+		{desc: "shorter", body: content[:5]},
+		{desc: "longer", body: content + " and more"},
+	} {
+		t.Run(testCase.desc, func(t *testing.T) {
+			remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Chunked, so without a Content-Length
+				w.Write([]byte(testCase.body[:1]))
+				w.(http.Flusher).Flush()
+				w.Write([]byte(testCase.body[1:]))
+			}))
+			defer remote.Close()
+
+			pointer := testLfsPointer(oid, len(content))
+			params := &blobParams{Lfs: &blobLfsParams{Objects: map[string]string{oid: remote.URL}}}
+			r := httptest.NewRequest("GET", "/raw/master/picture.png", nil)
+			w := httptest.NewRecorder()
+
+			defer func() {
+				if p := recover(); p != http.ErrAbortHandler {
+					t.Fatalf("expected the response to be aborted, got %v", p)
+				}
+			}()
+			serveBlobContent(w, r, params, int64(len(pointer)), bytes.NewReader([]byte(pointer)))
+		})
+	}
+}
+
+func TestServeBlobContentWithoutLfs(t *testing.T) {
+	oid := testLfsOid("content")
+	pointer := testLfsPointer(oid, 7)
+
+	r := httptest.NewRequest("GET", "/raw/master/file", nil)
+	w := httptest.NewRecorder()
+	serveBlobContent(w, r, &blobParams{}, int64(len(pointer)), bytes.NewReader([]byte(pointer)))
+
+	if w.Body.String() != pointer {
+		t.Fatalf("expected the pointer, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,194 @@
+/*
+In this file we handle conditional and range requests for blobs, and
+decide on their content type
+*/
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// http.DetectContentType looks at no more than this many bytes
+const blobSniffLength = 512
+
+const blobFallbackContentType = "text/plain; charset=utf-8"
+
+// Sniffed content types we pass on. Everything else, HTML in particular,
+// is served as plain text so that browsers do not render it.
+var blobSafeContentTypes = []string{
+	"image/",
+	"audio/",
+	"video/",
+	"application/octet-stream",
+	"application/pdf",
+	"application/zip",
+	"application/x-gzip",
+}
+
+// blobETag is a strong validator: the contents of a blob never change.
+// Responses that may contain the LFS object instead of the pointer, or
+// only the first limit bytes of the blob, get a different one. A negative
+// limit stands for the whole blob.
+func blobETag(blobId string, limit int64, lfs bool) string {
+	if blobId == "" {
+		return ""
+	}
+
+	etag := blobId
+	if limit >= 0 {
+		etag += fmt.Sprintf("-%d", limit)
+	}
+	if lfs {
+		etag += "-lfs"
+	}
+	return `"` + etag + `"`
+}
+
+// etagMatches implements the weak comparison of If-None-Match.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+type blobRange struct {
+	start  int64
+	length int64
+}
+
+// parseBlobRange returns nil for requests we answer with the whole blob.
+// We only support a single range; the RFC allows us to ignore the rest.
+func parseBlobRange(r *http.Request, etag string, size int64) (*blobRange, error) {
+	header := r.Header.Get("Range")
+	if header == "" || !strings.HasPrefix(header, "bytes=") {
+		return nil, nil
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != etag {
+		return nil, nil
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return nil, fmt.Errorf("invalid range %q", header)
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return nil, fmt.Errorf("invalid range %q", header)
+		}
+		if n > size {
+			n = size
+		}
+		return &blobRange{start: size - n, length: n}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return nil, fmt.Errorf("invalid range %q", header)
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid range %q", header)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return &blobRange{start: start, length: end - start + 1}, nil
+}
+
+func sniffBlobContentType(data []byte) string {
+	contentType := http.DetectContentType(data)
+	for _, safe := range blobSafeContentTypes {
+		if strings.HasPrefix(contentType, safe) {
+			return contentType
+		}
+	}
+	return blobFallbackContentType
+}
+
+// serveBlob writes blob, which is size bytes long, to w, or the range the
+// client asked for. It reports whether it read the blob to the end.
+func serveBlob(w http.ResponseWriter, r *http.Request, size int64, blob io.Reader) bool {
+	reader := blob
+	etag := w.Header().Get("ETag")
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	rng, err := parseBlobRange(r, etag, size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+		return false
+	}
+
+	// Rails knows better than we do, but it does not always tell us.
+	// Sniffing needs the start of the blob even for range requests.
+	if w.Header().Get("Content-Type") == "" {
+		head := make([]byte, blobSniffLength)
+		n, err := io.ReadFull(reader, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			helper.Fail500(w, r, fmt.Errorf("SendBlob: read blob: %v", err))
+			return false
+		}
+		head = head[:n]
+		reader = io.MultiReader(bytes.NewReader(head), reader)
+
+		w.Header().Set("Content-Type", sniffBlobContentType(head))
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	status, length := http.StatusOK, size
+	if rng != nil {
+		// Files, such as LFS objects in the local store, need not be
+		// read up to the range. Pipes from git cannot seek.
+		seeked := false
+		if seeker, ok := blob.(io.Seeker); ok {
+			if _, err := seeker.Seek(rng.start, io.SeekStart); err == nil {
+				reader, seeked = blob, true
+			}
+		}
+		if !seeked {
+			if _, err := io.CopyN(ioutil.Discard, reader, rng.start); err != nil {
+				helper.Fail500(w, r, fmt.Errorf("SendBlob: skip to offset %d: %v", rng.start, err))
+				return false
+			}
+		}
+
+		status, length = http.StatusPartialContent, rng.length
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.start+rng.length-1, size))
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+	if _, err := io.CopyN(w, reader, length); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("SendBlob: copy blob: %v", err)})
+		return false
+	}
+
+	return rng == nil || rng.start+rng.length == size
+}
@@ -0,0 +1,265 @@
+package git
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+// testGitRepository commits files, with their names as contents, to a new
+// repository and returns its git dir
+func testGitRepository(t *testing.T, files ...string) string {
+	dir, err := ioutil.TempDir("", "git-repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "test"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	return filepath.Join(dir, ".git")
+}
+
+func TestEtagMatches(t *testing.T) {
+	etag := `"abc"`
+	for _, testCase := range []struct {
+		header string
+		match  bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"def", "abc"`, true},
+		{`*`, true},
+		{`"def"`, false},
+		{`abc`, false},
+	} {
+		if etagMatches(testCase.header, etag) != testCase.match {
+			t.Errorf("If-None-Match %s: expected match to be %v", testCase.header, testCase.match)
+		}
+	}
+}
+
+func TestParseBlobRange(t *testing.T) {
+	for _, testCase := range []struct {
+		header  string
+		ifRange string
+		rng     *blobRange
+		invalid bool
+	}{
+		{header: ""},
+		{header: "bytes=0-9", rng: &blobRange{0, 10}},
+		{header: "bytes=90-", rng: &blobRange{90, 10}},
+		{header: "bytes=90-200", rng: &blobRange{90, 10}},
+		{header: "bytes=-5", rng: &blobRange{95, 5}},
+		{header: "bytes=-500", rng: &blobRange{0, 100}},
+		{header: "bytes=0-1,5-6"},
+		{header: "items=0-1"},
+		{header: "bytes=0-9", ifRange: `"abc"`, rng: &blobRange{0, 10}},
+		{header: "bytes=0-9", ifRange: `"def"`},
+		{header: "bytes=100-", invalid: true},
+		{header: "bytes=9-0", invalid: true},
+		{header: "bytes=-0", invalid: true},
+		{header: "bytes=x-1", invalid: true},
+	} {
+		r := httptest.NewRequest("GET", "/blob", nil)
+		r.Header.Set("Range", testCase.header)
+		r.Header.Set("If-Range", testCase.ifRange)
+
+		rng, err := parseBlobRange(r, `"abc"`, 100)
+		if testCase.invalid {
+			if err == nil {
+				t.Errorf("Range %s: expected an error", testCase.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Range %s: %v", testCase.header, err)
+			continue
+		}
+		if (rng == nil) != (testCase.rng == nil) || (rng != nil && *rng != *testCase.rng) {
+			t.Errorf("Range %s: expected %v, got %v", testCase.header, testCase.rng, rng)
+		}
+	}
+}
+
+func TestSniffBlobContentType(t *testing.T) {
+	for _, testCase := range []struct {
+		data        string
+		contentType string
+	}{
+		{"\x89PNG\x0D\x0A\x1A\x0A\x00\x00", "image/png"},
+		{"%PDF-1.4", "application/pdf"},
+		{"<html><script>alert(1)</script></html>", blobFallbackContentType},
+		{"<?xml version=\"1.0\"?><svg/>", blobFallbackContentType},
+		{"just some text", blobFallbackContentType},
+		{"\x00\x01\x02\x03", "application/octet-stream"},
+	} {
+		if contentType := sniffBlobContentType([]byte(testCase.data)); contentType != testCase.contentType {
+			t.Errorf("%q: expected %q, got %q", testCase.data, testCase.contentType, contentType)
+		}
+	}
+}
+
+func TestServeBlob(t *testing.T) {
+	data := "<html>" + strings.Repeat("x", 1000)
+
+	for _, testCase := range []struct {
+		desc     string
+		rng      string
+		code     int
+		body     string
+		complete bool
+	}{
+		{desc: "whole blob", code: 200, body: data, complete: true},
+		{desc: "start", rng: "bytes=0-5", code: 206, body: "<html>"},
+		{desc: "beyond sniffed bytes", rng: "bytes=600-609", code: 206, body: "xxxxxxxxxx"},
+		{desc: "end", rng: "bytes=-3", code: 206, body: "xxx", complete: true},
+		{desc: "unsatisfiable", rng: "bytes=2000-", code: 416},
+	} {
+		t.Run(testCase.desc, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/blob", nil)
+			if testCase.rng != "" {
+				r.Header.Set("Range", testCase.rng)
+			}
+			w := httptest.NewRecorder()
+
+			complete := serveBlob(w, r, int64(len(data)), bytes.NewReader([]byte(data)))
+			if w.Code != testCase.code {
+				t.Fatalf("expected status %d, got %d", testCase.code, w.Code)
+			}
+			if complete != testCase.complete {
+				t.Fatalf("expected complete to be %v", testCase.complete)
+			}
+			if testCase.code == 416 {
+				testhelper.AssertResponseWriterHeader(t, w, "Content-Range", "bytes */1006")
+				return
+			}
+
+			if w.Body.String() != testCase.body {
+				t.Fatalf("expected body %q, got %q", testCase.body, w.Body.String())
+			}
+			testhelper.AssertResponseWriterHeader(t, w, "Content-Type", blobFallbackContentType)
+			testhelper.AssertResponseWriterHeader(t, w, "X-Content-Type-Options", "nosniff")
+		})
+	}
+}
+
+func TestServeBlobRailsContentType(t *testing.T) {
+	data := "<html>" + strings.Repeat("x", 1000)
+
+	r := httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("Range", "bytes=600-609")
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "image/svg+xml")
+
+	serveBlob(w, r, int64(len(data)), bytes.NewReader([]byte(data)))
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d", w.Code)
+	}
+	if w.Body.String() != "xxxxxxxxxx" {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Type", "image/svg+xml")
+	testhelper.AssertResponseWriterHeader(t, w, "X-Content-Type-Options", "nosniff")
+}
+
+func TestSendBlobLocally(t *testing.T) {
+	repoPath := testGitRepository(t, "README.md")
+	defer os.RemoveAll(filepath.Dir(repoPath))
+
+	blobId, err := exec.Command("git", "--git-dir="+repoPath, "rev-parse", "HEAD:README.md").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := &blobParams{RepoPath: repoPath, BlobId: strings.TrimSpace(string(blobId))}
+
+	r := httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("Range", "bytes=2-")
+	w := httptest.NewRecorder()
+	handleSendBlobLocally(w, r, params)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d", w.Code)
+	}
+	if w.Body.String() != "ADME.md" {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Range", "bytes 2-8/9")
+}
+
+func TestSendBlobNotModified(t *testing.T) {
+	// The repository does not exist: a 304 must not need it
+	sendData := SendBlob.Prefix + senddata.Prefix(base64.URLEncoding.EncodeToString([]byte(`{"RepoPath":"/nonexistent","BlobId":"abc"}`)))
+
+	r := httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("If-None-Match", `"def", "abc"`)
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, r, string(sendData))
+
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected status 304, got %d", w.Code)
+	}
+	testhelper.AssertResponseWriterHeader(t, w, "ETag", `"abc"`)
+}
+
+func TestBlobETag(t *testing.T) {
+	testCases := []struct {
+		limit    int64
+		lfs      bool
+		expected string
+	}{
+		{-1, false, `"abc"`},
+		{-1, true, `"abc-lfs"`},
+		{0, false, `"abc-0"`},
+		{1024, true, `"abc-1024-lfs"`},
+	}
+
+	for _, tc := range testCases {
+		if etag := blobETag("abc", tc.limit, tc.lfs); etag != tc.expected {
+			t.Errorf("limit %d, lfs %v: expected %s, got %s", tc.limit, tc.lfs, tc.expected, etag)
+		}
+	}
+}
+
+func TestSendBlobNotModifiedWithLimit(t *testing.T) {
+	// Gitaly is not running: a 304 must not need it
+	sendData := SendBlob.Prefix + senddata.Prefix(base64.URLEncoding.EncodeToString([]byte(`{"GitalyServer":{"Address":"unix:/nonexistent"},"GetBlobRequest":{"oid":"abc","limit":4}}`)))
+
+	r := httptest.NewRequest("GET", "/blob", nil)
+	r.Header.Set("If-None-Match", `"abc-4"`)
+	w := httptest.NewRecorder()
+	SendBlob.Inject(w, r, string(sendData))
+
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected status 304, got %d", w.Code)
+	}
+	testhelper.AssertResponseWriterHeader(t, w, "ETag", `"abc-4"`)
+}
@@ -1,12 +1,14 @@
 package git
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
@@ -20,6 +22,7 @@ type blobParams struct {
 	BlobId         string
 	GitalyServer   gitaly.Server
 	GetBlobRequest pb.GetBlobRequest
+	Lfs            *blobLfsParams
 }
 
 var SendBlob = &blob{"git-blob:"}
@@ -31,6 +34,24 @@ func (b *blob) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 		return
 	}
 
+	blobId := params.BlobId
+	if blobId == "" {
+		blobId = params.GetBlobRequest.Oid
+	}
+	// Only Gitaly looks at the limit
+	limit := int64(-1)
+	if params.GitalyServer.Address != "" {
+		limit = params.GetBlobRequest.Limit
+	}
+	if etag := blobETag(blobId, limit, params.Lfs != nil); etag != "" {
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	if params.GitalyServer.Address != "" {
 		handleSendBlobWithGitaly(w, r, &params)
 	} else {
@@ -42,23 +63,43 @@ func handleSendBlobWithGitaly(w http.ResponseWriter, r *http.Request, params *bl
 	blobClient, err := gitaly.NewBlobClient(params.GitalyServer)
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("blob.GetBlob: %v", err))
+		return
 	}
 
-	if err := blobClient.SendBlob(r.Context(), w, &params.GetBlobRequest); err != nil {
+	// Stops the stream if we only need the start of the blob
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	size, reader, err := blobClient.GetBlobReader(ctx, &params.GetBlobRequest)
+	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("blob.GetBlob: %v", err))
+		return
 	}
+
+	serveBlobContent(w, r, params, size, reader)
 }
 
 func handleSendBlobLocally(w http.ResponseWriter, r *http.Request, params *blobParams) {
 	log.Printf("SendBlob: sending %q for %q", params.BlobId, r.URL.Path)
 
-	sizeOutput, err := gitCommand("", "", "git", "--git-dir="+params.RepoPath, "cat-file", "-s", params.BlobId).Output()
+	repoPath, err := confinement.Resolve(params.RepoPath)
+	if err != nil {
+		confinement.Fail(w, r, "SendBlob", err)
+		return
+	}
+
+	sizeOutput, err := gitCommand("", "", "git", "--git-dir="+repoPath, "cat-file", "-s", params.BlobId).Output()
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("SendBlob: get blob size: %v", err))
 		return
 	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(sizeOutput)), 10, 64)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBlob: parse blob size: %v", err))
+		return
+	}
 
-	gitShowCmd := gitCommand("", "", "git", "--git-dir="+params.RepoPath, "cat-file", "blob", params.BlobId)
+	gitShowCmd := gitCommand("", "", "git", "--git-dir="+repoPath, "cat-file", "blob", params.BlobId)
 	stdout, err := gitShowCmd.StdoutPipe()
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("SendBlob: git cat-file stdout: %v", err))
@@ -70,9 +111,8 @@ func handleSendBlobLocally(w http.ResponseWriter, r *http.Request, params *blobP
 	}
 	defer helper.CleanUpProcessGroup(gitShowCmd)
 
-	w.Header().Set("Content-Length", strings.TrimSpace(string(sizeOutput)))
-	if _, err := io.Copy(w, stdout); err != nil {
-		helper.LogError(r, &copyError{fmt.Errorf("SendBlob: copy git cat-file stdout: %v", err)})
+	// If we stopped early, git cat-file gets killed instead
+	if !serveBlobContent(w, r, params, size, stdout) {
 		return
 	}
 	if err := gitShowCmd.Wait(); err != nil {
@@ -0,0 +1,296 @@
+/*
+In this file we handle downloads of several files of a commit as one tar
+or zip archive
+*/
+
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+)
+
+type blobs struct{ senddata.Prefix }
+type blobsParams struct {
+	GitalyServer gitaly.Server
+	Repository   pb.Repository
+	// Revision is a commit ID or ref name
+	Revision string
+	// Paths are files or directories. Directories are added with all
+	// the files below them.
+	Paths []string
+	// Format is "tar" (the default) or "zip"
+	Format string
+	// Filename for Content-Disposition. Defaults to "blobs.<format>".
+	Filename string
+}
+
+// Every path costs a TreeEntry call to look it up and another one for the
+// contents of each file, and every directory below it a GetTreeEntries
+// call, up to treeWalkLimits per path. Rails sends a handful of paths;
+// this keeps mistakes cheap.
+const blobsMaxPaths = 100
+
+// Git file modes
+const (
+	gitModeExecutable = 0100755
+	gitModeSymlink    = 0120000
+)
+
+var SendBlobs = &blobs{"git-blobs:"}
+
+var blobsContentTypes = map[string]string{
+	"tar": "application/x-tar",
+	"zip": "application/zip",
+}
+
+// Gitaly only; there is no local git fallback for this injecter.
+func (b *blobs) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params blobsParams
+	if err := b.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBlobs: unpack sendData: %v", err))
+		return
+	}
+
+	if params.Format == "" {
+		params.Format = "tar"
+	}
+	contentType, ok := blobsContentTypes[params.Format]
+	if !ok {
+		helper.Fail500(w, r, fmt.Errorf("SendBlobs: invalid format %q", params.Format))
+		return
+	}
+	if len(params.Paths) == 0 {
+		helper.Fail500(w, r, fmt.Errorf("SendBlobs: no paths"))
+		return
+	}
+	if len(params.Paths) > blobsMaxPaths {
+		helper.Fail500(w, r, fmt.Errorf("SendBlobs: %d paths, at most %d allowed", len(params.Paths), blobsMaxPaths))
+		return
+	}
+	for i, p := range params.Paths {
+		if p == "" {
+			helper.Fail500(w, r, fmt.Errorf("SendBlobs: empty path"))
+			return
+		}
+		// Gitaly and the archive want "doc/index.md", not "./doc/index.md"
+		params.Paths[i] = path.Clean(p)
+	}
+
+	filename := params.Filename
+	if filename == "" {
+		filename = "blobs." + params.Format
+	}
+
+	log.Printf("SendBlobs: sending %d paths at %q for %q", len(params.Paths), params.Revision, r.URL.Path)
+
+	commitClient, err := gitaly.NewCommitClient(params.GitalyServer)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("commit.TreeEntry: %v", err))
+		return
+	}
+
+	// Look up all paths first so that missing ones still get a 404
+	entries := make([]*pb.TreeEntryResponse, len(params.Paths))
+	for i, path := range params.Paths {
+		entry, err := lookUpBlobsPath(r.Context(), commitClient, &params, path)
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("commit.TreeEntry: %v", err))
+			return
+		}
+		if entry == nil {
+			log.Printf("SendBlobs: %q does not exist at %q", path, params.Revision)
+			http.NotFound(w, r)
+			return
+		}
+		entries[i] = entry
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	w.Header().Set("Cache-Control", "private")
+	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
+
+	archive := newBlobsArchiveWriter(params.Format, w, time.Now())
+	if err := writeBlobs(r.Context(), commitClient, &params, entries, archive); err != nil {
+		helper.LogError(r, fmt.Errorf("SendBlobs: %v", err))
+		if err == gitaly.ErrTreeTooLarge {
+			// Do not let the client mistake part of the files for all
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if err := archive.Close(); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("SendBlobs: close archive: %v", err)})
+		return
+	}
+}
+
+func lookUpBlobsPath(ctx context.Context, client *gitaly.CommitClient, params *blobsParams, path string) (*pb.TreeEntryResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// We only want the type, not the contents
+	entry, _, err := client.GetTreeEntryReader(ctx, &pb.TreeEntryRequest{
+		Repository: &params.Repository,
+		Revision:   []byte(params.Revision),
+		Path:       []byte(path),
+		Limit:      1,
+	})
+	return entry, err
+}
+
+func writeBlobs(ctx context.Context, client *gitaly.CommitClient, params *blobsParams, entries []*pb.TreeEntryResponse, archive blobsArchiveWriter) error {
+	// Overlapping paths must not add a file twice
+	written := make(map[string]bool)
+	writeBlob := func(p string) error {
+		key := path.Clean(p)
+		if written[key] {
+			return nil
+		}
+		written[key] = true
+		return writeBlobsFile(ctx, client, params, p, archive)
+	}
+
+	for i, entry := range entries {
+		switch entry.GetType() {
+		case pb.TreeEntryResponse_BLOB:
+			if err := writeBlob(params.Paths[i]); err != nil {
+				return err
+			}
+		case pb.TreeEntryResponse_TREE:
+			request := &pb.GetTreeEntriesRequest{
+				Repository: &params.Repository,
+				Revision:   []byte(params.Revision),
+				Path:       []byte(params.Paths[i]),
+			}
+			err := client.WalkTree(ctx, request, treeWalkLimits, func(treeEntry *pb.TreeEntry) error {
+				if treeEntry.GetType() != pb.TreeEntry_BLOB {
+					return nil
+				}
+				return writeBlob(string(treeEntry.GetPath()))
+			})
+			if err == gitaly.ErrTreeTooLarge {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("commit.GetTreeEntries: %v", err)
+			}
+		}
+		// Submodules are left out, like in 'git archive'
+	}
+
+	return nil
+}
+
+func writeBlobsFile(ctx context.Context, client *gitaly.CommitClient, params *blobsParams, path string, archive blobsArchiveWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	entry, reader, err := client.GetTreeEntryReader(ctx, &pb.TreeEntryRequest{
+		Repository: &params.Repository,
+		Revision:   []byte(params.Revision),
+		Path:       []byte(path),
+	})
+	if err != nil {
+		return fmt.Errorf("commit.TreeEntry: %v", err)
+	}
+	if entry == nil {
+		return fmt.Errorf("commit.TreeEntry: %q disappeared", path)
+	}
+
+	return archive.writeFile(path, entry.GetMode(), entry.GetSize(), reader)
+}
+
+type blobsArchiveWriter interface {
+	writeFile(name string, gitMode int32, size int64, reader io.Reader) error
+	Close() error
+}
+
+func newBlobsArchiveWriter(format string, w io.Writer, modTime time.Time) blobsArchiveWriter {
+	if format == "zip" {
+		return &zipBlobsWriter{zip.NewWriter(w), modTime}
+	}
+	return &tarBlobsWriter{tar.NewWriter(w), modTime}
+}
+
+type tarBlobsWriter struct {
+	*tar.Writer
+	modTime time.Time
+}
+
+func (t *tarBlobsWriter) writeFile(name string, gitMode int32, size int64, reader io.Reader) error {
+	header := &tar.Header{Name: name, ModTime: t.modTime, Typeflag: tar.TypeReg, Mode: 0644, Size: size}
+
+	switch gitMode {
+	case gitModeExecutable:
+		header.Mode = 0755
+	case gitModeSymlink:
+		// The blob of a symlink is its target
+		target, err := ioutil.ReadAll(io.LimitReader(reader, size))
+		if err != nil {
+			return fmt.Errorf("read symlink %q: %v", name, err)
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Mode = 0777
+		header.Size = 0
+		header.Linkname = string(target)
+	}
+
+	if err := t.WriteHeader(header); err != nil {
+		return &copyError{fmt.Errorf("write tar header: %v", err)}
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if _, err := io.CopyN(t, reader, size); err != nil {
+		return fmt.Errorf("copy %q: %v", name, err)
+	}
+	return nil
+}
+
+type zipBlobsWriter struct {
+	*zip.Writer
+	modTime time.Time
+}
+
+func (z *zipBlobsWriter) writeFile(name string, gitMode int32, size int64, reader io.Reader) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.SetModTime(z.modTime)
+
+	switch gitMode {
+	case gitModeExecutable:
+		header.SetMode(0755)
+	case gitModeSymlink:
+		// Zip stores the target of a symlink as its contents
+		header.SetMode(os.ModeSymlink | 0777)
+	default:
+		header.SetMode(0644)
+	}
+
+	fileWriter, err := z.CreateHeader(header)
+	if err != nil {
+		return &copyError{fmt.Errorf("write zip header: %v", err)}
+	}
+	if _, err := io.CopyN(fileWriter, reader, size); err != nil {
+		return fmt.Errorf("copy %q: %v", name, err)
+	}
+	return nil
+}
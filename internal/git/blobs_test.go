@@ -0,0 +1,168 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func readTestBlobsArchive(t *testing.T, format string, data []byte) map[string]string {
+	files := make(map[string]string)
+
+	if format == "tar" {
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return files
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[header.Name] = string(contents)
+		}
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range zr.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(contents)
+	}
+	return files
+}
+
+func TestSendBlobs(t *testing.T) {
+	gitalyServer, stop := startCommitServer(t)
+	defer stop()
+
+	expected := make(map[string]string)
+	for _, mock := range testhelper.GitalyTreeMock {
+		if strings.HasPrefix(mock.Path, "doc/") || mock.Path == "run.sh" {
+			expected[mock.Path] = mock.Data
+		}
+	}
+
+	for _, format := range []string{"tar", "zip"} {
+		w := testInject(t, SendBlobs, blobsParams{
+			GitalyServer: gitalyServer,
+			Repository:   testGitalyRepository,
+			Revision:     "master",
+			Paths:        []string{"doc/", "run.sh", "./doc/index.md"},
+			Format:       format,
+		})
+
+		if w.Code != 200 {
+			t.Fatalf("%s: expected status 200, got %d", format, w.Code)
+		}
+		testhelper.AssertResponseWriterHeader(t, w, "Content-Type", blobsContentTypes[format])
+		testhelper.AssertResponseWriterHeader(t, w, "Content-Disposition", `attachment; filename="blobs.`+format+`"`)
+
+		if files := readTestBlobsArchive(t, format, w.Body.Bytes()); !reflect.DeepEqual(files, expected) {
+			t.Errorf("%s: expected %v, got %v", format, expected, files)
+		}
+	}
+}
+
+func TestSendBlobsErrors(t *testing.T) {
+	gitalyServer, stop := startCommitServer(t)
+	defer stop()
+
+	for _, testCase := range []struct {
+		desc   string
+		params blobsParams
+		code   int
+	}{
+		{desc: "missing path", params: blobsParams{Paths: []string{"README.md", "does-not-exist"}}, code: 404},
+		{desc: "no paths", params: blobsParams{}, code: 500},
+		{desc: "empty path", params: blobsParams{Paths: []string{""}}, code: 500},
+		{desc: "too many paths", params: blobsParams{Paths: make([]string, blobsMaxPaths+1)}, code: 500},
+		{desc: "invalid format", params: blobsParams{Paths: []string{"README.md"}, Format: "rar"}, code: 500},
+	} {
+		params := testCase.params
+		params.GitalyServer = gitalyServer
+		params.Repository = testGitalyRepository
+		params.Revision = "master"
+
+		if w := testInject(t, SendBlobs, params); w.Code != testCase.code {
+			t.Errorf("%s: expected status %d, got %d", testCase.desc, testCase.code, w.Code)
+		}
+	}
+}
+
+func TestBlobsArchiveWriterModes(t *testing.T) {
+	for _, format := range []string{"tar", "zip"} {
+		buf := &bytes.Buffer{}
+		archive := newBlobsArchiveWriter(format, buf, time.Now())
+		for _, file := range []struct {
+			name    string
+			gitMode int32
+			data    string
+		}{
+			{"plain.txt", 0100644, "plain"},
+			{"run.sh", gitModeExecutable, "#!/bin/sh"},
+			{"link", gitModeSymlink, "plain.txt"},
+		} {
+			if err := archive.writeFile(file.name, file.gitMode, int64(len(file.data)), strings.NewReader(file.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := archive.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		modes := make(map[string]os.FileMode)
+		if format == "tar" {
+			tr := tar.NewReader(buf)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				modes[header.Name] = header.FileInfo().Mode()
+				if header.Typeflag == tar.TypeSymlink && header.Linkname != "plain.txt" {
+					t.Errorf("tar: expected symlink to plain.txt, got %q", header.Linkname)
+				}
+			}
+		} else {
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range zr.File {
+				modes[file.Name] = file.Mode()
+			}
+		}
+
+		expected := map[string]os.FileMode{"plain.txt": 0644, "run.sh": 0755, "link": os.ModeSymlink | 0777}
+		if !reflect.DeepEqual(modes, expected) {
+			t.Errorf("%s: expected modes %v, got %v", format, expected, modes)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+/*
+In this file we handle 'git bundle' downloads
+*/
+
+package git
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+)
+
+type bundle struct{ senddata.Prefix }
+type bundleParams struct {
+	RepoPath string
+	// Refs are the refs and commit ranges to bundle, e.g.
+	// "refs/heads/master" or "v1.0..v2.0"
+	Refs []string
+	// With BundlePath set, the bundle is cached there
+	BundlePath string
+	// Filename for Content-Disposition. Defaults to the base name of
+	// BundlePath.
+	Filename string
+}
+
+const defaultBundleFilename = "repository.bundle"
+
+// Options of 'git rev-list' we accept in Refs
+var bundleRefOptions = map[string]bool{
+	"--all":      true,
+	"--branches": true,
+	"--tags":     true,
+}
+
+var (
+	SendBundle     = &bundle{"git-bundle:"}
+	gitBundleCache = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_bundle_cache",
+			Help: "Cache hits and misses for 'git bundle' streaming",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gitBundleCache)
+}
+
+// Gitaly has no RPC for 'git bundle' yet, so bundles always need the
+// repository on local disk.
+func (b *bundle) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params bundleParams
+	if err := b.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: unpack sendData: %v", err))
+		return
+	}
+
+	if err := validateBundleRefs(params.Refs); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: %v", err))
+		return
+	}
+
+	var err error
+	if params.RepoPath, err = confinement.Resolve(params.RepoPath); err != nil {
+		confinement.Fail(w, r, "SendBundle", err)
+		return
+	}
+
+	filename := params.Filename
+	if filename == "" && params.BundlePath != "" {
+		filename = path.Base(params.BundlePath)
+	}
+	if filename == "" {
+		filename = defaultBundleFilename
+	}
+
+	produce := func(ctx context.Context) (io.Reader, error) {
+		return newBundleReader(ctx, params.RepoPath, params.Refs)
+	}
+
+	if params.BundlePath == "" {
+		sendBundle(w, r, filename, produce)
+		return
+	}
+
+	if params.BundlePath, err = confinement.Resolve(params.BundlePath); err != nil {
+		confinement.Fail(w, r, "SendBundle", err)
+		return
+	}
+	sendCachedBundle(w, r, params.BundlePath, filename, produce)
+}
+
+func validateBundleRefs(refs []string) error {
+	if len(refs) == 0 {
+		return fmt.Errorf("no refs")
+	}
+
+	for _, ref := range refs {
+		if ref == "" || strings.HasPrefix(ref, "-") && !bundleRefOptions[ref] {
+			return fmt.Errorf("invalid ref %q", ref)
+		}
+	}
+
+	return nil
+}
+
+func sendBundle(w http.ResponseWriter, r *http.Request, filename string, produce produceFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	reader, err := produce(ctx)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: %v", err))
+		return
+	}
+
+	// Wait for the first bytes so that unknown refs still get a 500
+	bufReader := bufio.NewReader(reader)
+	if _, err := bufReader.Peek(1); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: create bundle: %v", err))
+		return
+	}
+
+	setBundleHeaders(w, filename)
+	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
+	if _, err := io.Copy(w, bufReader); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("SendBundle: copy 'git bundle' output: %v", err)})
+		return
+	}
+}
+
+func sendCachedBundle(w http.ResponseWriter, r *http.Request, bundlePath string, filename string, produce produceFunc) {
+	if cachedBundle, err := os.Open(bundlePath); err == nil {
+		defer cachedBundle.Close()
+		gitBundleCache.WithLabelValues("hit").Inc()
+		setBundleHeaders(w, filename)
+		http.ServeContent(w, r, "", time.Unix(0, 0), cachedBundle)
+		return
+	}
+
+	// Concurrent requests for the same bundle share one 'git bundle'
+	follower, started, err := followGeneration(r.Context(), bundlePath, produce)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: %v", err))
+		return
+	}
+	defer follower.Close()
+
+	if started {
+		gitBundleCache.WithLabelValues("miss").Inc()
+	} else {
+		gitBundleCache.WithLabelValues("coalesced").Inc()
+	}
+
+	if err := follower.ready(); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBundle: create bundle: %v", err))
+		return
+	}
+
+	setBundleHeaders(w, filename)
+	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
+	if _, err := io.Copy(w, follower); err != nil {
+		helper.LogError(r, &copyError{fmt.Errorf("SendBundle: copy 'git bundle' output: %v", err)})
+		return
+	}
+}
+
+func setBundleHeaders(w http.ResponseWriter, filename string) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	w.Header().Set("Cache-Control", "private")
+}
+
+func newBundleReader(ctx context.Context, repoPath string, refs []string) (*archiveReader, error) {
+	args := append([]string{"--git-dir=" + repoPath, "bundle", "create", "-"}, refs...)
+	bundleCmd := gitCommand("", "", "git", args...)
+
+	stdout, err := bundleCmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("bundle stdout: %v", err)
+	}
+
+	if err := bundleCmd.Start(); err != nil {
+		stdout.Close()
+		return nil, fmt.Errorf("start %v: %v", bundleCmd.Args, err)
+	}
+
+	go ctxKill(ctx, bundleCmd)
+
+	// archiveReader waits for the command once its output is exhausted
+	return &archiveReader{waitCmds: []*exec.Cmd{bundleCmd}, stdout: stdout}, nil
+}
@@ -0,0 +1,98 @@
+package git
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func testSendBundle(t *testing.T, params bundleParams) *httptest.ResponseRecorder {
+	jsonParams, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendData := SendBundle.Prefix + senddata.Prefix(base64.URLEncoding.EncodeToString(jsonParams))
+
+	w := httptest.NewRecorder()
+	SendBundle.Inject(w, httptest.NewRequest("GET", "/bundle", nil), string(sendData))
+	return w
+}
+
+func TestValidateBundleRefs(t *testing.T) {
+	for _, testCase := range []struct {
+		refs  []string
+		valid bool
+	}{
+		{refs: []string{"refs/heads/master"}, valid: true},
+		{refs: []string{"v1.0..v2.0", "refs/tags/v2.0"}, valid: true},
+		{refs: []string{"--all"}, valid: true},
+		{refs: nil},
+		{refs: []string{""}},
+		{refs: []string{"--output=/tmp/foo"}},
+	} {
+		if err := validateBundleRefs(testCase.refs); (err == nil) != testCase.valid {
+			t.Errorf("%v: expected valid to be %v, got %v", testCase.refs, testCase.valid, err)
+		}
+	}
+}
+
+func TestSendBundle(t *testing.T) {
+	repoPath := testGitRepository(t, "README.md")
+	defer os.RemoveAll(filepath.Dir(repoPath))
+
+	w := testSendBundle(t, bundleParams{RepoPath: repoPath, Refs: []string{"--all"}})
+	if w.Code != 200 {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Body.String(), "# v2 git bundle\n") {
+		t.Fatalf("expected a bundle, got %q", w.Body.String())
+	}
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Disposition", `attachment; filename="repository.bundle"`)
+
+	w = testSendBundle(t, bundleParams{RepoPath: repoPath, Refs: []string{"refs/heads/does-not-exist"}})
+	if w.Code != 500 {
+		t.Fatalf("expected status 500 for unknown ref, got %d", w.Code)
+	}
+}
+
+func TestSendCachedBundle(t *testing.T) {
+	repoPath := testGitRepository(t, "README.md")
+	defer os.RemoveAll(filepath.Dir(repoPath))
+
+	cacheDir, err := ioutil.TempDir("", "bundle-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	bundlePath := filepath.Join(cacheDir, "project-1", "project.bundle")
+	params := bundleParams{RepoPath: repoPath, Refs: []string{"--all"}, BundlePath: bundlePath}
+
+	miss := testSendBundle(t, params)
+	if miss.Code != 200 {
+		t.Fatalf("expected status 200, got %d", miss.Code)
+	}
+	testhelper.AssertResponseWriterHeader(t, miss, "Content-Disposition", `attachment; filename="project.bundle"`)
+
+	cached, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cached) != miss.Body.String() {
+		t.Fatal("expected the bundle to be cached")
+	}
+
+	// Served from the cache even though the repository is gone
+	os.RemoveAll(filepath.Dir(repoPath))
+	hit := testSendBundle(t, bundleParams{RepoPath: "/nonexistent", Refs: []string{"--all"}, BundlePath: bundlePath})
+	if hit.Body.String() != miss.Body.String() {
+		t.Fatalf("expected cached bundle, got status %d", hit.Code)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+In this file we turn the optional SendDiff parameters into 'git diff'
+arguments
+*/
+
+package git
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type diffOptions struct {
+	// Paths limits the diff to these files or directories
+	Paths []string
+	// ContextLines is the number of context lines around each change.
+	// Git's default of 3 is used when it is not set.
+	ContextLines *int
+	// IgnoreWhitespace is one of the keys of diffWhitespaceOptions
+	IgnoreWhitespace string
+	// FindRenames turns on rename detection
+	FindRenames bool
+	// Format is one of the keys of diffFormatOptions. Defaults to a
+	// patch.
+	Format string
+}
+
+// Git's own limit for the number of context lines is much higher, but
+// anything beyond this is the whole file anyway
+const diffMaxContextLines = 10000
+
+var diffWhitespaceOptions = map[string]string{
+	"all":         "--ignore-all-space",
+	"change":      "--ignore-space-change",
+	"eol":         "--ignore-space-at-eol",
+	"blank-lines": "--ignore-blank-lines",
+}
+
+var diffFormatOptions = map[string]string{
+	"patch":       "",
+	"stat":        "--stat",
+	"numstat":     "--numstat",
+	"name-status": "--name-status",
+}
+
+// validate checks every option against the allowlists above, so that
+// nothing is passed to git as it came in.
+func (o *diffOptions) validate() error {
+	if _, ok := diffFormatOptions[o.Format]; !ok && o.Format != "" {
+		return fmt.Errorf("invalid format %q", o.Format)
+	}
+
+	if o.ContextLines != nil && (*o.ContextLines < 0 || *o.ContextLines > diffMaxContextLines) {
+		return fmt.Errorf("invalid number of context lines %d", *o.ContextLines)
+	}
+
+	if _, ok := diffWhitespaceOptions[o.IgnoreWhitespace]; !ok && o.IgnoreWhitespace != "" {
+		return fmt.Errorf("invalid whitespace mode %q", o.IgnoreWhitespace)
+	}
+
+	for _, path := range o.Paths {
+		if path == "" {
+			return fmt.Errorf("empty path")
+		}
+	}
+
+	return nil
+}
+
+// args returns the 'git diff' arguments for the revisions from and to
+// and these options.
+func (o *diffOptions) args(from string, to string) ([]string, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	for _, rev := range []string{from, to} {
+		if rev == "" || strings.HasPrefix(rev, "-") {
+			return nil, fmt.Errorf("invalid revision %q", rev)
+		}
+	}
+
+	var args []string
+	if format := diffFormatOptions[o.Format]; format != "" {
+		args = append(args, format)
+	}
+	if o.ContextLines != nil {
+		args = append(args, "--unified="+strconv.Itoa(*o.ContextLines))
+	}
+	if whitespace := diffWhitespaceOptions[o.IgnoreWhitespace]; whitespace != "" {
+		args = append(args, whitespace)
+	}
+	if o.FindRenames {
+		args = append(args, "--find-renames")
+	}
+
+	args = append(args, from, to, "--")
+	return append(args, o.Paths...), nil
+}
+
+// gitalySupported reports whether the CommitDiff RPC can produce the diff
+// these options ask for. It only knows about paths and ignoring changes
+// in whitespace.
+func (o *diffOptions) gitalySupported() bool {
+	return o.ContextLines == nil &&
+		(o.IgnoreWhitespace == "" || o.IgnoreWhitespace == "change") &&
+		!o.FindRenames &&
+		(o.Format == "" || o.Format == "patch")
+}
@@ -0,0 +1,141 @@
+package git
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+)
+
+// The SHA of the tree without any files
+const emptyTreeId = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+func TestDiffOptionsArgs(t *testing.T) {
+	zero, five, tooMany := 0, 5, diffMaxContextLines+1
+
+	for _, testCase := range []struct {
+		desc    string
+		options diffOptions
+		args    []string
+	}{
+		{
+			desc: "no options",
+			args: []string{"a", "b", "--"},
+		},
+		{
+			desc:    "all options",
+			options: diffOptions{Paths: []string{"doc", "README"}, ContextLines: &five, IgnoreWhitespace: "all", FindRenames: true, Format: "numstat"},
+			args:    []string{"--numstat", "--unified=5", "--ignore-all-space", "--find-renames", "a", "b", "--", "doc", "README"},
+		},
+		{
+			desc:    "zero context lines",
+			options: diffOptions{ContextLines: &zero, Format: "patch"},
+			args:    []string{"--unified=0", "a", "b", "--"},
+		},
+		{
+			desc:    "path that looks like an option",
+			options: diffOptions{Paths: []string{"--output=foo"}},
+			args:    []string{"a", "b", "--", "--output=foo"},
+		},
+		{desc: "unknown format", options: diffOptions{Format: "--output=foo"}},
+		{desc: "unknown whitespace mode", options: diffOptions{IgnoreWhitespace: "-w"}},
+		{desc: "negative context lines", options: diffOptions{ContextLines: &[]int{-1}[0]}},
+		{desc: "too many context lines", options: diffOptions{ContextLines: &tooMany}},
+		{desc: "empty path", options: diffOptions{Paths: []string{""}}},
+	} {
+		args, err := testCase.options.args("a", "b")
+		if testCase.args == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", testCase.desc, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", testCase.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, testCase.args) {
+			t.Errorf("%s: expected %v, got %v", testCase.desc, testCase.args, args)
+		}
+	}
+}
+
+func TestDiffOptionsRevisions(t *testing.T) {
+	options := &diffOptions{}
+	for _, revs := range [][2]string{{"", "b"}, {"a", "--output=foo"}} {
+		if args, err := options.args(revs[0], revs[1]); err == nil {
+			t.Errorf("%v: expected an error, got %v", revs, args)
+		}
+	}
+}
+
+func TestDiffOptionsGitalySupported(t *testing.T) {
+	five := 5
+	for _, testCase := range []struct {
+		options   diffOptions
+		supported bool
+	}{
+		{options: diffOptions{}, supported: true},
+		{options: diffOptions{Paths: []string{"doc"}, IgnoreWhitespace: "change", Format: "patch"}, supported: true},
+		{options: diffOptions{IgnoreWhitespace: "all"}},
+		{options: diffOptions{ContextLines: &five}},
+		{options: diffOptions{FindRenames: true}},
+		{options: diffOptions{Format: "stat"}},
+	} {
+		if supported := testCase.options.gitalySupported(); supported != testCase.supported {
+			t.Errorf("%+v: expected %v, got %v", testCase.options, testCase.supported, supported)
+		}
+	}
+}
+
+func TestSendDiffWithOptions(t *testing.T) {
+	repoPath := testGitRepository(t, "README.md", "doc/index.md")
+	defer os.RemoveAll(filepath.Dir(repoPath))
+
+	for _, testCase := range []struct {
+		desc    string
+		options diffOptions
+		code    int
+		body    string
+	}{
+		{
+			desc:    "numstat for a path",
+			options: diffOptions{Paths: []string{"doc"}, Format: "numstat"},
+			code:    200,
+			body:    "1\t0\tdoc/index.md\n",
+		},
+		{
+			desc:    "name-status",
+			options: diffOptions{Format: "name-status"},
+			code:    200,
+			body:    "A\tREADME.md\nA\tdoc/index.md\n",
+		},
+		{
+			desc:    "invalid option",
+			options: diffOptions{Format: "--output=/tmp/diff"},
+			code:    500,
+		},
+	} {
+		jsonParams, err := json.Marshal(diffParams{RepoPath: repoPath, ShaFrom: emptyTreeId, ShaTo: "HEAD", diffOptions: testCase.options})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendData := SendDiff.Prefix + senddata.Prefix(base64.URLEncoding.EncodeToString(jsonParams))
+
+		w := httptest.NewRecorder()
+		SendDiff.Inject(w, httptest.NewRequest("GET", "/diff", nil), string(sendData))
+
+		if w.Code != testCase.code {
+			t.Errorf("%s: expected status %d, got %d", testCase.desc, testCase.code, w.Code)
+			continue
+		}
+		if testCase.code == 200 && w.Body.String() != testCase.body {
+			t.Errorf("%s: expected %q, got %q", testCase.desc, testCase.body, w.Body.String())
+		}
+	}
+}
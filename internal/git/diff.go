@@ -6,15 +6,22 @@ import (
 	"log"
 	"net/http"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
 )
 
 type diff struct{ senddata.Prefix }
 type diffParams struct {
-	RepoPath string
-	ShaFrom  string
-	ShaTo    string
+	RepoPath          string
+	ShaFrom           string
+	ShaTo             string
+	GitalyServer      gitaly.Server
+	CommitDiffRequest pb.CommitDiffRequest
+	diffOptions
 }
 
 var SendDiff = &diff{"git-diff:"}
@@ -26,9 +33,91 @@ func (d *diff) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 		return
 	}
 
+	if err := params.validate(); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendDiff: %v", err))
+		return
+	}
+
+	// Options CommitDiff does not know about need a local repository
+	if params.GitalyServer.Address != "" && (params.gitalySupported() || params.RepoPath == "") {
+		handleSendDiffWithGitaly(w, r, &params)
+	} else {
+		handleSendDiffLocally(w, r, &params)
+	}
+}
+
+func handleSendDiffWithGitaly(w http.ResponseWriter, r *http.Request, params *diffParams) {
+	request := &params.CommitDiffRequest
+	if request.LeftCommitId == "" {
+		request.LeftCommitId = params.ShaFrom
+	}
+	if request.RightCommitId == "" {
+		request.RightCommitId = params.ShaTo
+	}
+	if !params.gitalySupported() {
+		helper.Fail500(w, r, fmt.Errorf("SendDiff: options not supported by Gitaly and no RepoPath given"))
+		return
+	}
+	for _, path := range params.Paths {
+		request.Paths = append(request.Paths, []byte(path))
+	}
+	if params.IgnoreWhitespace == "change" {
+		request.IgnoreWhitespaceChange = true
+	}
+
+	log.Printf("SendDiff: sending diff between %q and %q for %q via Gitaly", request.LeftCommitId, request.RightCommitId, r.URL.Path)
+
+	diffClient, err := gitaly.NewDiffClient(params.GitalyServer)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("diff.CommitDiff: %v", err))
+		return
+	}
+
+	// Errors halfway through the diff cannot become a 500 anymore
+	rw := &diffResponseWriter{ResponseWriter: w}
+	if err := diffClient.SendRawDiff(r.Context(), rw, request); err != nil {
+		if rw.started {
+			helper.LogError(r, &copyError{fmt.Errorf("diff.CommitDiff: %v", err)})
+			return
+		}
+		helper.Fail500(w, r, fmt.Errorf("diff.CommitDiff: %v", err))
+		return
+	}
+}
+
+type diffResponseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (d *diffResponseWriter) WriteHeader(status int) {
+	d.started = true
+	d.ResponseWriter.WriteHeader(status)
+}
+
+func (d *diffResponseWriter) Write(p []byte) (int, error) {
+	d.started = true
+	return d.ResponseWriter.Write(p)
+}
+
+func handleSendDiffLocally(w http.ResponseWriter, r *http.Request, params *diffParams) {
+	repoPath, err := confinement.Resolve(params.RepoPath)
+	if err != nil {
+		confinement.Fail(w, r, "SendDiff", err)
+		return
+	}
+
 	log.Printf("SendDiff: sending diff between %q and %q for %q", params.ShaFrom, params.ShaTo, r.URL.Path)
 
-	gitDiffCmd := gitCommand("", "", "git", "--git-dir="+params.RepoPath, "diff", params.ShaFrom, params.ShaTo)
+	diffArgs, err := params.args(params.ShaFrom, params.ShaTo)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendDiff: %v", err))
+		return
+	}
+
+	// Gitaly sends full object IDs, and the abbreviated ones depend on the
+	// repository, so we do not abbreviate either
+	gitDiffCmd := gitCommand("", "", "git", append([]string{"--git-dir=" + repoPath, "diff", "--full-index"}, diffArgs...)...)
 	stdout, err := gitDiffCmd.StdoutPipe()
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("SendDiff: create stdout pipe: %v", err))
@@ -0,0 +1,111 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// repoDiffServer answers CommitDiff with a diff of one file
+type repoDiffServer struct {
+	*testhelper.GitalyTestServer
+	response *pb.CommitDiffResponse
+}
+
+func (s *repoDiffServer) CommitDiff(in *pb.CommitDiffRequest, stream pb.DiffService_CommitDiffServer) error {
+	return stream.Send(s.response)
+}
+
+func startDiffServer(t *testing.T, response *pb.CommitDiffResponse) (gitaly.Server, func()) {
+	dir, err := ioutil.TempDir("", "gitaly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketPath := filepath.Join(dir, "gitaly.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	pb.RegisterDiffServiceServer(server, &repoDiffServer{testhelper.NewGitalyServer(codes.OK), response})
+	go server.Serve(listener)
+
+	return gitaly.Server{Address: "unix://" + socketPath}, func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSendDiffSameWithGitalyAndLocally(t *testing.T) {
+	repoPath := testGitRepository(t, "README.md")
+	defer os.RemoveAll(filepath.Dir(repoPath))
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = filepath.Dir(repoPath)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(repoPath), "README.md"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-a", "-m", "change")
+	from, to := git("rev-parse", "HEAD~1"), git("rev-parse", "HEAD")
+
+	local := testInject(t, SendDiff, diffParams{RepoPath: repoPath, ShaFrom: from, ShaTo: to})
+	if local.Code != 200 {
+		t.Fatalf("expected status 200, got %d", local.Code)
+	}
+
+	// Gitaly sends the same hunks, with the object IDs and modes apart
+	hunks := bytes.Index(local.Body.Bytes(), []byte("\n@@ "))
+	if hunks < 0 {
+		t.Fatalf("expected hunks in %q", local.Body.String())
+	}
+	gitalyServer, stop := startDiffServer(t, &pb.CommitDiffResponse{
+		FromPath:     []byte("README.md"),
+		ToPath:       []byte("README.md"),
+		FromId:       git("rev-parse", from+":README.md"),
+		ToId:         git("rev-parse", to+":README.md"),
+		OldMode:      0100644,
+		NewMode:      0100644,
+		RawPatchData: local.Body.Bytes()[hunks+1:],
+		EndOfPatch:   true,
+	})
+	defer stop()
+
+	withGitaly := testInject(t, SendDiff, diffParams{
+		GitalyServer:      gitalyServer,
+		ShaFrom:           from,
+		ShaTo:             to,
+		CommitDiffRequest: pb.CommitDiffRequest{Repository: &testGitalyRepository},
+	})
+	if withGitaly.Code != 200 {
+		t.Fatalf("expected status 200, got %d", withGitaly.Code)
+	}
+
+	if withGitaly.Body.String() != local.Body.String() {
+		t.Fatalf("expected the same diff from git and Gitaly:\n%s\n%s", local.Body.String(), withGitaly.Body.String())
+	}
+	if expected := fmt.Sprintf("index %s..", git("rev-parse", from+":README.md")); !strings.Contains(local.Body.String(), expected) {
+		t.Fatalf("expected full object IDs in %q", local.Body.String())
+	}
+}
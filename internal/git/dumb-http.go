@@ -0,0 +1,174 @@
+/*
+In this file we handle the read-only Git 'dumb HTTP' protocol
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// The files a dumb HTTP client may ask for, relative to the repository
+var dumbHTTPFile = regexp.MustCompile(`\A(.*\.git)/(info/refs|HEAD|objects/info/packs|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(pack|idx))\z`)
+
+// Objects never change, so clients may cache them as long as they like.
+// Only clients: the repository may be private, so shared caches must not
+// keep them.
+const dumbHTTPObjectMaxAge = 365 * 24 * time.Hour
+
+// DumbHTTP serves repository files to clients that only speak the 'dumb'
+// HTTP protocol. Reading a repository this way requires the same
+// permission as a 'git fetch', so we authorize the request as if it was
+// the info/refs request of a fetch.
+func DumbHTTP(a *api.API) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matches := dumbHTTPFile.FindStringSubmatch(r.URL.Path)
+		if matches == nil {
+			http.NotFound(w, r)
+			return
+		}
+		file := matches[2]
+
+		authURL := *r.URL
+		authURL.Path = matches[1] + "/info/refs"
+		authURL.RawPath = ""
+		authURL.RawQuery = url.Values{"service": {"git-upload-pack"}}.Encode()
+		authReq := *r
+		authReq.URL = &authURL
+
+		repoPreAuthorizeHandler(a, func(w http.ResponseWriter, _ *http.Request, ar *api.Response) {
+			handleDumbHTTP(w, r, ar, file)
+		}).ServeHTTP(w, &authReq)
+	})
+}
+
+func handleDumbHTTP(rw http.ResponseWriter, r *http.Request, a *api.Response, file string) {
+	w := NewGitHttpResponseWriter(rw)
+	defer w.Log(r, 0)
+
+	repoPath, err := confinement.Resolve(a.RepoPath)
+	if err != nil {
+		confinement.Fail(w, r, "handleDumbHTTP", err)
+		return
+	}
+
+	switch {
+	case file == "info/refs":
+		serveDumbGenerated(w, r, file, func() ([]byte, error) { return dumbInfoRefs(repoPath) })
+	case file == "objects/info/packs":
+		serveDumbGenerated(w, r, file, func() ([]byte, error) { return dumbInfoPacks(repoPath) })
+	case file == "HEAD":
+		serveDumbFile(w, r, repoPath, file, "text/plain", false)
+	case strings.HasSuffix(file, ".pack"):
+		serveDumbFile(w, r, repoPath, file, "application/x-git-packed-objects", true)
+	case strings.HasSuffix(file, ".idx"):
+		serveDumbFile(w, r, repoPath, file, "application/x-git-packed-objects-toc", true)
+	default:
+		serveDumbFile(w, r, repoPath, file, "application/x-git-loose-object", true)
+	}
+}
+
+func serveDumbGenerated(w http.ResponseWriter, r *http.Request, file string, generate func() ([]byte, error)) {
+	content, err := generate()
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("handleDumbHTTP: %s: %v", file, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	helper.SetNoCacheHeaders(w.Header())
+	w.Write(content)
+}
+
+func serveDumbFile(w http.ResponseWriter, r *http.Request, repoPath string, file string, contentType string, immutable bool) {
+	// A symlink in the repository must not lead us out of it
+	path, err := confinement.Resolve(filepath.Join(repoPath, file))
+	if err != nil {
+		confinement.Fail(w, r, "handleDumbHTTP", err)
+		return
+	}
+
+	content, fi, err := helper.OpenFile(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	if immutable {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(dumbHTTPObjectMaxAge.Seconds())))
+	} else {
+		helper.SetNoCacheHeaders(w.Header())
+	}
+
+	// ServeContent handles Range requests, which clients use to resume
+	// packfile downloads
+	http.ServeContent(w, r, "", fi.ModTime(), content)
+}
+
+// dumbInfoRefs produces the same output as 'git update-server-info' would
+// write to info/refs, so that we do not depend on it having been run.
+func dumbInfoRefs(repoPath string) ([]byte, error) {
+	cmd := gitCommand("", "", "git", "--git-dir="+repoPath, "for-each-ref", "--format=%(objectname) %(refname) %(*objectname)")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd.Args, err)
+	}
+
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "%s\t%s\n", fields[0], fields[1])
+		if len(fields) == 3 {
+			fmt.Fprintf(&buf, "%s\t%s^{}\n", fields[2], fields[1])
+		}
+	}
+
+	return buf.Bytes(), scanner.Err()
+}
+
+// dumbInfoPacks lists the packfiles of the repository in the format of
+// objects/info/packs.
+func dumbInfoPacks(repoPath string) ([]byte, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(repoPath, "objects/pack"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var packs []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "pack-") && strings.HasSuffix(entry.Name(), ".pack") {
+			packs = append(packs, entry.Name())
+		}
+	}
+	sort.Strings(packs)
+
+	var buf bytes.Buffer
+	for _, pack := range packs {
+		fmt.Fprintf(&buf, "P %s\n", pack)
+	}
+	buf.WriteString("\n")
+
+	return buf.Bytes(), nil
+}
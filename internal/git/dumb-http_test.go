@@ -0,0 +1,135 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func createDumbTestRepo(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "dumb-http-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	repoPath := filepath.Join(dir, "repo.git")
+	run := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"--git-dir=" + repoPath}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		output, err := cmd.Output()
+		if err != nil {
+			cleanup()
+			t.Fatalf("%v: %v", cmd.Args, err)
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	run("init", "--bare")
+	tree := run("write-tree")
+	commit := run("commit-tree", tree, "-m", "initial commit")
+	run("update-ref", "refs/heads/master", commit)
+	run("tag", "-a", "v1.0", "-m", "release", commit)
+
+	return repoPath, commit, cleanup
+}
+
+func TestDumbInfoRefs(t *testing.T) {
+	repoPath, commit, cleanup := createDumbTestRepo(t)
+	defer cleanup()
+
+	infoRefs, err := dumbInfoRefs(repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(infoRefs)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %q", infoRefs)
+	}
+	if lines[0] != commit+"\trefs/heads/master" {
+		t.Errorf("unexpected branch line %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "\trefs/tags/v1.0") {
+		t.Errorf("unexpected tag line %q", lines[1])
+	}
+	if lines[2] != commit+"\trefs/tags/v1.0^{}" {
+		t.Errorf("unexpected peeled tag line %q", lines[2])
+	}
+}
+
+func TestDumbInfoPacks(t *testing.T) {
+	repoPath, _, cleanup := createDumbTestRepo(t)
+	defer cleanup()
+
+	packs, err := dumbInfoPacks(repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(packs) != "\n" {
+		t.Fatalf("expected no packs, got %q", packs)
+	}
+
+	packName := "pack-" + strings.Repeat("a", 40)
+	for _, ext := range []string{".pack", ".idx"} {
+		if err := ioutil.WriteFile(filepath.Join(repoPath, "objects/pack", packName+ext), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packs, err = dumbInfoPacks(repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "P " + packName + ".pack\n\n"; string(packs) != expected {
+		t.Fatalf("expected %q, got %q", expected, packs)
+	}
+}
+
+func TestHandleDumbHTTPLooseObject(t *testing.T) {
+	repoPath, commit, cleanup := createDumbTestRepo(t)
+	defer cleanup()
+
+	file := "objects/" + commit[:2] + "/" + commit[2:]
+	w := httptest.NewRecorder()
+	handleDumbHTTP(w, httptest.NewRequest("GET", "/group/repo.git/"+file, nil), &api.Response{RepoPath: repoPath}, file)
+
+	testhelper.AssertResponseCode(t, w, 200)
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Type", "application/x-git-loose-object")
+	testhelper.AssertResponseWriterHeader(t, w, "Cache-Control", "private, max-age=31536000")
+
+	missing := "objects/00/" + strings.Repeat("0", 38)
+	w = httptest.NewRecorder()
+	handleDumbHTTP(w, httptest.NewRequest("GET", "/group/repo.git/"+missing, nil), &api.Response{RepoPath: repoPath}, missing)
+
+	testhelper.AssertResponseCode(t, w, 404)
+}
+
+func TestHandleDumbHTTPConfinement(t *testing.T) {
+	repoPath, _, cleanup := createDumbTestRepo(t)
+	defer cleanup()
+
+	otherRoot, err := ioutil.TempDir("", "dumb-http-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(otherRoot)
+
+	if err := confinement.SetAllowedRoots([]string{otherRoot}); err != nil {
+		t.Fatal(err)
+	}
+	defer confinement.SetAllowedRoots(nil)
+
+	w := httptest.NewRecorder()
+	handleDumbHTTP(w, httptest.NewRequest("GET", "/group/repo.git/HEAD", nil), &api.Response{RepoPath: repoPath}, "HEAD")
+
+	testhelper.AssertResponseCode(t, w, 403)
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 )
@@ -26,10 +27,18 @@ func (p *patch) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 		return
 	}
 
+	// Gitaly has no RPC for 'git format-patch' yet, so unlike SendDiff
+	// this always needs the repository on local disk
+	repoPath, err := confinement.Resolve(params.RepoPath)
+	if err != nil {
+		confinement.Fail(w, r, "SendPatch", err)
+		return
+	}
+
 	log.Printf("SendPatch: sending patch between %q and %q for %q", params.ShaFrom, params.ShaTo, r.URL.Path)
 
 	gitRange := fmt.Sprintf("%s..%s", params.ShaFrom, params.ShaTo)
-	gitPatchCmd := gitCommand("", "", "git", "--git-dir="+params.RepoPath, "format-patch", gitRange, "--stdout")
+	gitPatchCmd := gitCommand("", "", "git", "--git-dir="+repoPath, "format-patch", gitRange, "--stdout")
 
 	stdout, err := gitPatchCmd.StdoutPipe()
 	if err != nil {
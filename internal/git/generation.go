@@ -0,0 +1,239 @@
+/*
+In this file we share the generation of a cached file, such as an
+archive, between concurrent requests for it
+*/
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+)
+
+// generation writes the output of one 'git archive' or similar command
+// to a tempfile. Requests for the same file that arrive in the meantime
+// read the tempfile as it grows instead of running the command again.
+type generation struct {
+	tempPath string
+	cancel   context.CancelFunc
+
+	// Guarded by generationsMutex
+	readers   int
+	abandoned bool
+
+	sync.Mutex
+	written int64
+	done    bool
+	err     error
+	changed chan struct{}
+}
+
+var (
+	generations      = make(map[string]*generation)
+	generationsMutex sync.Mutex
+)
+
+func newGeneration(tempPath string, cancel context.CancelFunc) *generation {
+	return &generation{
+		tempPath: tempPath,
+		cancel:   cancel,
+		changed:  make(chan struct{}),
+	}
+}
+
+// produceFunc starts generating a file. The generation stops when ctx is
+// done.
+type produceFunc func(ctx context.Context) (io.Reader, error)
+
+// followGeneration returns a reader for the file that gets cached at
+// cachePath. It starts a new generation with produce unless one is
+// already running, and reports whether it did.
+func followGeneration(ctx context.Context, cachePath string, produce produceFunc) (*generationFollower, bool, error) {
+	generationsMutex.Lock()
+	defer generationsMutex.Unlock()
+
+	started := false
+	gen := generations[cachePath]
+	if gen == nil || gen.abandoned {
+		var err error
+		if gen, err = startGeneration(cachePath, produce); err != nil {
+			return nil, false, err
+		}
+		generations[cachePath] = gen
+		started = true
+	}
+
+	// The tempfile is only removed after the generation has left
+	// generations, so it still exists
+	file, err := os.Open(gen.tempPath)
+	if err != nil {
+		if started {
+			gen.abandoned = true
+			gen.cancel()
+		}
+		return nil, false, fmt.Errorf("open tempfile: %v", err)
+	}
+
+	gen.readers++
+	return &generationFollower{ctx: ctx, gen: gen, file: file}, started, nil
+}
+
+// startGeneration must be called with generationsMutex held.
+func startGeneration(cachePath string, produce produceFunc) (*generation, error) {
+	// We create the tempfile in the same directory as the final cached
+	// file we want to create so that we can use an atomic link(2)
+	// operation to finalize the cached file.
+	tempFile, err := prepareArchiveTempfile(path.Dir(cachePath), path.Base(cachePath))
+	if err != nil {
+		return nil, fmt.Errorf("create tempfile: %v", err)
+	}
+
+	// The generation outlives the request that started it as long as
+	// other requests follow it
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := produce(ctx)
+	if err != nil {
+		cancel()
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return nil, err
+	}
+
+	gen := newGeneration(tempFile.Name(), cancel)
+	go gen.run(tempFile, reader, cachePath)
+
+	return gen, nil
+}
+
+func (g *generation) run(tempFile *os.File, r io.Reader, cachePath string) {
+	defer g.cancel()
+	defer os.Remove(tempFile.Name())
+
+	_, err := io.Copy(&generationWriter{gen: g, file: tempFile}, r)
+	if err == nil {
+		// Followers already have the data, so they need not wait for this
+		if finalizeErr := finalizeCachedArchive(tempFile, cachePath); finalizeErr != nil {
+			log.Printf("finalize cached file %s: %v", cachePath, finalizeErr)
+		}
+	} else {
+		tempFile.Close()
+	}
+
+	generationsMutex.Lock()
+	if generations[cachePath] == g {
+		delete(generations, cachePath)
+	}
+	generationsMutex.Unlock()
+
+	g.finish(err)
+}
+
+func (g *generation) advance(n int64) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.written += n
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *generation) finish(err error) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.done = true
+	g.err = err
+	close(g.changed)
+}
+
+// wait blocks until there are bytes beyond offset, or the generation is
+// done. In the latter case it returns io.EOF or the generation error.
+func (g *generation) wait(ctx context.Context, offset int64) (int64, error) {
+	for {
+		g.Lock()
+		available, done, err, changed := g.written-offset, g.done, g.err, g.changed
+		g.Unlock()
+
+		if available > 0 {
+			return available, nil
+		}
+		if done {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+type generationWriter struct {
+	gen  *generation
+	file *os.File
+}
+
+func (w *generationWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.gen.advance(int64(n))
+	return n, err
+}
+
+// generationFollower reads the tempfile of a generation up to where it has
+// been written, until the generation is done.
+type generationFollower struct {
+	ctx    context.Context
+	gen    *generation
+	file   *os.File
+	offset int64
+}
+
+// ready blocks until the generation has produced its first bytes, and
+// returns its error if it failed before that.
+func (f *generationFollower) ready() error {
+	_, err := f.gen.wait(f.ctx, 0)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (f *generationFollower) Read(p []byte) (int, error) {
+	available, err := f.gen.wait(f.ctx, f.offset)
+	if available == 0 {
+		return 0, err
+	}
+
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := f.file.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF {
+		// More data may be on its way
+		err = nil
+	}
+	return n, err
+}
+
+// Close stops the generation if this was its last follower.
+func (f *generationFollower) Close() error {
+	generationsMutex.Lock()
+	f.gen.readers--
+	if f.gen.readers == 0 {
+		f.gen.abandoned = true
+		f.gen.cancel()
+	}
+	generationsMutex.Unlock()
+
+	return f.file.Close()
+}
@@ -0,0 +1,168 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGeneration runs a generation fed from the returned pipe and
+// registers it for archivePath.
+func testGeneration(t *testing.T, archivePath string) (*generation, *io.PipeWriter, context.Context) {
+	tempFile, err := prepareArchiveTempfile(filepath.Dir(archivePath), filepath.Base(archivePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gen := newGeneration(tempFile.Name(), cancel)
+	pr, pw := io.Pipe()
+
+	generationsMutex.Lock()
+	generations[archivePath] = gen
+	generationsMutex.Unlock()
+
+	go gen.run(tempFile, pr, archivePath)
+	return gen, pw, ctx
+}
+
+func testFollowGeneration(t *testing.T, archivePath string) *generationFollower {
+	follower, started, err := followGeneration(context.Background(), archivePath, func(context.Context) (io.Reader, error) {
+		return nil, errors.New("unexpected generation")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started {
+		t.Fatal("expected to follow the running generation")
+	}
+	return follower
+}
+
+func TestGenerationFollowers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar")
+
+	_, pw, _ := testGeneration(t, archivePath)
+
+	first := testFollowGeneration(t, archivePath)
+	defer first.Close()
+	pw.Write([]byte("first part, "))
+
+	// Joins after the generation has started writing
+	second := testFollowGeneration(t, archivePath)
+	defer second.Close()
+	if err := second.ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		pw.Write([]byte("second part"))
+		pw.Close()
+	}()
+
+	for _, follower := range []*generationFollower{first, second} {
+		data, err := ioutil.ReadAll(follower)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "first part, second part" {
+			t.Fatalf("unexpected archive %q", data)
+		}
+	}
+
+	cached, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cached) != "first part, second part" {
+		t.Fatalf("unexpected cached archive %q", cached)
+	}
+
+	generationsMutex.Lock()
+	defer generationsMutex.Unlock()
+	if generations[archivePath] != nil {
+		t.Fatal("expected finished generation to be forgotten")
+	}
+}
+
+func TestGenerationError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar")
+
+	_, pw, _ := testGeneration(t, archivePath)
+	generateErr := errors.New("git archive failed")
+
+	early := testFollowGeneration(t, archivePath)
+	defer early.Close()
+	pw.Write([]byte("partial"))
+
+	late := testFollowGeneration(t, archivePath)
+	defer late.Close()
+	pw.CloseWithError(generateErr)
+
+	for _, follower := range []*generationFollower{early, late} {
+		if _, err := ioutil.ReadAll(follower); err != generateErr {
+			t.Fatalf("expected generation error, got %v", err)
+		}
+	}
+
+	if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+		t.Fatalf("expected failed archive not to be cached, got %v", err)
+	}
+}
+
+func TestGenerationFailsBeforeData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar")
+
+	_, pw, _ := testGeneration(t, archivePath)
+	follower := testFollowGeneration(t, archivePath)
+	defer follower.Close()
+
+	generateErr := errors.New("unknown revision")
+	pw.CloseWithError(generateErr)
+
+	if err := follower.ready(); err != generateErr {
+		t.Fatalf("expected generation error, got %v", err)
+	}
+}
+
+func TestGenerationAbandoned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archivePath := filepath.Join(dir, "archive.tar")
+
+	gen, pw, ctx := testGeneration(t, archivePath)
+	defer pw.Close()
+
+	follower := testFollowGeneration(t, archivePath)
+	follower.Close()
+
+	<-ctx.Done()
+
+	generationsMutex.Lock()
+	defer generationsMutex.Unlock()
+	if !gen.abandoned {
+		t.Fatal("expected generation without followers to be abandoned")
+	}
+}
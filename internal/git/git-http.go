@@ -18,14 +18,23 @@ import (
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 )
 
-func ReceivePack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleReceivePack", handleReceivePack)
+func ReceivePack(a *api.API, maxPushSize int64, infoRefsCache *InfoRefsCache) http.Handler {
+	return postRPCHandler(a, "handleReceivePack", func(w *GitHttpResponseWriter, r *http.Request, ar *api.Response) error {
+		if infoRefsCache != nil {
+			// Even a failed push may have updated some refs
+			defer infoRefsCache.Pushed(ar)
+		}
+		return handleReceivePack(w, r, ar, maxPushSize)
+	})
 }
 
-func UploadPack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleUploadPack", handleUploadPack)
+func UploadPack(a *api.API, cache *UploadPackCache, queue *queueing.Queue) http.Handler {
+	return postRPCHandler(a, "handleUploadPack", func(w *GitHttpResponseWriter, r *http.Request, ar *api.Response) error {
+		return handleUploadPack(w, r, ar, cache, queue)
+	})
 }
 
 func postRPCHandler(a *api.API, name string, handler func(*GitHttpResponseWriter, *http.Request, *api.Response) error) http.Handler {
@@ -74,12 +83,15 @@ func repoPreAuthorizeHandler(myAPI *api.API, handleFunc api.HandleFunc) http.Han
 	}, "")
 }
 
-func startGitCommand(a *api.Response, stdin io.Reader, stdout io.Writer, action string, options ...string) (cmd *exec.Cmd, err error) {
+func startGitCommand(a *api.Response, stdin io.Reader, stdout io.Writer, action string, gitProtocol string, options ...string) (cmd *exec.Cmd, err error) {
 	// Prepare our Git subprocess
 	args := []string{subCommand(action), "--stateless-rpc"}
 	args = append(args, options...)
 	args = append(args, a.RepoPath)
 	cmd = gitCommand(a.GL_ID, a.GL_REPOSITORY, "git", args...)
+	if gitProtocol != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_PROTOCOL=%s", gitProtocol))
+	}
 	cmd.Stdin = stdin
 	cmd.Stdout = stdout
 
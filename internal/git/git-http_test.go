@@ -32,11 +32,15 @@ func createTestPayload() []byte {
 }
 
 func TestHandleUploadPack(t *testing.T) {
-	testHandlePostRpc(t, "git-upload-pack", handleUploadPack)
+	testHandlePostRpc(t, "git-upload-pack", func(w *GitHttpResponseWriter, r *http.Request, a *api.Response) error {
+		return handleUploadPack(w, r, a, nil, nil)
+	})
 }
 
 func TestHandleReceivePack(t *testing.T) {
-	testHandlePostRpc(t, "git-receive-pack", handleReceivePack)
+	testHandlePostRpc(t, "git-receive-pack", func(w *GitHttpResponseWriter, r *http.Request, a *api.Response) error {
+		return handleReceivePack(w, r, a, 0)
+	})
 }
 
 func testHandlePostRpc(t *testing.T, action string, handler func(*GitHttpResponseWriter, *http.Request, *api.Response) error) {
@@ -0,0 +1,291 @@
+/*
+In this file we cache ref advertisements until the refs change
+*/
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+const (
+	DefaultInfoRefsCacheMaxSize = 64 * 1024 * 1024
+	DefaultInfoRefsCacheTTL     = time.Minute
+
+	// Rails and gitlab-workhorse publish <prefix><gl_repository>=<anything>
+	// on the keywatcher channel when the refs of a repository change
+	InfoRefsNotificationPrefix = "git:refs:"
+)
+
+var (
+	infoRefsCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_info_refs_cache",
+			Help: "How many cacheable info/refs requests have been handled, partitioned by result (hit, miss).",
+		},
+		[]string{"result"},
+	)
+	infoRefsCacheInvalidations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_info_refs_cache_invalidations",
+			Help: "How many times the cached ref advertisements of a repository have been dropped, partitioned by source (push, notification, ttl, evicted).",
+		},
+		[]string{"source"},
+	)
+	infoRefsCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_info_refs_cache_size_bytes",
+			Help: "Total size of the cached ref advertisements.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(infoRefsCacheRequests)
+	prometheus.MustRegister(infoRefsCacheInvalidations)
+	prometheus.MustRegister(infoRefsCacheSize)
+}
+
+type infoRefsCacheEntry struct {
+	data     []byte
+	created  time.Time
+	lastUsed time.Time
+}
+
+// infoRefsCacheRepository holds the advertisements of one repository, by
+// service and protocol version. It is replaced when the repository is
+// invalidated, so that a response that was generated before a push does
+// not get cached after it.
+type infoRefsCacheRepository struct {
+	entries map[string]*infoRefsCacheEntry
+	// Misses that have not called set or abandon yet
+	pending int
+}
+
+// InfoRefsCache keeps info/refs responses in memory. CI jobs and mirrors
+// poll repositories much more often than they change. A repository's
+// entries are dropped when gitlab-workhorse handles a push to it, when a
+// notification for it arrives through the Redis keywatcher, and in any
+// case after the TTL.
+type InfoRefsCache struct {
+	sync.Mutex
+	maxSize      int64
+	ttl          time.Duration
+	totalSize    int64
+	repositories map[string]*infoRefsCacheRepository
+	notify       bool
+}
+
+// NewInfoRefsCache returns nil if cfg is nil. With notify set, pushes
+// are also announced through Redis so that other gitlab-workhorse
+// processes drop their entries too.
+func NewInfoRefsCache(cfg *config.InfoRefsCacheConfig, notify bool) *InfoRefsCache {
+	if cfg == nil {
+		return nil
+	}
+
+	c := &InfoRefsCache{
+		maxSize:      cfg.MaxSize,
+		ttl:          DefaultInfoRefsCacheTTL,
+		repositories: make(map[string]*infoRefsCacheRepository),
+		notify:       notify,
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = DefaultInfoRefsCacheMaxSize
+	}
+	if cfg.TTL != nil {
+		c.ttl = cfg.TTL.Duration
+	}
+
+	return c
+}
+
+// HandleNotification is a keywatcher listener for
+// InfoRefsNotificationPrefix.
+func (c *InfoRefsCache) HandleNotification(key, _ string) {
+	if c.invalidate(strings.TrimPrefix(key, InfoRefsNotificationPrefix)) {
+		infoRefsCacheInvalidations.WithLabelValues("notification").Inc()
+	}
+}
+
+// Pushed drops the entries of the repository a has pushed to.
+func (c *InfoRefsCache) Pushed(a *api.Response) {
+	if a.GL_REPOSITORY == "" {
+		return
+	}
+
+	if c.invalidate(a.GL_REPOSITORY) {
+		infoRefsCacheInvalidations.WithLabelValues("push").Inc()
+	}
+
+	if c.notify {
+		// Our own notification comes back to us, which does no harm
+		value := strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := redis.Notify(InfoRefsNotificationPrefix+a.GL_REPOSITORY, value); err != nil {
+			log.Printf("InfoRefsCache: %v", err)
+		}
+	}
+}
+
+func infoRefsCacheVariant(a *api.Response, rpc string, gitProtocol string) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s", rpc, gitProtocol, a.GitalyServer.Address, a.Repository.StorageName, a.Repository.RelativePath)
+}
+
+// get returns the cached response if there is one. Otherwise it returns
+// the repository to pass to set or abandon.
+func (c *InfoRefsCache) get(glRepository string, variant string) ([]byte, *infoRefsCacheRepository) {
+	c.Lock()
+	defer c.Unlock()
+
+	repository := c.repositories[glRepository]
+	if repository == nil {
+		repository = &infoRefsCacheRepository{entries: make(map[string]*infoRefsCacheEntry)}
+		c.repositories[glRepository] = repository
+	}
+
+	entry := repository.entries[variant]
+	if entry != nil && time.Since(entry.created) > c.ttl {
+		c.removeEntry(repository, variant)
+		infoRefsCacheInvalidations.WithLabelValues("ttl").Inc()
+		entry = nil
+	}
+
+	if entry == nil {
+		infoRefsCacheRequests.WithLabelValues("miss").Inc()
+		repository.pending++
+		return nil, repository
+	}
+
+	entry.lastUsed = time.Now()
+	infoRefsCacheRequests.WithLabelValues("hit").Inc()
+	return entry.data, nil
+}
+
+// set stores data unless the repository has been invalidated since get.
+func (c *InfoRefsCache) set(glRepository string, repository *infoRefsCacheRepository, variant string, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	repository.pending--
+	size := int64(len(data))
+	if c.repositories[glRepository] != repository || size > c.maxSize {
+		c.prune(glRepository, repository)
+		return
+	}
+
+	c.removeEntry(repository, variant)
+
+	now := time.Now()
+	repository.entries[variant] = &infoRefsCacheEntry{data: data, created: now, lastUsed: now}
+	c.totalSize += size
+
+	for c.totalSize > c.maxSize {
+		c.evictOldest()
+	}
+
+	infoRefsCacheSize.Set(float64(c.totalSize))
+}
+
+// abandon is set for misses that have nothing to store.
+func (c *InfoRefsCache) abandon(glRepository string, repository *infoRefsCacheRepository) {
+	c.Lock()
+	defer c.Unlock()
+
+	repository.pending--
+	c.prune(glRepository, repository)
+}
+
+// prune forgets about a repository without entries, so that the
+// repositories of failed requests and expired or evicted entries do not
+// pile up. It must be called with the lock held.
+func (c *InfoRefsCache) prune(glRepository string, repository *infoRefsCacheRepository) {
+	if c.repositories[glRepository] == repository && len(repository.entries) == 0 && repository.pending == 0 {
+		delete(c.repositories, glRepository)
+	}
+}
+
+// invalidate reports whether there was anything to drop.
+func (c *InfoRefsCache) invalidate(glRepository string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	repository := c.repositories[glRepository]
+	if repository == nil {
+		return false
+	}
+
+	for variant := range repository.entries {
+		c.removeEntry(repository, variant)
+	}
+	delete(c.repositories, glRepository)
+	infoRefsCacheSize.Set(float64(c.totalSize))
+
+	return true
+}
+
+// removeEntry must be called with the lock held.
+func (c *InfoRefsCache) removeEntry(repository *infoRefsCacheRepository, variant string) {
+	entry := repository.entries[variant]
+	if entry == nil {
+		return
+	}
+
+	delete(repository.entries, variant)
+	c.totalSize -= int64(len(entry.data))
+}
+
+// evictOldest must be called with the lock held.
+func (c *InfoRefsCache) evictOldest() {
+	var oldestRepository, oldestVariant string
+	var oldest *infoRefsCacheEntry
+	for glRepository, repository := range c.repositories {
+		for variant, entry := range repository.entries {
+			if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+				oldestRepository, oldestVariant, oldest = glRepository, variant, entry
+			}
+		}
+	}
+
+	if oldest == nil {
+		return
+	}
+
+	repository := c.repositories[oldestRepository]
+	c.removeEntry(repository, oldestVariant)
+	c.prune(oldestRepository, repository)
+	infoRefsCacheInvalidations.WithLabelValues("evicted").Inc()
+}
+
+// serve writes the advertisement for a, rpc and gitProtocol to w, from
+// the cache if possible. Otherwise produce is called to generate it.
+func (c *InfoRefsCache) serve(a *api.Response, rpc string, gitProtocol string, w io.Writer, produce func(io.Writer) error) error {
+	variant := infoRefsCacheVariant(a, rpc, gitProtocol)
+
+	data, repository := c.get(a.GL_REPOSITORY, variant)
+	if data != nil {
+		_, err := w.Write(data)
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := produce(io.MultiWriter(w, &buf)); err != nil {
+		c.abandon(a.GL_REPOSITORY, repository)
+		return err
+	}
+
+	c.set(a.GL_REPOSITORY, repository, variant, buf.Bytes())
+	return nil
+}
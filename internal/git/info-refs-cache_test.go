@@ -0,0 +1,160 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func testInfoRefsResponse(glRepository string) *api.Response {
+	a := &api.Response{GL_REPOSITORY: glRepository}
+	a.Repository.StorageName = "default"
+	a.Repository.RelativePath = glRepository + ".git"
+	return a
+}
+
+// serveInfoRefs returns the response and whether produce was called
+func serveInfoRefs(t *testing.T, c *InfoRefsCache, a *api.Response, rpc string, data string) (string, bool) {
+	produced := false
+	produce := func(w io.Writer) error {
+		produced = true
+		_, err := io.WriteString(w, data)
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := c.serve(a, rpc, "", &buf, produce); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), produced
+}
+
+func TestInfoRefsCacheHit(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{}, false)
+	a := testInfoRefsResponse("project-1")
+
+	if _, produced := serveInfoRefs(t, c, a, "git-upload-pack", "refs v1"); !produced {
+		t.Fatal("expected a miss")
+	}
+
+	body, produced := serveInfoRefs(t, c, a, "git-upload-pack", "refs v2")
+	if produced {
+		t.Fatal("expected a hit")
+	}
+	if body != "refs v1" {
+		t.Fatalf("expected cached response, got %q", body)
+	}
+
+	if _, produced := serveInfoRefs(t, c, a, "git-receive-pack", "refs v1"); !produced {
+		t.Fatal("expected services to be cached separately")
+	}
+}
+
+func TestInfoRefsCacheInvalidation(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{}, false)
+	a := testInfoRefsResponse("project-1")
+	other := testInfoRefsResponse("project-2")
+
+	serveInfoRefs(t, c, a, "git-upload-pack", "refs v1")
+	serveInfoRefs(t, c, other, "git-upload-pack", "other refs")
+
+	c.Pushed(a)
+	if body, _ := serveInfoRefs(t, c, a, "git-upload-pack", "refs v2"); body != "refs v2" {
+		t.Fatalf("expected a fresh response after a push, got %q", body)
+	}
+
+	c.HandleNotification(InfoRefsNotificationPrefix+"project-1", "1")
+	if body, _ := serveInfoRefs(t, c, a, "git-upload-pack", "refs v3"); body != "refs v3" {
+		t.Fatalf("expected a fresh response after a notification, got %q", body)
+	}
+
+	if _, produced := serveInfoRefs(t, c, other, "git-upload-pack", "other refs"); produced {
+		t.Fatal("expected other repositories to stay cached")
+	}
+}
+
+func TestInfoRefsCacheInvalidatedWhileProducing(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{}, false)
+	a := testInfoRefsResponse("project-1")
+
+	var buf bytes.Buffer
+	err := c.serve(a, "git-upload-pack", "", &buf, func(w io.Writer) error {
+		io.WriteString(w, "refs before push")
+		c.Pushed(a)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body, _ := serveInfoRefs(t, c, a, "git-upload-pack", "refs after push"); body != "refs after push" {
+		t.Fatalf("expected response from before the push not to be cached, got %q", body)
+	}
+}
+
+func TestInfoRefsCacheTTL(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{TTL: &config.TomlDuration{Duration: time.Nanosecond}}, false)
+	a := testInfoRefsResponse("project-1")
+
+	serveInfoRefs(t, c, a, "git-upload-pack", "refs v1")
+	time.Sleep(time.Millisecond)
+	if body, _ := serveInfoRefs(t, c, a, "git-upload-pack", "refs v2"); body != "refs v2" {
+		t.Fatalf("expected expired response to be replaced, got %q", body)
+	}
+}
+
+func TestInfoRefsCacheEviction(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{MaxSize: 10}, false)
+	a := testInfoRefsResponse("project-1")
+	other := testInfoRefsResponse("project-2")
+
+	serveInfoRefs(t, c, a, "git-upload-pack", "123456")
+	serveInfoRefs(t, c, other, "git-upload-pack", "abcdef")
+
+	if c.totalSize != 6 {
+		t.Fatalf("expected the older entry to be evicted, total size is %d", c.totalSize)
+	}
+	if _, produced := serveInfoRefs(t, c, other, "git-upload-pack", "abcdef"); produced {
+		t.Fatal("expected newer entry to be cached")
+	}
+
+	if _, produced := serveInfoRefs(t, c, a, "git-upload-pack", "this is too large to cache"); !produced {
+		t.Fatal("expected a miss")
+	}
+	if _, produced := serveInfoRefs(t, c, a, "git-upload-pack", "this is too large to cache"); !produced {
+		t.Fatal("expected response larger than the cache not to be cached")
+	}
+}
+
+func TestInfoRefsCacheForgetsEmptyRepositories(t *testing.T) {
+	c := NewInfoRefsCache(&config.InfoRefsCacheConfig{MaxSize: 10, TTL: &config.TomlDuration{Duration: time.Minute}}, false)
+
+	failing := func(w io.Writer) error { return fmt.Errorf("gitaly is gone") }
+	if err := c.serve(testInfoRefsResponse("failed"), "git-upload-pack", "", ioutil.Discard, failing); err == nil {
+		t.Fatal("expected produce error")
+	}
+
+	serveInfoRefs(t, c, testInfoRefsResponse("too-large"), "git-upload-pack", "this is too large to cache")
+
+	serveInfoRefs(t, c, testInfoRefsResponse("evicted"), "git-upload-pack", "123456")
+	serveInfoRefs(t, c, testInfoRefsResponse("kept"), "git-upload-pack", "abcdef")
+
+	c.ttl = time.Nanosecond
+	serveInfoRefs(t, c, testInfoRefsResponse("expired"), "git-upload-pack", "1")
+	time.Sleep(time.Millisecond)
+	if err := c.serve(testInfoRefsResponse("expired"), "git-upload-pack", "", ioutil.Discard, failing); err == nil {
+		t.Fatal("expected produce error")
+	}
+
+	for glRepository := range c.repositories {
+		if glRepository != "kept" {
+			t.Errorf("expected %q to be forgotten", glRepository)
+		}
+	}
+}
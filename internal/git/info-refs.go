@@ -16,11 +16,13 @@ var (
 	Testing = false
 )
 
-func GetInfoRefsHandler(a *api.API) http.Handler {
-	return repoPreAuthorizeHandler(a, handleGetInfoRefs)
+func GetInfoRefsHandler(a *api.API, cache *InfoRefsCache) http.Handler {
+	return repoPreAuthorizeHandler(a, func(rw http.ResponseWriter, r *http.Request, ar *api.Response) {
+		handleGetInfoRefs(rw, r, ar, cache)
+	})
 }
 
-func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response) {
+func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response, cache *InfoRefsCache) {
 	w := NewGitHttpResponseWriter(rw)
 	// Log 0 bytes in because we ignore the request body (and there usually is none anyway).
 	defer w.Log(r, 0)
@@ -35,11 +37,24 @@ func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response)
 	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
 	w.Header().Set("Cache-Control", "no-cache")
 
+	// Protocol v2 only applies to fetches
+	var gitProtocol string
+	if rpc == "git-upload-pack" {
+		gitProtocol = localGitProtocol(r, a, rpc)
+	}
+
+	produce := func(out io.Writer) error {
+		if a.GitalyServer.Address == "" && Testing {
+			return handleGetInfoRefsLocalTesting(out, a, rpc, gitProtocol)
+		}
+		return handleGetInfoRefsWithGitaly(r.Context(), out, a, rpc)
+	}
+
 	var err error
-	if a.GitalyServer.Address == "" && Testing {
-		err = handleGetInfoRefsLocalTesting(w, a, rpc)
+	if cache == nil || a.GL_REPOSITORY == "" {
+		err = produce(w)
 	} else {
-		err = handleGetInfoRefsWithGitaly(r.Context(), w, a, rpc)
+		err = cache.serve(a, rpc, gitProtocol, w, produce)
 	}
 
 	if err != nil {
@@ -50,7 +65,7 @@ func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response)
 // This code is not used in production. It is left over from before
 // Gitaly. We left it here to allow local workhorse tests to keep working
 // until we are done migrating Git HTTP to Gitaly.
-func handleGetInfoRefsLocalTesting(w http.ResponseWriter, a *api.Response, rpc string) error {
+func handleGetInfoRefsLocalTesting(w io.Writer, a *api.Response, rpc string, gitProtocol string) error {
 	if err := pktLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
 		return fmt.Errorf("pktLine: %v", err)
 	}
@@ -58,7 +73,7 @@ func handleGetInfoRefsLocalTesting(w http.ResponseWriter, a *api.Response, rpc s
 		return fmt.Errorf("pktFlush: %v", err)
 	}
 
-	cmd, err := startGitCommand(a, nil, w, rpc, "--advertise-refs")
+	cmd, err := startGitCommand(a, nil, w, rpc, gitProtocol, "--advertise-refs")
 	if err != nil {
 		return fmt.Errorf("startGitCommand: %v", err)
 	}
@@ -71,7 +86,7 @@ func handleGetInfoRefsLocalTesting(w http.ResponseWriter, a *api.Response, rpc s
 	return nil
 }
 
-func handleGetInfoRefsWithGitaly(ctx context.Context, w http.ResponseWriter, a *api.Response, rpc string) error {
+func handleGetInfoRefsWithGitaly(ctx context.Context, w io.Writer, a *api.Response, rpc string) error {
 	smarthttp, err := gitaly.NewSmartHTTPClient(a.GitalyServer)
 	if err != nil {
 		return fmt.Errorf("GetInfoRefsHandler: %v", err)
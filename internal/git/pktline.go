@@ -53,7 +53,12 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 	// Cast is safe because we requested an int-size number from strconv.ParseInt
 	pktLength := int(pktLength64)
 
-	if pktLength < 0 {
+	// Protocol v2 delimiter ("0001") and response end ("0002") packets
+	if pktLength == 1 || pktLength == 2 {
+		return 4, data[:0], nil
+	}
+
+	if pktLength < 0 || pktLength == 3 {
 		return 0, nil, fmt.Errorf("pktLineSplitter: invalid length: %d", pktLength)
 	}
 
@@ -67,3 +72,46 @@ func pktLineSplitter(data []byte, atEOF bool) (advance int, token []byte, err er
 	// return "pkt" token without length prefix
 	return pktLength, data[4:pktLength], nil
 }
+
+// pktLineParser calls handle for each pkt-line written to it. Flush and
+// delimiter packets are passed as nil. Writes never fail so the parser can
+// be used in a TeeReader or MultiWriter.
+type pktLineParser struct {
+	buf    []byte
+	handle func(line []byte) bool
+	done   bool
+}
+
+func (p *pktLineParser) Write(data []byte) (int, error) {
+	if p.done {
+		return len(data), nil
+	}
+
+	p.buf = append(p.buf, data...)
+	for !p.done && len(p.buf) >= 4 {
+		length, err := strconv.ParseUint(string(p.buf[:4]), 16, 16)
+		if err != nil || length == 3 {
+			p.done = true
+			break
+		}
+
+		if length < 4 {
+			p.buf = p.buf[4:]
+			p.done = !p.handle(nil)
+			continue
+		}
+
+		if len(p.buf) < int(length) {
+			break
+		}
+
+		line := p.buf[4:length]
+		p.buf = p.buf[length:]
+		p.done = !p.handle(line)
+	}
+
+	if p.done {
+		p.buf = nil
+	}
+	return len(data), nil
+}
@@ -37,3 +37,10 @@ func TestFailedScanDeepen(t *testing.T) {
 		}
 	}
 }
+
+func TestScanDeepenProtocolV2(t *testing.T) {
+	input := "0012command=fetch\n0001000ddeepen 10000"
+	if !scanDeepen(bytes.NewReader([]byte(input))) {
+		t.Fatalf("scanDeepen %q: expected result to be true, got false", input)
+	}
+}
@@ -0,0 +1,84 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const gitProtocolHeader = "Git-Protocol"
+
+var (
+	gitProtocolRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_protocol_requests",
+			Help: "How many Git HTTP requests have been handled, partitioned by RPC and Git protocol version.",
+		},
+		[]string{"rpc", "version"},
+	)
+
+	// Git-Protocol is a colon-separated list of key or key=value parameters
+	gitProtocolParameter = regexp.MustCompile(`\A[a-zA-Z0-9._-]+(=[a-zA-Z0-9./_-]*)?\z`)
+)
+
+func init() {
+	prometheus.MustRegister(gitProtocolRequests)
+}
+
+// getGitProtocol returns the Git-Protocol header of r if it is valid, and
+// an empty string otherwise. An empty string means protocol v0.
+func getGitProtocol(r *http.Request, rpc string) string {
+	header := r.Header.Get(gitProtocolHeader)
+	version, err := parseGitProtocol(header)
+	if err != nil {
+		helper.LogError(r, fmt.Errorf("getGitProtocol: %v", err))
+		header, version = "", "0"
+	}
+
+	gitProtocolRequests.WithLabelValues(rpc, version).Inc()
+	return header
+}
+
+// localGitProtocol is getGitProtocol for requests that may be served by
+// Gitaly. The vendored gitaly-proto (v0.29.0) has no git_protocol field
+// yet, so only local git gets to see the header; with Gitaly we stay on
+// protocol v0 until we move to a gitaly-proto release that has it. The
+// response must then be treated as v0 too, e.g. by the upload-pack
+// cache, which is why this returns "" rather than the header.
+func localGitProtocol(r *http.Request, a *api.Response, rpc string) string {
+	gitProtocol := getGitProtocol(r, rpc)
+	if !(Testing && a.GitalyServer.Address == "") {
+		return ""
+	}
+	return gitProtocol
+}
+
+func parseGitProtocol(header string) (version string, err error) {
+	version = "0"
+	if header == "" {
+		return version, nil
+	}
+
+	for _, parameter := range strings.Split(header, ":") {
+		if !gitProtocolParameter.MatchString(parameter) {
+			return "", fmt.Errorf("invalid %s header: %q", gitProtocolHeader, header)
+		}
+
+		if strings.HasPrefix(parameter, "version=") {
+			version = strings.TrimPrefix(parameter, "version=")
+		}
+	}
+
+	switch version {
+	case "0", "1", "2":
+		return version, nil
+	default:
+		return "", fmt.Errorf("unsupported Git protocol version in %s header: %q", gitProtocolHeader, header)
+	}
+}
@@ -0,0 +1,49 @@
+package git
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseGitProtocol(t *testing.T) {
+	testCases := []struct {
+		header  string
+		version string
+		valid   bool
+	}{
+		{"", "0", true},
+		{"version=2", "2", true},
+		{"version=1", "1", true},
+		{"version=2:object-format=sha1", "2", true},
+		{"agent=git/2.18.0", "0", true},
+		{"version=3", "", false},
+		{"version=2\nfoo", "", false},
+		{"version=2 ; rm -rf", "", false},
+		{"version=2::", "", false},
+	}
+
+	for _, tc := range testCases {
+		version, err := parseGitProtocol(tc.header)
+		if tc.valid != (err == nil) {
+			t.Errorf("%q: expected valid=%v, got error %v", tc.header, tc.valid, err)
+			continue
+		}
+		if version != tc.version {
+			t.Errorf("%q: expected version %q, got %q", tc.header, tc.version, version)
+		}
+	}
+}
+
+func TestGetGitProtocolDropsInvalidHeader(t *testing.T) {
+	r := httptest.NewRequest("POST", "/group/project.git/git-upload-pack", nil)
+
+	r.Header.Set(gitProtocolHeader, "version=2")
+	if protocol := getGitProtocol(r, "git-upload-pack"); protocol != "version=2" {
+		t.Fatalf("expected %q, got %q", "version=2", protocol)
+	}
+
+	r.Header.Set(gitProtocolHeader, "version=2\x00")
+	if protocol := getGitProtocol(r, "git-upload-pack"); protocol != "" {
+		t.Fatalf("expected invalid header to be dropped, got %q", protocol)
+	}
+}
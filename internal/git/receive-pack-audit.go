@@ -0,0 +1,127 @@
+/*
+In this file we record which refs a 'git push' updates, for the audit log
+*/
+
+package git
+
+import (
+	"net/http"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/audit"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+type pushAuditRecord struct {
+	GlID         string       `json:"gl_id"`
+	GlRepository string       `json:"gl_repository"`
+	Path         string       `json:"path"`
+	ClientIP     string       `json:"client_ip"`
+	ForwardedFor string       `json:"forwarded_for,omitempty"`
+	RefUpdates   []*refUpdate `json:"ref_updates"`
+	PushOptions  []string     `json:"push_options,omitempty"`
+	Truncated    bool         `json:"truncated,omitempty"`
+	UnpackStatus string       `json:"unpack_status"`
+	Error        string       `json:"error,omitempty"`
+	HTTPStatus   int          `json:"http_status"`
+}
+
+// pushAudit collects the ref update commands from a receive-pack request
+// and their outcome from the report-status response.
+type pushAudit struct {
+	record  pushAuditRecord
+	request *receivePackRequest
+	refs    map[string]*refUpdate
+
+	// response sees the response body as it streams by
+	response *pktLineParser
+	status   *pktLineParser
+}
+
+func newPushAudit(r *http.Request, a *api.Response, request *receivePackRequest) *pushAudit {
+	p := &pushAudit{
+		record: pushAuditRecord{
+			GlID:         a.GL_ID,
+			GlRepository: a.GL_REPOSITORY,
+			Path:         r.URL.Path,
+			ClientIP:     helper.ClientIP(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			UnpackStatus: "unknown",
+		},
+		request: request,
+	}
+	p.response = &pktLineParser{handle: p.handleResponse}
+	p.status = &pktLineParser{handle: p.handleStatus}
+	return p
+}
+
+func (p *pushAudit) handleResponse(line []byte) bool {
+	if !p.request.SideBand {
+		return p.handleStatus(line)
+	}
+
+	if len(line) == 0 {
+		return true
+	}
+
+	switch line[0] {
+	case 1:
+		p.status.Write(line[1:])
+	case 3:
+		p.record.Error = strings.TrimSpace(string(line[1:]))
+	}
+	return true
+}
+
+func (p *pushAudit) handleStatus(line []byte) bool {
+	if line == nil {
+		return true
+	}
+
+	status := strings.TrimSuffix(string(line), "\n")
+	switch {
+	case strings.HasPrefix(status, "unpack "):
+		p.record.UnpackStatus = strings.TrimPrefix(status, "unpack ")
+	case strings.HasPrefix(status, "ok "):
+		if update := p.refUpdate(strings.TrimPrefix(status, "ok ")); update != nil {
+			update.Status = "ok"
+		}
+	case strings.HasPrefix(status, "ng "):
+		fields := strings.SplitN(strings.TrimPrefix(status, "ng "), " ", 2)
+		if update := p.refUpdate(fields[0]); update != nil {
+			update.Status = "ng"
+			if len(fields) == 2 {
+				update.Reason = fields[1]
+			}
+		}
+	}
+	return true
+}
+
+// refUpdate must only be called once the commands have been parsed,
+// which is the case when git responds.
+func (p *pushAudit) refUpdate(ref string) *refUpdate {
+	if p.refs == nil {
+		p.refs = make(map[string]*refUpdate)
+		for _, update := range p.request.Commands {
+			p.refs[update.Ref] = update
+		}
+	}
+	return p.refs[ref]
+}
+
+func (p *pushAudit) fillRecord(w *GitHttpResponseWriter, err error) {
+	p.record.RefUpdates = p.request.Commands
+	p.record.PushOptions = p.request.PushOptions
+	p.record.Truncated = p.request.Truncated
+	p.record.HTTPStatus = w.Status()
+	if err != nil {
+		p.record.Error = err.Error()
+	}
+}
+
+func (p *pushAudit) Log(w *GitHttpResponseWriter, err error) {
+	p.fillRecord(w, err)
+	audit.Log("push", &p.record)
+}
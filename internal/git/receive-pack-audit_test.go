@@ -0,0 +1,133 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+var (
+	zeroSha = strings.Repeat("0", 40)
+	shaA    = strings.Repeat("a", 40)
+	shaB    = strings.Repeat("b", 40)
+)
+
+func newTestPushAudit() *pushAudit {
+	r := httptest.NewRequest("POST", "/group/project.git/git-receive-pack", nil)
+	r.RemoteAddr = "10.0.0.2:4321"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 127.0.0.1")
+	return newPushAudit(r, &api.Response{GL_ID: "user-1", GL_REPOSITORY: "project-2"}, newReceivePackRequest())
+}
+
+// writeInChunks makes sure the parser copes with pkt-lines that are split
+// across writes.
+func writeInChunks(w io.Writer, data string) {
+	for len(data) > 0 {
+		n := 7
+		if n > len(data) {
+			n = len(data)
+		}
+		w.Write([]byte(data[:n]))
+		data = data[n:]
+	}
+}
+
+func sideBand(channel byte, data string) string {
+	var buf bytes.Buffer
+	pktLine(&buf, string(channel)+data)
+	return buf.String()
+}
+
+func TestPushAuditSideBand(t *testing.T) {
+	p := newTestPushAudit()
+
+	request := pktLines(
+		zeroSha+" "+shaA+" refs/heads/feature\x00report-status side-band-64k push-options agent=git/2.18.0",
+		shaA+" "+shaB+" refs/heads/master",
+		"",
+		"ci.skip",
+		"",
+	) + "PACK garbage that is not pkt-line encoded"
+	writeInChunks(p.request, request)
+
+	status := pktLines("unpack ok", "ok refs/heads/feature", "ng refs/heads/master pre-receive hook declined", "")
+	response := sideBand(2, "Resolving deltas: 100% (1/1)\n") + sideBand(1, status) + "0000"
+	writeInChunks(p.response, response)
+
+	rw := httptest.NewRecorder()
+	w := NewGitHttpResponseWriter(rw)
+	w.WriteHeader(200)
+	p.fillRecord(w, nil)
+
+	expected := pushAuditRecord{
+		GlID:         "user-1",
+		GlRepository: "project-2",
+		Path:         "/group/project.git/git-receive-pack",
+		ClientIP:     "10.0.0.2",
+		ForwardedFor: "10.0.0.1, 127.0.0.1",
+		RefUpdates: []*refUpdate{
+			{OldSha: zeroSha, NewSha: shaA, Ref: "refs/heads/feature", Status: "ok"},
+			{OldSha: shaA, NewSha: shaB, Ref: "refs/heads/master", Status: "ng", Reason: "pre-receive hook declined"},
+		},
+		PushOptions:  []string{"ci.skip"},
+		UnpackStatus: "ok",
+		HTTPStatus:   200,
+	}
+	if !reflect.DeepEqual(p.record, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, p.record)
+	}
+}
+
+func TestPushAuditWithoutSideBand(t *testing.T) {
+	p := newTestPushAudit()
+
+	writeInChunks(p.request, pktLines(shaA+" "+zeroSha+" refs/heads/old\x00report-status", "")+"PACK")
+	writeInChunks(p.response, pktLines("unpack ok", "ok refs/heads/old", ""))
+
+	if len(p.request.PushOptions) != 0 {
+		t.Fatalf("expected no push options, got %v", p.request.PushOptions)
+	}
+	expected := []*refUpdate{{OldSha: shaA, NewSha: zeroSha, Ref: "refs/heads/old", Status: "ok"}}
+	if !reflect.DeepEqual(p.request.Commands, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, p.request.Commands)
+	}
+	if p.record.UnpackStatus != "ok" {
+		t.Fatalf("expected unpack status ok, got %q", p.record.UnpackStatus)
+	}
+}
+
+func TestPushAuditErrorChannel(t *testing.T) {
+	p := newTestPushAudit()
+
+	writeInChunks(p.request, pktLines(zeroSha+" "+shaA+" refs/heads/feature\x00side-band-64k", ""))
+	writeInChunks(p.response, sideBand(3, "fatal: unpack failed\n"))
+
+	if p.record.Error != "fatal: unpack failed" {
+		t.Fatalf("expected error to be recorded, got %q", p.record.Error)
+	}
+	if status := p.request.Commands[0].Status; status != "unknown" {
+		t.Fatalf("expected status unknown, got %q", status)
+	}
+}
+
+func TestPushAuditTruncated(t *testing.T) {
+	p := newTestPushAudit()
+
+	var lines []string
+	for i := 0; i < 20000; i++ {
+		lines = append(lines, zeroSha+" "+shaA+" refs/heads/branch-"+strings.Repeat("x", 10))
+	}
+	writeInChunks(p.request, pktLines(lines...))
+
+	if !p.request.Truncated {
+		t.Fatal("expected commands to be truncated")
+	}
+	if n := len(p.request.Commands); n == 0 || n >= len(lines) {
+		t.Fatalf("expected a partial list of ref updates, got %d", n)
+	}
+}
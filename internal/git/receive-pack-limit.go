@@ -0,0 +1,147 @@
+/*
+In this file we cut off 'git push' requests that are larger than allowed
+*/
+
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+var errPushTooLarge = errors.New("push exceeds the maximum size")
+
+var pushesTooLarge = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_git_receive_pack_too_large",
+		Help: "How many git-receive-pack requests were rejected for exceeding the maximum push size.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(pushesTooLarge)
+}
+
+// pushSizeLimit prefers the limit Rails sent for the project over the
+// global one. Zero means unlimited.
+func pushSizeLimit(a *api.Response, maxPushSize int64) int64 {
+	if a.MaxPushSize > 0 {
+		return a.MaxPushSize
+	}
+	return maxPushSize
+}
+
+// pushSizeLimiter reads the request body and fails as soon as it is
+// clear that the push is too large: when more than limit bytes have been
+// read, or as soon as the commands are parsed if the Content-Length says
+// it will be too large. From then on, the response from git or Gitaly is
+// discarded so that we can write our own.
+type pushSizeLimiter struct {
+	reader        io.Reader
+	out           io.Writer
+	request       *receivePackRequest
+	limit         int64
+	contentLength int64
+	cancel        func()
+
+	n        int64
+	mutex    sync.Mutex
+	exceeded bool
+}
+
+func newPushSizeLimiter(reader io.Reader, out io.Writer, request *receivePackRequest, limit int64, contentLength int64, cancel func()) *pushSizeLimiter {
+	return &pushSizeLimiter{
+		reader:        reader,
+		out:           out,
+		request:       request,
+		limit:         limit,
+		contentLength: contentLength,
+		cancel:        cancel,
+	}
+}
+
+func (l *pushSizeLimiter) Read(p []byte) (int, error) {
+	if l.Exceeded() {
+		return 0, errPushTooLarge
+	}
+
+	n, err := l.reader.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit || (l.contentLength > l.limit && l.request.Parsed()) {
+		l.mutex.Lock()
+		l.exceeded = true
+		l.mutex.Unlock()
+
+		l.cancel()
+		return 0, errPushTooLarge
+	}
+
+	return n, err
+}
+
+func (l *pushSizeLimiter) Exceeded() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.exceeded
+}
+
+// Output returns a writer that passes the response on until the limit
+// is exceeded.
+func (l *pushSizeLimiter) Output() io.Writer {
+	return &pushSizeLimiterOutput{l}
+}
+
+type pushSizeLimiterOutput struct {
+	limiter *pushSizeLimiter
+}
+
+func (o *pushSizeLimiterOutput) Write(p []byte) (int, error) {
+	if o.limiter.Exceeded() {
+		return len(p), nil
+	}
+	return o.limiter.out.Write(p)
+}
+
+// Reject tells the client why its push failed, in a way git displays:
+// an 'unpack' error and an 'ng' line for each ref in the report-status,
+// and a progress message if the client asked for side-band.
+func (l *pushSizeLimiter) Reject(r *http.Request) error {
+	pushesTooLarge.Inc()
+	helper.LogError(r, fmt.Errorf("handleReceivePack: %v of %d bytes", errPushTooLarge, l.limit))
+
+	reason := fmt.Sprintf("%v of %d bytes", errPushTooLarge, l.limit)
+
+	var status bytes.Buffer
+	if l.request.ReportStatus {
+		pktLine(&status, "unpack "+reason+"\n")
+		for _, command := range l.request.Commands {
+			pktLine(&status, "ng "+command.Ref+" push too large\n")
+		}
+		pktFlush(&status)
+	}
+
+	if !l.request.SideBand {
+		_, err := status.WriteTo(l.out)
+		return err
+	}
+
+	var response bytes.Buffer
+	pktLine(&response, "\x02"+reason+"\n")
+	for status.Len() > 0 {
+		// Stay within the 1000 byte packets of plain side-band
+		pktLine(&response, "\x01"+string(status.Next(995)))
+	}
+	pktFlush(&response)
+
+	_, err := response.WriteTo(l.out)
+	return err
+}
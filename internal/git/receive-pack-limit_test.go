@@ -0,0 +1,150 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestPushSizeLimit(t *testing.T) {
+	if limit := pushSizeLimit(&api.Response{}, 100); limit != 100 {
+		t.Errorf("expected global limit, got %d", limit)
+	}
+	if limit := pushSizeLimit(&api.Response{MaxPushSize: 10}, 100); limit != 10 {
+		t.Errorf("expected project limit, got %d", limit)
+	}
+}
+
+func testPushRequest(capabilities string) string {
+	return pktLines(
+		zeroSha+" "+shaA+" refs/heads/feature\x00"+capabilities,
+		shaA+" "+shaB+" refs/heads/master",
+		"",
+	)
+}
+
+func TestPushSizeLimiterReadsUpToLimit(t *testing.T) {
+	body := testPushRequest("report-status") + "PACK" + strings.Repeat("x", 1000)
+	request := newReceivePackRequest()
+
+	l := newPushSizeLimiter(io.TeeReader(strings.NewReader(body), request), ioutil.Discard, request, int64(len(body)), -1, func() {})
+	if _, err := io.Copy(ioutil.Discard, l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Exceeded() {
+		t.Fatal("expected a push of exactly the maximum size to be accepted")
+	}
+}
+
+func TestPushSizeLimiterContentLength(t *testing.T) {
+	commands := testPushRequest("report-status")
+	body := commands + "PACK" + strings.Repeat("x", 100000)
+	request := newReceivePackRequest()
+
+	cancelled := false
+	l := newPushSizeLimiter(io.TeeReader(strings.NewReader(body), request), ioutil.Discard, request, 1000, int64(len(body)), func() { cancelled = true })
+
+	buf := make([]byte, len(commands))
+	if _, err := io.ReadFull(l, buf); err != errPushTooLarge {
+		t.Fatalf("expected %v, got %v", errPushTooLarge, err)
+	}
+	if !cancelled {
+		t.Fatal("expected the request to Gitaly to be cancelled")
+	}
+	if _, err := l.Read(buf); err != errPushTooLarge {
+		t.Fatalf("expected reads to keep failing, got %v", err)
+	}
+}
+
+func TestPushSizeLimiterReject(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		capabilities string
+		expected     string
+	}{
+		{
+			desc:         "report-status",
+			capabilities: "report-status",
+			expected: pktLines(
+				"unpack push exceeds the maximum size of 10 bytes",
+				"ng refs/heads/feature push too large",
+				"ng refs/heads/master push too large",
+				"",
+			),
+		},
+		{
+			desc:         "side-band",
+			capabilities: "report-status side-band-64k",
+			expected: sideBand(2, "push exceeds the maximum size of 10 bytes\n") +
+				sideBand(1, pktLines(
+					"unpack push exceeds the maximum size of 10 bytes",
+					"ng refs/heads/feature push too large",
+					"ng refs/heads/master push too large",
+					"",
+				)) +
+				"0000",
+		},
+		{
+			desc:         "no report-status",
+			capabilities: "side-band-64k",
+			expected:     sideBand(2, "push exceeds the maximum size of 10 bytes\n") + "0000",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			request := newReceivePackRequest()
+			request.Write([]byte(testPushRequest(tc.capabilities)))
+
+			out := &bytes.Buffer{}
+			l := newPushSizeLimiter(strings.NewReader(""), out, request, 10, -1, func() {})
+			if err := l.Reject(httptest.NewRequest("POST", "/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestHandleReceivePackTooLarge(t *testing.T) {
+	defer func(oldTesting bool) {
+		Testing = oldTesting
+	}(Testing)
+	Testing = true
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.Command }()
+
+	body := testPushRequest("report-status") + "PACK" + strings.Repeat("x", 100000)
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-receive-pack", strings.NewReader(body))
+	req.ContentLength = -1
+
+	rr := httptest.NewRecorder()
+	if err := handleReceivePack(NewGitHttpResponseWriter(rr), req, &api.Response{GL_ID: GL_ID}, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+
+	// The fake git echoes the request; none of that may reach the client
+	expected := pktLines(
+		"unpack push exceeds the maximum size of 1000 bytes",
+		"ng refs/heads/feature push too large",
+		"ng refs/heads/master push too large",
+		"",
+	)
+	if rr.Body.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, rr.Body.String())
+	}
+}
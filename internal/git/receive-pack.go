@@ -1,37 +1,154 @@
 package git
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/audit"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
+// Command lists are small; if we have not seen the end of it after this
+// many bytes, we stop looking.
+const maxReceivePackCommandsSize = 1024 * 1024
+
+type refUpdate struct {
+	OldSha string `json:"old_sha"`
+	NewSha string `json:"new_sha"`
+	Ref    string `json:"ref"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// receivePackRequest collects the ref update commands, capabilities and
+// push options at the start of a git-receive-pack request body as it is
+// written to it. Everything after that is the pack.
+type receivePackRequest struct {
+	pktLineParser
+	Commands     []*refUpdate
+	PushOptions  []string
+	SideBand     bool
+	ReportStatus bool
+	Truncated    bool
+
+	flushes     int
+	pushOptions bool
+	size        int
+}
+
+func newReceivePackRequest() *receivePackRequest {
+	q := &receivePackRequest{Commands: []*refUpdate{}}
+	q.handle = q.handleCommand
+	return q
+}
+
+// Parsed reports whether we have seen all we are going to see of the
+// commands.
+func (q *receivePackRequest) Parsed() bool {
+	return q.done
+}
+
+func (q *receivePackRequest) handleCommand(line []byte) bool {
+	q.size += len(line) + 4
+	if q.size > maxReceivePackCommandsSize {
+		q.Truncated = true
+		return false
+	}
+
+	if line == nil {
+		q.flushes++
+		// The command list ends with a flush, and so do the push options
+		return q.pushOptions && q.flushes < 2
+	}
+
+	if q.flushes > 0 {
+		q.PushOptions = append(q.PushOptions, string(bytes.TrimSuffix(line, []byte("\n"))))
+		return true
+	}
+
+	command := line
+	if i := bytes.IndexByte(line, 0); i >= 0 {
+		command = line[:i]
+		for _, capability := range strings.Fields(string(line[i+1:])) {
+			switch capability {
+			case "side-band", "side-band-64k":
+				q.SideBand = true
+			case "report-status":
+				q.ReportStatus = true
+			case "push-options":
+				q.pushOptions = true
+			}
+		}
+	}
+
+	fields := strings.Fields(string(command))
+	if len(fields) != 3 {
+		// E.g. 'shallow' lines or a push certificate
+		return true
+	}
+
+	q.Commands = append(q.Commands, &refUpdate{OldSha: fields[0], NewSha: fields[1], Ref: fields[2], Status: "unknown"})
+	return true
+}
+
 // Will not return a non-nil error after the response body has been
 // written to.
-func handleReceivePack(w *GitHttpResponseWriter, r *http.Request, a *api.Response) error {
+func handleReceivePack(w *GitHttpResponseWriter, r *http.Request, a *api.Response, maxPushSize int64) error {
 	action := getService(r)
 	writePostRPCHeader(w, action)
 
-	cr, cw := helper.NewWriteAfterReader(r.Body, w)
-	defer cw.Flush()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
 
+	var body io.Reader = r.Body
+	var out io.Writer = w
 	var err error
+	limit := pushSizeLimit(a, maxPushSize)
+
+	var request *receivePackRequest
+	if audit.Enabled() || limit > 0 {
+		request = newReceivePackRequest()
+		body = io.TeeReader(body, request)
+	}
+
+	if audit.Enabled() {
+		pa := newPushAudit(r, a, request)
+		out = io.MultiWriter(w, pa.response)
+		defer func() { pa.Log(w, err) }()
+	}
+
+	var limiter *pushSizeLimiter
+	if limit > 0 {
+		limiter = newPushSizeLimiter(body, out, request, limit, r.ContentLength, cancel)
+		body = limiter
+		out = limiter.Output()
+	}
+
+	cr, cw := helper.NewWriteAfterReader(body, out)
+	defer cw.Flush()
+
 	if a.GitalyServer.Address == "" {
 		err = handleReceivePackLocally(a, r, cr, cw, action)
 	} else {
-		err = handleReceivePackWithGitaly(r.Context(), a, cr, cw)
+		err = handleReceivePackWithGitaly(ctx, a, cr, cw)
+	}
+
+	if limiter != nil && limiter.Exceeded() {
+		// Whatever went wrong further down was caused by cutting off the push
+		err = limiter.Reject(r)
 	}
 
 	return err
 }
 
 func handleReceivePackLocally(a *api.Response, r *http.Request, stdin io.Reader, stdout io.Writer, action string) error {
-	cmd, err := startGitCommand(a, stdin, stdout, action)
+	cmd, err := startGitCommand(a, stdin, stdout, action, "")
 	if err != nil {
 		return fmt.Errorf("startGitCommand: %v", err)
 	}
@@ -0,0 +1,128 @@
+/*
+In this file we handle recursive repository tree listings
+*/
+
+package git
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+)
+
+type tree struct{ senddata.Prefix }
+type treeParams struct {
+	GitalyServer          gitaly.Server
+	GetTreeEntriesRequest pb.GetTreeEntriesRequest
+}
+
+// treeEntry is what the repository tree API returns for an entry
+type treeEntry struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+}
+
+var SendTree = &tree{"git-tree:"}
+
+// treeWalkLimits keep a listing of a huge tree from keeping Gitaly and
+// us busy for long. Both SendTree and SendBlobs walk trees.
+var treeWalkLimits = gitaly.TreeWalkLimits{MaxCalls: 10000, MaxEntries: 200000}
+
+var treeEntryTypes = map[pb.TreeEntry_EntryType]string{
+	pb.TreeEntry_BLOB:   "blob",
+	pb.TreeEntry_TREE:   "tree",
+	pb.TreeEntry_COMMIT: "commit",
+}
+
+func (t *tree) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params treeParams
+	if err := t.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendTree: unpack sendData: %v", err))
+		return
+	}
+
+	request := &params.GetTreeEntriesRequest
+	log.Printf("SendTree: sending tree %q at %q for %q", request.GetPath(), request.GetRevision(), r.URL.Path)
+
+	commitClient, err := gitaly.NewCommitClient(params.GitalyServer)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("commit.GetTreeEntries: %v", err))
+		return
+	}
+
+	// The listing is newline-delimited JSON, one entry per line. We only
+	// send the headers with the first entry, so that errors at the start
+	// still get a 500.
+	bufWriter := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bufWriter)
+	started := false
+
+	err = commitClient.WalkTree(r.Context(), request, treeWalkLimits, func(entry *pb.TreeEntry) error {
+		if !started {
+			setTreeHeaders(w)
+			w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
+			started = true
+		}
+		if err := encoder.Encode(newTreeEntry(entry)); err != nil {
+			return &copyError{fmt.Errorf("SendTree: copy tree entries: %v", err)}
+		}
+		return nil
+	})
+	if err == nil && started {
+		if flushErr := bufWriter.Flush(); flushErr != nil {
+			err = &copyError{fmt.Errorf("SendTree: copy tree entries: %v", flushErr)}
+		}
+	}
+
+	if !started {
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("commit.GetTreeEntries: %v", err))
+			return
+		}
+		// An empty tree
+		setTreeHeaders(w)
+		w.WriteHeader(200)
+		return
+	}
+
+	if err == gitaly.ErrTreeTooLarge {
+		// The client already has part of the listing. Break the
+		// connection so that it cannot mistake it for the whole tree.
+		helper.LogError(r, fmt.Errorf("SendTree: %v", err))
+		panic(http.ErrAbortHandler)
+	}
+
+	if _, ok := err.(*copyError); ok {
+		helper.LogError(r, err)
+	} else if err != nil {
+		helper.LogError(r, fmt.Errorf("commit.GetTreeEntries: %v", err))
+	}
+}
+
+func setTreeHeaders(w http.ResponseWriter) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+}
+
+func newTreeEntry(entry *pb.TreeEntry) *treeEntry {
+	entryPath := string(entry.GetPath())
+	return &treeEntry{
+		Id:   entry.GetOid(),
+		Name: path.Base(entryPath),
+		Type: treeEntryTypes[entry.GetType()],
+		Path: entryPath,
+		Mode: fmt.Sprintf("%06o", entry.GetMode()),
+	}
+}
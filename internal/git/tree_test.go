@@ -0,0 +1,130 @@
+package git
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var testGitalyRepository = pb.Repository{StorageName: "default", RelativePath: "foo/bar.git"}
+
+// startCommitServer serves the CommitService mocks of testhelper
+func startCommitServer(t *testing.T) (gitaly.Server, func()) {
+	dir, err := ioutil.TempDir("", "gitaly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketPath := filepath.Join(dir, "gitaly.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	pb.RegisterCommitServiceServer(server, testhelper.NewGitalyServer(codes.OK))
+	go server.Serve(listener)
+
+	return gitaly.Server{Address: "unix://" + socketPath}, func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func testInject(t *testing.T, injecter senddata.Injecter, params interface{}) *httptest.ResponseRecorder {
+	jsonParams, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendData := injecter.Name() + ":" + base64.URLEncoding.EncodeToString(jsonParams)
+
+	w := httptest.NewRecorder()
+	injecter.Inject(w, httptest.NewRequest("GET", "/something", nil), sendData)
+	return w
+}
+
+func TestSendTree(t *testing.T) {
+	gitalyServer, stop := startCommitServer(t)
+	defer stop()
+
+	w := testInject(t, SendTree, treeParams{
+		GitalyServer: gitalyServer,
+		GetTreeEntriesRequest: pb.GetTreeEntriesRequest{
+			Repository: &testGitalyRepository,
+			Revision:   []byte("master"),
+			Path:       []byte("doc"),
+		},
+	})
+
+	if w.Code != 200 {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Type", "application/x-ndjson")
+
+	expected := []treeEntry{
+		{Name: "api", Type: "tree", Path: "doc/api", Mode: "040000"},
+		{Name: "tree.md", Type: "blob", Path: "doc/api/tree.md", Mode: "100644"},
+		{Name: "index.md", Type: "blob", Path: "doc/index.md", Mode: "100644"},
+	}
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d entries, got %q", len(expected), w.Body.String())
+	}
+	for i, line := range lines {
+		var entry treeEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Id == "" {
+			t.Errorf("%s: expected an id", entry.Path)
+		}
+		entry.Id = ""
+		if entry != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], entry)
+		}
+	}
+}
+
+func TestSendTreeTooLarge(t *testing.T) {
+	gitalyServer, stop := startCommitServer(t)
+	defer stop()
+
+	defer func(limits gitaly.TreeWalkLimits) { treeWalkLimits = limits }(treeWalkLimits)
+	params := treeParams{
+		GitalyServer: gitalyServer,
+		GetTreeEntriesRequest: pb.GetTreeEntriesRequest{
+			Repository: &testGitalyRepository,
+			Revision:   []byte("master"),
+		},
+	}
+
+	// The top-level directory alone is too large: nothing has been sent
+	treeWalkLimits = gitaly.TreeWalkLimits{MaxCalls: 10, MaxEntries: 1}
+	if w := testInject(t, SendTree, params); w.Code != 500 {
+		t.Fatalf("expected status 500, got %d", w.Code)
+	}
+
+	// "doc" is one directory too many, after "README.md" has been sent
+	treeWalkLimits = gitaly.TreeWalkLimits{MaxCalls: 1, MaxEntries: 10}
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("expected panic with %v, got %v", http.ErrAbortHandler, p)
+		}
+	}()
+	testInject(t, SendTree, params)
+}
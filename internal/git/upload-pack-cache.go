@@ -0,0 +1,384 @@
+/*
+In this file we cache the responses to identical 'git fetch' requests
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	DefaultUploadPackCacheMaxSize = 1024 * 1024 * 1024
+	DefaultUploadPackCacheTTL     = 5 * time.Minute
+
+	uploadPackCacheFilePrefix = "upload-pack-"
+)
+
+var (
+	uploadPackCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_upload_pack_cache",
+			Help: "How many cacheable git-upload-pack requests have been handled, partitioned by result (hit, miss, coalesced).",
+		},
+		[]string{"result"},
+	)
+	uploadPackCacheBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_upload_pack_cache_bytes",
+			Help: "How many bytes of git-upload-pack responses have been written, partitioned by result (hit, miss).",
+		},
+		[]string{"result"},
+	)
+	uploadPackCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_git_upload_pack_cache_size_bytes",
+			Help: "Total size of the cached git-upload-pack responses on disk.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadPackCacheRequests)
+	prometheus.MustRegister(uploadPackCacheBytes)
+	prometheus.MustRegister(uploadPackCacheSize)
+}
+
+type uploadPackCacheEntry struct {
+	path     string
+	size     int64
+	created  time.Time
+	lastUsed time.Time
+}
+
+// UploadPackCache keeps git-upload-pack responses for clones on disk so
+// that identical requests, typically from CI, are served without asking
+// Gitaly to build the same pack again. The least recently used responses
+// are evicted when the cache grows beyond its maximum size.
+type UploadPackCache struct {
+	sync.Mutex
+	dir       string
+	maxSize   int64
+	ttl       time.Duration
+	totalSize int64
+	entries   map[string]*uploadPackCacheEntry
+	inflight  map[string]*generation
+}
+
+// NewUploadPackCache returns nil if cfg does not configure a cache
+// directory.
+func NewUploadPackCache(cfg *config.UploadPackCacheConfig) (*UploadPackCache, error) {
+	if cfg == nil || cfg.Dir == "" {
+		return nil, nil
+	}
+
+	c := &UploadPackCache{
+		dir:      cfg.Dir,
+		maxSize:  cfg.MaxSize,
+		ttl:      DefaultUploadPackCacheTTL,
+		entries:  make(map[string]*uploadPackCacheEntry),
+		inflight: make(map[string]*generation),
+	}
+	if c.maxSize <= 0 {
+		c.maxSize = DefaultUploadPackCacheMaxSize
+	}
+	if cfg.TTL != nil {
+		if cfg.TTL.Duration <= 0 {
+			return nil, fmt.Errorf("NewUploadPackCache: TTL must be positive, got %v", cfg.TTL.Duration)
+		}
+		c.ttl = cfg.TTL.Duration
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, fmt.Errorf("NewUploadPackCache: %v", err)
+	}
+
+	// We do not know anything about responses left over from a previous run
+	leftovers, err := filepath.Glob(filepath.Join(c.dir, uploadPackCacheFilePrefix+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("NewUploadPackCache: %v", err)
+	}
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+
+	return c, nil
+}
+
+// serve writes the response for key to w, from the cache if possible.
+// Otherwise produce is called to write the response to a spool file that
+// w, and any concurrent calls for the same key, read as it grows.
+// produce runs on a context of its own that is only cancelled once every
+// one of those readers has gone away, so a client that disconnects does
+// not cut the response short for the others. ctx is only used when the
+// response cannot be shared.
+func (c *UploadPackCache) serve(ctx context.Context, key string, w io.Writer, produce func(context.Context, io.Writer) error) error {
+	for {
+		c.Lock()
+		if cached := c.open(key); cached != nil {
+			c.Unlock()
+			defer cached.Close()
+
+			uploadPackCacheRequests.WithLabelValues("hit").Inc()
+			n, err := io.Copy(w, cached)
+			uploadPackCacheBytes.WithLabelValues("hit").Add(float64(n))
+			return err
+		}
+
+		if gen := c.inflight[key]; gen != nil {
+			follower, err := joinGeneration(gen)
+			if err != nil {
+				c.Unlock()
+				log.Printf("UploadPackCache: open spool file: %v", err)
+				return produce(ctx, w)
+			}
+
+			// An abandoned generation is on its way out, start a new one
+			if follower != nil {
+				c.Unlock()
+
+				uploadPackCacheRequests.WithLabelValues("coalesced").Inc()
+				retry, err := c.follow(follower, w)
+				if retry {
+					// The first of the followers to get here takes over
+					continue
+				}
+				return err
+			}
+		}
+
+		tempFile, err := ioutil.TempFile(c.dir, uploadPackCacheFilePrefix)
+		if err != nil {
+			c.Unlock()
+			log.Printf("UploadPackCache: create tempfile: %v", err)
+			return produce(ctx, w)
+		}
+		file, err := os.Open(tempFile.Name())
+		if err != nil {
+			c.Unlock()
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+			log.Printf("UploadPackCache: open spool file: %v", err)
+			return produce(ctx, w)
+		}
+		genCtx, cancel := context.WithCancel(context.Background())
+		gen := newGeneration(tempFile.Name(), cancel)
+		gen.readers = 1
+		c.inflight[key] = gen
+		c.Unlock()
+
+		uploadPackCacheRequests.WithLabelValues("miss").Inc()
+		follower := &generationFollower{ctx: context.Background(), gen: gen, file: file}
+		return c.fill(genCtx, key, gen, tempFile, follower, w, produce)
+	}
+}
+
+// joinGeneration adds a reader to gen. It returns nil if all the readers
+// of gen have already gone away. The spool file is only removed after the
+// generation has left inflight, so it must be called with the cache
+// locked.
+func joinGeneration(gen *generation) (*generationFollower, error) {
+	generationsMutex.Lock()
+	defer generationsMutex.Unlock()
+
+	if gen.abandoned {
+		return nil, nil
+	}
+
+	file, err := os.Open(gen.tempPath)
+	if err != nil {
+		return nil, err
+	}
+	gen.readers++
+
+	return &generationFollower{ctx: context.Background(), gen: gen, file: file}, nil
+}
+
+// follow copies a response that another request is producing to w. It
+// reports whether that request failed before producing anything, in
+// which case the caller should try again.
+func (c *UploadPackCache) follow(follower *generationFollower, w io.Writer) (bool, error) {
+	defer follower.Close()
+
+	if err := follower.ready(); err != nil {
+		return true, nil
+	}
+
+	n, err := io.Copy(w, follower)
+	uploadPackCacheBytes.WithLabelValues("hit").Add(float64(n))
+	return false, err
+}
+
+// fill runs produce in the background so that a slow client does not
+// hold up the requests that follow the same response. The client reads
+// the spool file through follower, like the other requests do.
+func (c *UploadPackCache) fill(ctx context.Context, key string, gen *generation, tempFile *os.File, follower *generationFollower, w io.Writer, produce func(context.Context, io.Writer) error) error {
+	produced := make(chan error, 1)
+	go func() {
+		err := produce(ctx, &generationWriter{gen: gen, file: tempFile})
+		c.finishFill(key, gen, tempFile, err)
+		produced <- err
+	}()
+
+	_, copyErr := io.Copy(w, follower)
+	follower.Close()
+
+	// produce may write progress messages to w, so we must not return
+	// before it does
+	if err := <-produced; err != nil {
+		return err
+	}
+	return copyErr
+}
+
+func (c *UploadPackCache) finishFill(key string, gen *generation, tempFile *os.File, err error) {
+	tempFile.Close()
+
+	gen.Lock()
+	size := gen.written
+	gen.Unlock()
+
+	c.Lock()
+	if c.inflight[key] == gen {
+		delete(c.inflight, key)
+	}
+	if err == nil && size <= c.maxSize {
+		c.add(key, tempFile.Name(), size)
+	} else {
+		os.Remove(tempFile.Name())
+	}
+	c.Unlock()
+
+	if err == nil {
+		uploadPackCacheBytes.WithLabelValues("miss").Add(float64(size))
+	}
+	gen.finish(err)
+}
+
+// open must be called with the lock held.
+func (c *UploadPackCache) open(key string) *os.File {
+	entry := c.entries[key]
+	if entry == nil {
+		return nil
+	}
+
+	if time.Since(entry.created) > c.ttl {
+		c.remove(key)
+		return nil
+	}
+
+	// Once open, the file stays readable even if it gets evicted
+	cached, err := os.Open(entry.path)
+	if err != nil {
+		c.remove(key)
+		return nil
+	}
+
+	entry.lastUsed = time.Now()
+	return cached
+}
+
+// add must be called with the lock held.
+func (c *UploadPackCache) add(key string, path string, size int64) {
+	if c.entries[key] != nil {
+		c.remove(key)
+	}
+
+	now := time.Now()
+	c.entries[key] = &uploadPackCacheEntry{path: path, size: size, created: now, lastUsed: now}
+	c.totalSize += size
+
+	for c.totalSize > c.maxSize {
+		var oldestKey string
+		var oldest *uploadPackCacheEntry
+		for k, entry := range c.entries {
+			if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = k, entry
+			}
+		}
+		c.remove(oldestKey)
+	}
+
+	uploadPackCacheSize.Set(float64(c.totalSize))
+}
+
+// remove must be called with the lock held.
+func (c *UploadPackCache) remove(key string) {
+	entry := c.entries[key]
+	if entry == nil {
+		return
+	}
+
+	os.Remove(entry.path)
+	delete(c.entries, key)
+	c.totalSize -= entry.size
+	uploadPackCacheSize.Set(float64(c.totalSize))
+}
+
+// uploadPackCacheKey returns a key for requests whose response only
+// depends on the repository and the request body: protocol v0 requests
+// without 'have' lines. Cosmetic differences such as the order of the
+// 'want' lines and the client agent are normalized away.
+func uploadPackCacheKey(a *api.Response, body io.Reader) (string, bool) {
+	var wants, capabilities, rest []string
+
+	scanner := bufio.NewScanner(body)
+	scanner.Split(pktLineSplitter)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\n")
+
+		switch {
+		case strings.HasPrefix(line, "have "):
+			return "", false
+		case strings.HasPrefix(line, "want "):
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return "", false
+			}
+			wants = append(wants, fields[1])
+			for _, capability := range fields[2:] {
+				if !strings.HasPrefix(capability, "agent=") {
+					capabilities = append(capabilities, capability)
+				}
+			}
+		case line == "":
+			rest = append(rest, "flush")
+		default:
+			rest = append(rest, line)
+		}
+	}
+	if scanner.Err() != nil || len(wants) == 0 {
+		return "", false
+	}
+
+	sort.Strings(wants)
+	sort.Strings(capabilities)
+
+	var normalized bytes.Buffer
+	fmt.Fprintf(&normalized, "%s\x00%s\x00%s\x00%s\x00", a.GitalyServer.Address, a.Repository.StorageName, a.Repository.RelativePath, a.RepoPath)
+	fmt.Fprintf(&normalized, "want %s\x00", strings.Join(wants, " "))
+	fmt.Fprintf(&normalized, "capabilities %s\x00", strings.Join(capabilities, " "))
+	normalized.WriteString(strings.Join(rest, "\x00"))
+
+	sum := sha256.Sum256(normalized.Bytes())
+	return hex.EncodeToString(sum[:]), true
+}
@@ -0,0 +1,402 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func pktLines(lines ...string) string {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if line == "" {
+			pktFlush(&buf)
+			continue
+		}
+		pktLine(&buf, line+"\n")
+	}
+	return buf.String()
+}
+
+var (
+	wantA = "want " + strings.Repeat("a", 40)
+	wantB = "want " + strings.Repeat("b", 40)
+)
+
+func TestUploadPackCacheKey(t *testing.T) {
+	a := &api.Response{RepoPath: "/repos/project.git"}
+
+	key, ok := uploadPackCacheKey(a, strings.NewReader(pktLines(wantA+" side-band-64k ofs-delta agent=git/2.18.0", wantB, "deepen 1", "", "done")))
+	if !ok {
+		t.Fatal("expected clone request to be cacheable")
+	}
+
+	sameKey, _ := uploadPackCacheKey(a, strings.NewReader(pktLines(wantB+" ofs-delta side-band-64k agent=git/2.20.1", wantA, "deepen 1", "", "done")))
+	if key != sameKey {
+		t.Error("expected want order, capability order and agent to be ignored")
+	}
+
+	otherDepth, _ := uploadPackCacheKey(a, strings.NewReader(pktLines(wantA+" side-band-64k ofs-delta", wantB, "deepen 2", "", "done")))
+	if key == otherDepth {
+		t.Error("expected depth to be part of the key")
+	}
+
+	otherRepo, _ := uploadPackCacheKey(&api.Response{RepoPath: "/repos/other.git"}, strings.NewReader(pktLines(wantA+" side-band-64k ofs-delta", wantB, "deepen 1", "", "done")))
+	if key == otherRepo {
+		t.Error("expected repository to be part of the key")
+	}
+
+	if _, ok := uploadPackCacheKey(a, strings.NewReader(pktLines(wantA, "", "have "+strings.Repeat("c", 40), "done"))); ok {
+		t.Error("expected request with haves not to be cacheable")
+	}
+}
+
+func newTestUploadPackCache(t *testing.T, maxSize int64, ttl time.Duration) (*UploadPackCache, func()) {
+	dir, err := ioutil.TempDir("", "upload-pack-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewUploadPackCache(&config.UploadPackCacheConfig{Dir: dir, MaxSize: maxSize, TTL: &config.TomlDuration{Duration: ttl}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cache, func() { os.RemoveAll(dir) }
+}
+
+func TestUploadPackCacheServe(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024, time.Minute)
+	defer cleanup()
+
+	var calls int32
+	produce := func(ctx context.Context, w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		_, err := fmt.Fprint(w, "pack data")
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		var out bytes.Buffer
+		if err := cache.serve(context.Background(), "key", &out, produce); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != "pack data" {
+			t.Fatalf("expected %q, got %q", "pack data", out.String())
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("expected one call to produce, got %d", calls)
+	}
+}
+
+func TestUploadPackCacheCoalescing(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024, time.Minute)
+	defer cleanup()
+
+	var calls int32
+	release := make(chan struct{})
+	produce := func(ctx context.Context, w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		_, err := fmt.Fprint(w, "pack data")
+		return err
+	}
+
+	var wg sync.WaitGroup
+	outputs := make([]bytes.Buffer, 10)
+	for i := range outputs {
+		wg.Add(1)
+		go func(out *bytes.Buffer) {
+			defer wg.Done()
+			if err := cache.serve(context.Background(), "key", out, produce); err != nil {
+				t.Error(err)
+			}
+		}(&outputs[i])
+	}
+
+	waitForReaders(t, cache, "key", len(outputs))
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected one call to produce, got %d", calls)
+	}
+	for _, out := range outputs {
+		if out.String() != "pack data" {
+			t.Fatalf("expected %q, got %q", "pack data", out.String())
+		}
+	}
+}
+
+func TestUploadPackCacheSlowClient(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024, time.Minute)
+	defer cleanup()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	produce := func(ctx context.Context, w io.Writer) error {
+		close(started)
+		<-release
+		_, err := fmt.Fprint(w, "pack data")
+		return err
+	}
+
+	slow := &blockingWriter{unblock: make(chan struct{})}
+	leaderDone := make(chan error)
+	go func() { leaderDone <- cache.serve(context.Background(), "key", slow, produce) }()
+	<-started
+
+	var wg sync.WaitGroup
+	outputs := make([]bytes.Buffer, 3)
+	for i := range outputs {
+		wg.Add(1)
+		go func(out *bytes.Buffer) {
+			defer wg.Done()
+			if err := cache.serve(context.Background(), "key", out, produce); err != nil {
+				t.Error(err)
+			}
+		}(&outputs[i])
+	}
+
+	waitForReaders(t, cache, "key", len(outputs)+1)
+	close(release)
+
+	// The followers finish while the first client is still blocked
+	wg.Wait()
+	for _, out := range outputs {
+		if out.String() != "pack data" {
+			t.Fatalf("expected %q, got %q", "pack data", out.String())
+		}
+	}
+
+	close(slow.unblock)
+	if err := <-leaderDone; err != nil {
+		t.Fatal(err)
+	}
+	if slow.String() != "pack data" {
+		t.Fatalf("expected %q, got %q", "pack data", slow.String())
+	}
+}
+
+func TestUploadPackCacheLeaderFailure(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024, time.Minute)
+	defer cleanup()
+
+	var calls int32
+	release := make(chan struct{})
+	produce := func(ctx context.Context, w io.Writer) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+			return fmt.Errorf("gitaly is gone")
+		}
+		_, err := fmt.Fprint(w, "pack data")
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var failures int32
+	outputs := make([]bytes.Buffer, 10)
+	for i := range outputs {
+		wg.Add(1)
+		go func(out *bytes.Buffer) {
+			defer wg.Done()
+			if err := cache.serve(context.Background(), "key", out, produce); err != nil {
+				atomic.AddInt32(&failures, 1)
+				return
+			}
+			if out.String() != "pack data" {
+				t.Errorf("expected %q, got %q", "pack data", out.String())
+			}
+		}(&outputs[i])
+	}
+
+	waitForReaders(t, cache, "key", len(outputs))
+	close(release)
+	wg.Wait()
+
+	if failures != 1 {
+		t.Errorf("expected only the first request to fail, got %d failures", failures)
+	}
+	if calls != 2 {
+		t.Fatalf("expected one new request to take over, got %d calls to produce", calls)
+	}
+}
+
+func TestUploadPackCacheLeaderDisconnects(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024, time.Minute)
+	defer cleanup()
+
+	release := make(chan struct{})
+	produce := func(ctx context.Context, w io.Writer) error {
+		<-release
+		if _, err := fmt.Fprint(w, "pack "); err != nil {
+			return err
+		}
+		// Give the first client time to go away
+		time.Sleep(10 * time.Millisecond)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprint(w, "data")
+		return err
+	}
+
+	leaderDone := make(chan error)
+	go func() { leaderDone <- cache.serve(context.Background(), "key", failingWriter{}, produce) }()
+	waitForReaders(t, cache, "key", 1)
+
+	followerDone := make(chan error)
+	var out bytes.Buffer
+	go func() { followerDone <- cache.serve(context.Background(), "key", &out, produce) }()
+	waitForReaders(t, cache, "key", 2)
+	close(release)
+
+	if err := <-followerDone; err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "pack data" {
+		t.Fatalf("expected %q, got %q", "pack data", out.String())
+	}
+	if err := <-leaderDone; err == nil {
+		t.Fatal("expected the disconnected client to get an error")
+	}
+}
+
+func TestUploadPackCacheAllClientsDisconnect(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024, time.Minute)
+	defer cleanup()
+
+	cancelled := make(chan struct{})
+	produce := func(ctx context.Context, w io.Writer) error {
+		if _, err := fmt.Fprint(w, "pack "); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			close(cancelled)
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("expected produce to be cancelled")
+		}
+	}
+
+	if err := cache.serve(context.Background(), "key", failingWriter{}, produce); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	<-cancelled
+
+	if cache.entries["key"] != nil {
+		t.Fatal("expected cancelled response not to be cached")
+	}
+}
+
+func TestUploadPackCacheZeroTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-pack-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewUploadPackCache(&config.UploadPackCacheConfig{Dir: dir, TTL: &config.TomlDuration{}}); err == nil {
+		t.Fatal("expected TTL 0 to be rejected")
+	}
+}
+
+func TestUploadPackCacheEviction(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 20, time.Minute)
+	defer cleanup()
+
+	produce := func(ctx context.Context, w io.Writer) error {
+		_, err := fmt.Fprint(w, "0123456789")
+		return err
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.serve(context.Background(), key, ioutil.Discard, produce); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cache.entries["a"] != nil {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if cache.entries["b"] == nil || cache.entries["c"] == nil {
+		t.Error("expected recent entries to be kept")
+	}
+	if cache.totalSize != 20 {
+		t.Errorf("expected total size 20, got %d", cache.totalSize)
+	}
+}
+
+func TestUploadPackCacheTTL(t *testing.T) {
+	cache, cleanup := newTestUploadPackCache(t, 1024, 10*time.Millisecond)
+	defer cleanup()
+
+	var calls int32
+	produce := func(ctx context.Context, w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		_, err := fmt.Fprint(w, "pack data")
+		return err
+	}
+
+	cache.serve(context.Background(), "key", ioutil.Discard, produce)
+	time.Sleep(20 * time.Millisecond)
+	cache.serve(context.Background(), "key", ioutil.Discard, produce)
+
+	if calls != 2 {
+		t.Fatalf("expected expired entry to be produced again, got %d calls", calls)
+	}
+}
+
+// waitForReaders waits until n requests read the response for key that
+// is being produced.
+func waitForReaders(t *testing.T, cache *UploadPackCache, key string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		readers := 0
+		cache.Lock()
+		if gen := cache.inflight[key]; gen != nil {
+			generationsMutex.Lock()
+			readers = gen.readers
+			generationsMutex.Unlock()
+		}
+		cache.Unlock()
+
+		if readers == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d readers, got %d", n, readers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type blockingWriter struct {
+	bytes.Buffer
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.Buffer.Write(p)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("client went away")
+}
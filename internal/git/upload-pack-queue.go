@@ -0,0 +1,144 @@
+/*
+In this file we keep 'git clone' users informed while their request waits
+for a free slot
+*/
+
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+)
+
+const uploadPackQueueProgressInterval = 5 * time.Second
+
+const (
+	sideBandProgress = 2
+	sideBandError    = 3
+)
+
+// earlyResponseHeader returns the pkt-line git-upload-pack will start its
+// response with, if we can send it ahead of time so that we can send
+// progress messages while the request is queued. That is the case for
+// protocol v0 clones that negotiated side-band: git-upload-pack answers
+// with a single NAK and then multiplexes everything else.
+func earlyResponseHeader(stats *uploadPackStats, gitProtocol string) []byte {
+	if gitProtocol != "" || stats.Command != "" {
+		return nil
+	}
+
+	// For deepen requests, and for clients that are shallow already,
+	// git-upload-pack first sends the shallow/unshallow lines of the new
+	// boundary. We cannot know them without asking Gitaly.
+	if stats.Wants == 0 || stats.Haves > 0 || !stats.Done || stats.isShallow() || stats.Shallows > 0 {
+		return nil
+	}
+
+	if !stats.hasCapability("side-band-64k") && !stats.hasCapability("side-band") {
+		return nil
+	}
+	if stats.hasCapability("no-progress") {
+		return nil
+	}
+
+	var header bytes.Buffer
+	pktLine(&header, "NAK\n")
+	return header.Bytes()
+}
+
+// uploadPackClient is where the git-upload-pack response goes. If we had
+// to start the response before the request left the queue, it strips the
+// header we already sent from the response.
+type uploadPackClient struct {
+	w       *GitHttpResponseWriter
+	header  []byte
+	started bool
+	pending []byte
+	spliced bool
+}
+
+func newUploadPackClient(w *GitHttpResponseWriter, header []byte) *uploadPackClient {
+	return &uploadPackClient{w: w, header: header}
+}
+
+func (c *uploadPackClient) Write(p []byte) (int, error) {
+	if !c.started || c.spliced {
+		return c.w.Write(p)
+	}
+
+	c.pending = append(c.pending, p...)
+	if len(c.pending) < len(c.header) && bytes.HasPrefix(c.header, c.pending) {
+		return len(p), nil
+	}
+
+	// Should not happen, but if the response does not start the way we
+	// promised there is nothing better to do than to pass it on.
+	pending := bytes.TrimPrefix(c.pending, c.header)
+	c.pending = nil
+	c.spliced = true
+
+	if _, err := c.w.Write(pending); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// waitForSlot takes a slot from queue. Until it gets one, it sends
+// progress messages to the client if the response can be started early.
+func (c *uploadPackClient) waitForSlot(queue *queueing.Queue) error {
+	if c.header == nil {
+		return queue.Acquire()
+	}
+
+	err := queue.AcquireWithProgress(uploadPackQueueProgressInterval, func(position int) {
+		c.start()
+		c.progress(fmt.Sprintf("waiting for a free slot (position %d)...\r", position))
+	})
+	if err == nil && c.started {
+		c.progress("waiting for a free slot, done.\n")
+	}
+
+	return err
+}
+
+func (c *uploadPackClient) start() {
+	if c.started {
+		return
+	}
+
+	c.w.Write(c.header)
+	c.started = true
+}
+
+func (c *uploadPackClient) progress(message string) {
+	c.sideBand(sideBandProgress, message)
+	c.w.Flush()
+}
+
+func (c *uploadPackClient) sideBand(band byte, message string) {
+	pktLine(c.w, string([]byte{band})+message)
+}
+
+// rejectQueued tells the client that its request did not get a slot.
+// Once the response has started, the only way to do so is an error on
+// the side-band.
+func (c *uploadPackClient) rejectQueued(r *http.Request, err error) {
+	helper.LogError(r, fmt.Errorf("handleUploadPack: %v", err))
+
+	if c.started {
+		c.sideBand(sideBandError, "the server is busy, please try again later\n")
+		pktFlush(c.w)
+		return
+	}
+
+	if err == queueing.ErrTooManyRequests {
+		http.Error(c.w, "Too Many Requests", http.StatusTooManyRequests)
+	} else {
+		http.Error(c.w, "Service Unavailable", http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,161 @@
+package git
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+)
+
+func TestEarlyResponseHeader(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		body        string
+		gitProtocol string
+		early       bool
+	}{
+		{
+			desc:  "clone with side-band",
+			body:  pktLines(wantA+" multi_ack_detailed side-band-64k ofs-delta", wantB, "", "done"),
+			early: true,
+		},
+		{
+			desc: "clone without side-band",
+			body: pktLines(wantA+" multi_ack_detailed ofs-delta", "", "done"),
+		},
+		{
+			desc: "quiet clone",
+			body: pktLines(wantA+" side-band-64k no-progress", "", "done"),
+		},
+		{
+			desc: "fetch",
+			body: pktLines(wantA+" side-band-64k", "", "have "+strings.Repeat("c", 40), "done"),
+		},
+		{
+			desc: "shallow clone",
+			body: pktLines(wantA+" side-band-64k", "deepen 1", "", "done"),
+		},
+		{
+			desc: "shallow since",
+			body: pktLines(wantA+" side-band-64k", "deepen-since 1500000000", "", "done"),
+		},
+		{
+			desc: "deepen a shallow repository",
+			body: pktLines(wantA+" side-band-64k", "shallow "+strings.Repeat("c", 40), "deepen 2147483647", "", "done"),
+		},
+		{
+			desc: "negotiation not done",
+			body: pktLines(wantA+" side-band-64k", ""),
+		},
+		{
+			desc:        "protocol v2",
+			body:        pktLines("command=fetch", "") + "0001" + pktLines(wantA, "done", ""),
+			gitProtocol: "version=2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			stats, err := parseUploadPackRequest(strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := earlyResponseHeader(stats, tc.gitProtocol)
+			if tc.early && string(header) != "0008NAK\n" {
+				t.Fatalf("expected NAK header, got %q", header)
+			}
+			if !tc.early && header != nil {
+				t.Fatalf("expected no header, got %q", header)
+			}
+		})
+	}
+}
+
+func TestUploadPackClientSplicesResponse(t *testing.T) {
+	rr := httptest.NewRecorder()
+	c := newUploadPackClient(NewGitHttpResponseWriter(rr), []byte("0008NAK\n"))
+	c.start()
+	c.progress("waiting\r")
+
+	response := "0008NAK\n" + sideBand(1, "PACK")
+	for _, b := range []byte(response) {
+		c.Write([]byte{b})
+	}
+
+	expected := "0008NAK\n" + sideBand(2, "waiting\r") + sideBand(1, "PACK")
+	if rr.Body.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, rr.Body.String())
+	}
+}
+
+func TestUploadPackClientPassesUnexpectedResponse(t *testing.T) {
+	rr := httptest.NewRecorder()
+	c := newUploadPackClient(NewGitHttpResponseWriter(rr), []byte("0008NAK\n"))
+	c.start()
+	c.Write([]byte("0008ACK"))
+	c.Write([]byte(" and more"))
+
+	expected := "0008NAK\n0008ACK and more"
+	if rr.Body.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, rr.Body.String())
+	}
+}
+
+func testQueuedUploadPack(t *testing.T, queue *queueing.Queue, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/gitlab/gitlab-ce.git/git-upload-pack", bytes.NewReader([]byte(body)))
+	rr := httptest.NewRecorder()
+	if err := handleUploadPack(NewGitHttpResponseWriter(rr), req, &api.Response{}, nil, queue); err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestHandleUploadPackQueueTimeout(t *testing.T) {
+	queue := queueing.NewQueue("test_upload_pack_timeout", 1, 1, 10*time.Millisecond)
+	if err := queue.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Release()
+
+	t.Run("progress", func(t *testing.T) {
+		rr := testQueuedUploadPack(t, queue, pktLines(wantA+" side-band-64k", "", "done"))
+
+		if rr.Code != 200 {
+			t.Fatalf("expected status 200, got %d", rr.Code)
+		}
+		expected := "0008NAK\n" +
+			sideBand(2, "waiting for a free slot (position 1)...\r") +
+			sideBand(3, "the server is busy, please try again later\n") +
+			"0000"
+		if rr.Body.String() != expected {
+			t.Fatalf("expected %q, got %q", expected, rr.Body.String())
+		}
+	})
+
+	t.Run("no side-band", func(t *testing.T) {
+		rr := testQueuedUploadPack(t, queue, pktLines(wantA, "", "done"))
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status 503, got %d", rr.Code)
+		}
+	})
+}
+
+func TestHandleUploadPackQueueFull(t *testing.T) {
+	queue := queueing.NewQueue("test_upload_pack_full", 1, 0, time.Second)
+	if err := queue.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Release()
+
+	rr := testQueuedUploadPack(t, queue, pktLines(wantA+" side-band-64k", "", "done"))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rr.Code)
+	}
+}
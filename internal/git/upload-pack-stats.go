@@ -0,0 +1,219 @@
+/*
+In this file we look at what a client asks for in a git-upload-pack request
+*/
+
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// Filter kinds we report separately; anything else is counted as "other"
+var knownFilterKinds = map[string]bool{
+	"blob:none":  true,
+	"blob:limit": true,
+	"tree":       true,
+	"sparse:oid": true,
+	"combine":    true,
+}
+
+var (
+	uploadPackRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_upload_pack_requests",
+			Help: "How many git-upload-pack requests have been handled, partitioned by request type (full, shallow, partial, fetch, ls-refs, unknown) and agent.",
+		},
+		[]string{"type", "agent"},
+	)
+	uploadPackFilters = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_upload_pack_filters",
+			Help: "How many git-upload-pack requests asked for a partial clone, partitioned by filter kind.",
+		},
+		[]string{"filter"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadPackRequests)
+	prometheus.MustRegister(uploadPackFilters)
+}
+
+// uploadPackStats describes a git-upload-pack request body, for either
+// protocol v0 or v2.
+type uploadPackStats struct {
+	Command        string
+	Wants          int
+	Haves          int
+	Shallows       int
+	Depth          int
+	DeepenSince    string
+	DeepenNot      int
+	DeepenRelative bool
+	Filter         string
+	Done           bool
+	Agent          string
+	Capabilities   []string
+}
+
+func parseUploadPackRequest(body io.Reader) (*uploadPackStats, error) {
+	stats := &uploadPackStats{}
+	inArguments := true
+
+	scanner := bufio.NewScanner(body)
+	scanner.Split(pktLineSplitter)
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSuffix(scanner.Text(), "\n")
+
+		// Protocol v2 requests start with a command and its capabilities,
+		// followed by a delimiter and the arguments
+		if first && strings.HasPrefix(line, "command=") {
+			stats.Command = strings.TrimPrefix(line, "command=")
+			inArguments = false
+			continue
+		}
+		if !inArguments {
+			if line == "" {
+				inArguments = true
+			} else {
+				stats.addCapability(line)
+			}
+			continue
+		}
+
+		keyword, value := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			keyword, value = line[:i], line[i+1:]
+		}
+
+		switch keyword {
+		case "want":
+			if fields := strings.Fields(value); stats.Wants == 0 && stats.Command == "" && len(fields) > 1 {
+				// Protocol v0 sends capabilities on the first want line
+				for _, capability := range fields[1:] {
+					stats.addCapability(capability)
+				}
+			}
+			stats.Wants++
+		case "have":
+			stats.Haves++
+		case "shallow":
+			stats.Shallows++
+		case "deepen":
+			depth, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid deepen line: %q", line)
+			}
+			stats.Depth = depth
+		case "deepen-since":
+			stats.DeepenSince = value
+		case "deepen-not":
+			stats.DeepenNot++
+		case "deepen-relative":
+			stats.DeepenRelative = true
+		case "filter":
+			stats.Filter = value
+		case "done":
+			stats.Done = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (s *uploadPackStats) addCapability(capability string) {
+	if strings.HasPrefix(capability, "agent=") {
+		s.Agent = strings.TrimPrefix(capability, "agent=")
+		return
+	}
+	s.Capabilities = append(s.Capabilities, capability)
+}
+
+func (s *uploadPackStats) hasCapability(capability string) bool {
+	for _, c := range s.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *uploadPackStats) isShallow() bool {
+	return s.Depth > 0 || s.DeepenSince != "" || s.DeepenNot > 0
+}
+
+// requestType has a small fixed set of values so it can be used as a
+// metric label.
+func (s *uploadPackStats) requestType() string {
+	switch {
+	case s.Command == "ls-refs":
+		return "ls-refs"
+	case s.Command != "" && s.Command != "fetch", s.Wants == 0:
+		return "unknown"
+	case s.Filter != "":
+		return "partial"
+	case s.isShallow():
+		return "shallow"
+	case s.Haves > 0:
+		return "fetch"
+	default:
+		return "full"
+	}
+}
+
+// filterKind reports e.g. "blob:limit=1m" as "blob:limit" and "tree:0" as
+// "tree".
+func (s *uploadPackStats) filterKind() string {
+	kind := s.Filter
+	if i := strings.IndexByte(kind, '='); i >= 0 {
+		kind = kind[:i]
+	}
+	if i := strings.IndexByte(kind, ':'); i >= 0 && !knownFilterKinds[kind] {
+		kind = kind[:i]
+	}
+
+	if !knownFilterKinds[kind] {
+		return "other"
+	}
+	return kind
+}
+
+func countUploadPackRequest(r *http.Request, stats *uploadPackStats) {
+	uploadPackRequests.WithLabelValues(stats.requestType(), getRequestAgent(r)).Inc()
+	if stats.Filter != "" {
+		uploadPackFilters.WithLabelValues(stats.filterKind()).Inc()
+	}
+}
+
+func logUploadPackRequest(r *http.Request, stats *uploadPackStats, w *GitHttpResponseWriter) {
+	log.Printf("handleUploadPack: path=%q type=%s wants=%d haves=%d shallows=%d depth=%d deepen_since=%q deepen_not=%d deepen_relative=%v filter=%q agent=%q capabilities=%q status=%d bytes=%d",
+		helper.ScrubURLParams(r.URL.Path),
+		stats.requestType(),
+		stats.Wants,
+		stats.Haves,
+		stats.Shallows,
+		stats.Depth,
+		stats.DeepenSince,
+		stats.DeepenNot,
+		stats.DeepenRelative,
+		stats.Filter,
+		stats.Agent,
+		strings.Join(stats.Capabilities, " "),
+		w.Status(),
+		w.Count(),
+	)
+}
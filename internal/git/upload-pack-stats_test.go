@@ -0,0 +1,108 @@
+package git
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseUploadPackRequestV0(t *testing.T) {
+	body := pktLines(
+		wantA+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.18.0",
+		wantB,
+		"shallow "+strings.Repeat("c", 40),
+		"deepen 1",
+		"",
+		"have "+strings.Repeat("d", 40),
+		"done",
+	)
+
+	stats, err := parseUploadPackRequest(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &uploadPackStats{
+		Wants:        2,
+		Haves:        1,
+		Shallows:     1,
+		Depth:        1,
+		Done:         true,
+		Agent:        "git/2.18.0",
+		Capabilities: []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "ofs-delta"},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	if stats.requestType() != "shallow" {
+		t.Fatalf("expected shallow request, got %q", stats.requestType())
+	}
+}
+
+func TestParseUploadPackRequestV2(t *testing.T) {
+	body := pktLines("command=fetch", "agent=git/2.20.1", "object-format=sha1") +
+		"0001" +
+		pktLines("thin-pack", wantA, "filter blob:limit=1m", "done", "")
+
+	stats, err := parseUploadPackRequest(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &uploadPackStats{
+		Command:      "fetch",
+		Wants:        1,
+		Filter:       "blob:limit=1m",
+		Done:         true,
+		Agent:        "git/2.20.1",
+		Capabilities: []string{"object-format=sha1"},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	if stats.requestType() != "partial" {
+		t.Fatalf("expected partial request, got %q", stats.requestType())
+	}
+	if stats.filterKind() != "blob:limit" {
+		t.Fatalf("expected filter kind blob:limit, got %q", stats.filterKind())
+	}
+}
+
+func TestUploadPackRequestType(t *testing.T) {
+	testCases := []struct {
+		stats       uploadPackStats
+		requestType string
+	}{
+		{uploadPackStats{Wants: 1}, "full"},
+		{uploadPackStats{Wants: 1, Haves: 10}, "fetch"},
+		{uploadPackStats{Wants: 1, DeepenSince: "1500000000"}, "shallow"},
+		{uploadPackStats{Wants: 1, Depth: 1, Filter: "blob:none"}, "partial"},
+		{uploadPackStats{Command: "ls-refs"}, "ls-refs"},
+		{uploadPackStats{Command: "object-info", Wants: 1}, "unknown"},
+		{uploadPackStats{}, "unknown"},
+	}
+
+	for _, tc := range testCases {
+		if requestType := tc.stats.requestType(); requestType != tc.requestType {
+			t.Errorf("%+v: expected %q, got %q", tc.stats, tc.requestType, requestType)
+		}
+	}
+}
+
+func TestUploadPackFilterKind(t *testing.T) {
+	testCases := map[string]string{
+		"blob:none":           "blob:none",
+		"blob:limit=1024":     "blob:limit",
+		"tree:0":              "tree",
+		"sparse:oid=abcdef":   "sparse:oid",
+		"combine:blob%3Anone": "combine",
+		"something:else":      "other",
+	}
+
+	for filter, kind := range testCases {
+		stats := uploadPackStats{Filter: filter}
+		if stats.filterKind() != kind {
+			t.Errorf("%q: expected %q, got %q", filter, kind, stats.filterKind())
+		}
+	}
+}
@@ -10,11 +10,12 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 )
 
 // Will not return a non-nil error after the response body has been
 // written to.
-func handleUploadPack(w *GitHttpResponseWriter, r *http.Request, a *api.Response) error {
+func handleUploadPack(w *GitHttpResponseWriter, r *http.Request, a *api.Response, cache *UploadPackCache, queue *queueing.Queue) error {
 	// The body will consist almost entirely of 'have XXX' and 'want XXX'
 	// lines; these are about 50 bytes long. With a limit of 10MB the client
 	// can send over 200,000 have/want lines.
@@ -25,26 +26,67 @@ func handleUploadPack(w *GitHttpResponseWriter, r *http.Request, a *api.Response
 	defer buffer.Close()
 	r.Body.Close()
 
+	stats, err := parseUploadPackRequest(buffer)
+	if err != nil {
+		helper.LogError(r, fmt.Errorf("parseUploadPackRequest: %v", err))
+		stats = &uploadPackStats{}
+	}
+	if _, err := buffer.Seek(0, 0); err != nil {
+		return fmt.Errorf("seek tempfile: %v", err)
+	}
+	countUploadPackRequest(r, stats)
+	defer logUploadPackRequest(r, stats, w)
+
 	action := getService(r)
+	gitProtocol := localGitProtocol(r, a, action)
 	writePostRPCHeader(w, action)
 
-	if Testing && a.GitalyServer.Address == "" {
-		// This code path is no longer reachable in GitLab 10.0
-		err = handleUploadPackLocally(a, r, buffer, w, action)
+	client := newUploadPackClient(w, earlyResponseHeader(stats, gitProtocol))
+	produce := func(ctx context.Context, out io.Writer) error {
+		if queue != nil {
+			if err := client.waitForSlot(queue); err != nil {
+				return err
+			}
+			defer queue.Release()
+		}
+
+		if Testing && a.GitalyServer.Address == "" {
+			// This code path is no longer reachable in GitLab 10.0
+			return handleUploadPackLocally(a, r, buffer, out, action, gitProtocol)
+		}
+		return handleUploadPackWithGitaly(ctx, a, buffer, out)
+	}
+
+	if cache == nil || gitProtocol != "" {
+		err = produce(r.Context(), client)
 	} else {
-		err = handleUploadPackWithGitaly(r.Context(), a, buffer, w)
+		key, cacheable := uploadPackCacheKey(a, buffer)
+		if _, err := buffer.Seek(0, 0); err != nil {
+			return fmt.Errorf("seek tempfile: %v", err)
+		}
+
+		if cacheable {
+			err = cache.serve(r.Context(), key, client, produce)
+		} else {
+			err = produce(r.Context(), client)
+		}
+	}
+
+	if err == queueing.ErrTooManyRequests || err == queueing.ErrQueueingTimedout {
+		client.rejectQueued(r, err)
+		return nil
 	}
 
 	return err
 }
 
-func handleUploadPackLocally(a *api.Response, r *http.Request, stdin *os.File, stdout io.Writer, action string) error {
+func handleUploadPackLocally(a *api.Response, r *http.Request, stdin *os.File, stdout io.Writer, action string, gitProtocol string) error {
 	isShallowClone := scanDeepen(stdin)
 	if _, err := stdin.Seek(0, 0); err != nil {
 		return fmt.Errorf("seek tempfile: %v", err)
 	}
 
-	cmd, err := startGitCommand(a, stdin, stdout, action)
+	cmd, err := startGitCommand(a, stdin, stdout, action, gitProtocol)
 	if err != nil {
 		return fmt.Errorf("startGitCommand: %v", err)
 	}
@@ -4,8 +4,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"net/http"
-	"strconv"
 
 	pb "gitlab.com/gitlab-org/gitaly-proto/go"
 	"gitlab.com/gitlab-org/gitaly/streamio"
@@ -15,27 +13,36 @@ type BlobClient struct {
 	pb.BlobServiceClient
 }
 
-func (client *BlobClient) SendBlob(ctx context.Context, w http.ResponseWriter, request *pb.GetBlobRequest) error {
+// GetBlobReader returns how many bytes of the blob request asks for and
+// a reader for them. Cancel ctx to stop the stream early.
+func (client *BlobClient) GetBlobReader(ctx context.Context, request *pb.GetBlobRequest) (int64, io.Reader, error) {
 	c, err := client.GetBlob(ctx, request)
 	if err != nil {
-		return fmt.Errorf("rpc failed: %v", err)
+		return 0, nil, fmt.Errorf("rpc failed: %v", err)
 	}
 
-	firstResponseReceived := false
-	rr := streamio.NewReader(func() ([]byte, error) {
-		resp, err := c.Recv()
+	// Only the first response tells us the size
+	first, err := c.Recv()
+	if err != nil {
+		return 0, nil, fmt.Errorf("rpc failed: %v", err)
+	}
+
+	size := first.GetSize()
+	if limit := request.GetLimit(); limit >= 0 && limit < size {
+		size = limit
+	}
 
-		if !firstResponseReceived && err == nil {
-			firstResponseReceived = true
-			w.Header().Set("Content-Length", strconv.FormatInt(resp.GetSize(), 10))
+	data := first.GetData()
+	rr := streamio.NewReader(func() ([]byte, error) {
+		if data != nil {
+			p := data
+			data = nil
+			return p, nil
 		}
 
+		resp, err := c.Recv()
 		return resp.GetData(), err
 	})
 
-	if _, err := io.Copy(w, rr); err != nil {
-		return fmt.Errorf("copy rpc data: %v", err)
-	}
-
-	return nil
+	return size, rr, nil
 }
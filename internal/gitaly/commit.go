@@ -0,0 +1,135 @@
+package gitaly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+	"gitlab.com/gitlab-org/gitaly/streamio"
+)
+
+type CommitClient struct {
+	pb.CommitServiceClient
+}
+
+// TreeWalkLimits bound the work WalkTree does for one tree.
+type TreeWalkLimits struct {
+	// MaxCalls is how many GetTreeEntries calls, that is directories,
+	// WalkTree may make
+	MaxCalls int
+	// MaxEntries is how many entries WalkTree may pass to fn
+	MaxEntries int
+}
+
+// ErrTreeTooLarge is returned by WalkTree for trees beyond its limits.
+var ErrTreeTooLarge = errors.New("tree too large")
+
+type treeWalk struct {
+	limits  TreeWalkLimits
+	calls   int
+	entries int
+}
+
+// WalkTree calls fn for every entry below the path of request, including
+// the entries of subdirectories. A directory comes before its contents.
+// GetTreeEntries only lists one directory, so we list each subdirectory
+// once we are done with its parent: a tree with n directories costs n
+// calls. If the tree goes beyond limits WalkTree stops with
+// ErrTreeTooLarge, possibly after calling fn for part of the tree.
+func (client *CommitClient) WalkTree(ctx context.Context, request *pb.GetTreeEntriesRequest, limits TreeWalkLimits, fn func(*pb.TreeEntry) error) error {
+	return client.walkTree(ctx, request, &treeWalk{limits: limits}, fn)
+}
+
+func (client *CommitClient) walkTree(ctx context.Context, request *pb.GetTreeEntriesRequest, walk *treeWalk, fn func(*pb.TreeEntry) error) error {
+	walk.calls++
+	if walk.calls > walk.limits.MaxCalls {
+		return ErrTreeTooLarge
+	}
+
+	entries, err := client.listTreeEntries(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	walk.entries += len(entries)
+	if walk.entries > walk.limits.MaxEntries {
+		return ErrTreeTooLarge
+	}
+
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+
+		if entry.GetType() != pb.TreeEntry_TREE {
+			continue
+		}
+
+		subRequest := *request
+		subRequest.Path = entry.GetPath()
+		if err := client.walkTree(ctx, &subRequest, walk, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (client *CommitClient) listTreeEntries(ctx context.Context, request *pb.GetTreeEntriesRequest) ([]*pb.TreeEntry, error) {
+	c, err := client.GetTreeEntries(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("rpc failed: %v", err)
+	}
+
+	var entries []*pb.TreeEntry
+	for {
+		resp, err := c.Recv()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rpc failed: %v", err)
+		}
+		entries = append(entries, resp.GetEntries()...)
+	}
+}
+
+// GetTreeEntryReader returns the type, object ID, size and mode of the
+// tree entry request asks for and a reader for its contents. The entry is
+// nil if there is no such path. Cancel ctx to stop the stream early.
+func (client *CommitClient) GetTreeEntryReader(ctx context.Context, request *pb.TreeEntryRequest) (*pb.TreeEntryResponse, io.Reader, error) {
+	c, err := client.TreeEntry(ctx, request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rpc failed: %v", err)
+	}
+
+	// Only the first response tells us what the entry is
+	first, err := c.Recv()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("rpc failed: %v", err)
+	}
+	if first.GetOid() == "" {
+		return nil, nil, nil
+	}
+
+	data := first.GetData()
+	rr := streamio.NewReader(func() ([]byte, error) {
+		if data != nil {
+			p := data
+			data = nil
+			return p, nil
+		}
+
+		resp, err := c.Recv()
+		return resp.GetData(), err
+	})
+
+	entry := *first
+	entry.Data = nil
+	return &entry, rr, nil
+}
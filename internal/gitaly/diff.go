@@ -0,0 +1,115 @@
+package gitaly
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+)
+
+type DiffClient struct {
+	pb.DiffServiceClient
+}
+
+// SendRawDiff writes the diff between the commits of request to w in the
+// format of 'git diff --full-index'. CommitDiff returns the patch of each
+// file without its header, so we write the headers ourselves. They are
+// not byte-identical to git's for renames: CommitDiff does not tell us
+// the similarity, so the "similarity index" line is missing.
+func (client *DiffClient) SendRawDiff(ctx context.Context, w http.ResponseWriter, request *pb.CommitDiffRequest) error {
+	// We want the whole diff, not what fits on a merge request page
+	request.EnforceLimits = false
+	request.CollapseDiffs = false
+
+	c, err := client.CommitDiff(ctx, request)
+	if err != nil {
+		return fmt.Errorf("rpc failed: %v", err)
+	}
+
+	w.Header().Del("Content-Length")
+	if err := writeRawDiff(w, c.Recv); err != nil {
+		return fmt.Errorf("copy rpc data: %v", err)
+	}
+
+	return nil
+}
+
+func writeRawDiff(w io.Writer, recv func() (*pb.CommitDiffResponse, error)) error {
+	inPatch := false
+	for {
+		resp, err := recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !inPatch {
+			if _, err := io.WriteString(w, rawDiffHeader(resp)); err != nil {
+				return err
+			}
+		}
+
+		if _, err := w.Write(resp.GetRawPatchData()); err != nil {
+			return err
+		}
+
+		// Large patches are split over several responses
+		inPatch = !resp.GetEndOfPatch()
+	}
+}
+
+const nullPath = "/dev/null"
+
+// rawDiffHeader puts the lines in the order git does: mode changes come
+// before the rename lines, and the index line after them.
+func rawDiffHeader(resp *pb.CommitDiffResponse) string {
+	fromPath, toPath := string(resp.GetFromPath()), string(resp.GetToPath())
+	oldMode, newMode := resp.GetOldMode(), resp.GetNewMode()
+
+	var header []string
+	header = append(header, fmt.Sprintf("diff --git a/%s b/%s", fromPath, toPath))
+
+	switch {
+	case oldMode == 0:
+		header = append(header, fmt.Sprintf("new file mode %o", newMode))
+	case newMode == 0:
+		header = append(header, fmt.Sprintf("deleted file mode %o", oldMode))
+	case oldMode != newMode:
+		header = append(header, fmt.Sprintf("old mode %o", oldMode), fmt.Sprintf("new mode %o", newMode))
+	}
+
+	if fromPath != toPath {
+		header = append(header, "rename from "+fromPath, "rename to "+toPath)
+	}
+
+	if resp.GetFromId() != resp.GetToId() {
+		index := fmt.Sprintf("index %s..%s", resp.GetFromId(), resp.GetToId())
+		if oldMode == newMode {
+			index += fmt.Sprintf(" %o", oldMode)
+		}
+		header = append(header, index)
+
+		from, to := "a/"+fromPath, "b/"+toPath
+		if oldMode == 0 {
+			from = nullPath
+		}
+		if newMode == 0 {
+			to = nullPath
+		}
+
+		if resp.GetBinary() {
+			if len(resp.GetRawPatchData()) == 0 {
+				header = append(header, fmt.Sprintf("Binary files %s and %s differ", from, to))
+			}
+		} else if len(resp.GetRawPatchData()) > 0 {
+			header = append(header, "--- "+from, "+++ "+to)
+		}
+	}
+
+	return strings.Join(header, "\n") + "\n"
+}
@@ -0,0 +1,93 @@
+package gitaly
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+)
+
+const (
+	testFromId = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+	testToId   = "ce013625030ba8dba906f756967f9e9ca394464a"
+	testZeroId = "0000000000000000000000000000000000000000"
+)
+
+func TestWriteRawDiff(t *testing.T) {
+	responses := []*pb.CommitDiffResponse{
+		{
+			FromPath: []byte("README.md"), ToPath: []byte("README.md"),
+			FromId: testFromId, ToId: testToId, OldMode: 0100644, NewMode: 0100644,
+			RawPatchData: []byte("@@ -0,0 +1 @@\n"),
+		},
+		{RawPatchData: []byte("+hello\n"), EndOfPatch: true},
+		{
+			FromPath: []byte("new.txt"), ToPath: []byte("new.txt"),
+			FromId: testZeroId, ToId: testToId, NewMode: 0100644,
+			RawPatchData: []byte("@@ -0,0 +1 @@\n+hello\n"), EndOfPatch: true,
+		},
+		{
+			FromPath: []byte("old.txt"), ToPath: []byte("old.txt"),
+			FromId: testToId, ToId: testZeroId, OldMode: 0100644,
+			RawPatchData: []byte("@@ -1 +0,0 @@\n-hello\n"), EndOfPatch: true,
+		},
+		{
+			FromPath: []byte("image.png"), ToPath: []byte("image.png"),
+			FromId: testFromId, ToId: testToId, OldMode: 0100644, NewMode: 0100644,
+			Binary: true, EndOfPatch: true,
+		},
+		{
+			FromPath: []byte("a.sh"), ToPath: []byte("b.sh"),
+			FromId: testToId, ToId: testToId, OldMode: 0100644, NewMode: 0100755,
+			EndOfPatch: true,
+		},
+	}
+
+	expected := `diff --git a/README.md b/README.md
+index e69de29bb2d1d6434b8b29ae775ad8c2e48c5391..ce013625030ba8dba906f756967f9e9ca394464a 100644
+--- a/README.md
++++ b/README.md
+@@ -0,0 +1 @@
++hello
+diff --git a/new.txt b/new.txt
+new file mode 100644
+index 0000000000000000000000000000000000000000..ce013625030ba8dba906f756967f9e9ca394464a
+--- /dev/null
++++ b/new.txt
+@@ -0,0 +1 @@
++hello
+diff --git a/old.txt b/old.txt
+deleted file mode 100644
+index ce013625030ba8dba906f756967f9e9ca394464a..0000000000000000000000000000000000000000
+--- a/old.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-hello
+diff --git a/image.png b/image.png
+index e69de29bb2d1d6434b8b29ae775ad8c2e48c5391..ce013625030ba8dba906f756967f9e9ca394464a 100644
+Binary files a/image.png and b/image.png differ
+diff --git a/a.sh b/b.sh
+old mode 100644
+new mode 100755
+rename from a.sh
+rename to b.sh
+`
+
+	recv := func() (*pb.CommitDiffResponse, error) {
+		if len(responses) == 0 {
+			return nil, io.EOF
+		}
+		resp := responses[0]
+		responses = responses[1:]
+		return resp, nil
+	}
+
+	var buf bytes.Buffer
+	if err := writeRawDiff(&buf, recv); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
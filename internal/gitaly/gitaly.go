@@ -45,6 +45,24 @@ func NewBlobClient(server Server) (*BlobClient, error) {
 	return &BlobClient{grpcClient}, nil
 }
 
+func NewDiffClient(server Server) (*DiffClient, error) {
+	conn, err := getOrCreateConnection(server)
+	if err != nil {
+		return nil, err
+	}
+	grpcClient := pb.NewDiffServiceClient(conn)
+	return &DiffClient{grpcClient}, nil
+}
+
+func NewCommitClient(server Server) (*CommitClient, error) {
+	conn, err := getOrCreateConnection(server)
+	if err != nil {
+		return nil, err
+	}
+	grpcClient := pb.NewCommitServiceClient(conn)
+	return &CommitClient{grpcClient}, nil
+}
+
 func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
 	cache.Lock()
 	defer cache.Unlock()
@@ -6,6 +6,7 @@ import (
 
 type CountingResponseWriter interface {
 	http.ResponseWriter
+	http.Flusher
 	Count() int64
 	Status() int
 }
@@ -43,6 +44,12 @@ func (c *countingResponseWriter) WriteHeader(status int) {
 	c.rw.WriteHeader(status)
 }
 
+func (c *countingResponseWriter) Flush() {
+	if flusher, ok := c.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Count returns the number of bytes written to the ResponseWriter. This
 // function is not thread-safe.
 func (c *countingResponseWriter) Count() int64 {
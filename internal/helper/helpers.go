@@ -43,6 +43,12 @@ func RequestEntityTooLarge(w http.ResponseWriter, r *http.Request, err error) {
 	printError(r, err)
 }
 
+func Forbidden(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	captureRavenError(r, err)
+	printError(r, err)
+}
+
 func printError(r *http.Request, err error) {
 	if r != nil {
 		log.Printf("error: %s %q: %v", r.Method, ScrubURLParams(r.RequestURI), err)
@@ -167,6 +173,30 @@ func SetForwardedFor(newHeaders *http.Header, originalRequest *http.Request) {
 	}
 }
 
+// ClientIP returns the address of the client as far as we can trust it.
+// Over TCP that is the peer, like SetForwardedFor assumes. On a unix
+// socket the peer is the NGINX in front of us, which sets X-Real-IP and
+// appends the address it saw to X-Forwarded-For; the earlier entries of
+// X-Forwarded-For are whatever the client sent.
+func ClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+
+	if forwardedFor := r.Header["X-Forwarded-For"]; len(forwardedFor) > 0 {
+		hops := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+		if lastHop := strings.TrimSpace(hops[len(hops)-1]); lastHop != "" {
+			return lastHop
+		}
+	}
+
+	return r.RemoteAddr
+}
+
 func IsContentType(expected, actual string) bool {
 	parsed, _, err := mime.ParseMediaType(actual)
 	return err == nil && parsed == expected
@@ -53,6 +53,37 @@ func TestSetForwardedForGeneratesHeader(t *testing.T) {
 	}
 }
 
+func TestClientIP(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		remoteAddr   string
+		realIP       string
+		forwardedFor []string
+		expected     string
+	}{
+		{"tcp", "8.8.8.8:3000", "", []string{"138.124.33.63"}, "8.8.8.8"},
+		{"tcp ignores X-Real-IP", "8.8.8.8:3000", "138.124.33.63", nil, "8.8.8.8"},
+		{"unix socket with X-Real-IP", "@", "151.146.211.237", []string{"138.124.33.63, 151.146.211.237"}, "151.146.211.237"},
+		{"unix socket with X-Forwarded-For", "@", "", []string{"138.124.33.63, 151.146.211.237"}, "151.146.211.237"},
+		{"unix socket with repeated X-Forwarded-For", "", "", []string{"8.154.76.107", "115.206.118.179"}, "115.206.118.179"},
+		{"unix socket without headers", "@", "", nil, "@"},
+	}
+
+	for _, tc := range testCases {
+		r := &http.Request{RemoteAddr: tc.remoteAddr, Header: http.Header{}}
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if tc.forwardedFor != nil {
+			r.Header["X-Forwarded-For"] = tc.forwardedFor
+		}
+
+		if result := ClientIP(r); result != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.desc, tc.expected, result)
+		}
+	}
+}
+
 func TestReadRequestBody(t *testing.T) {
 	data := []byte("123456")
 	rw := httptest.NewRecorder()
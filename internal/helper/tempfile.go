@@ -1,13 +1,14 @@
 package helper
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
 )
 
 func ReadAllTempfile(r io.Reader) (tempfile *os.File, err error) {
-	tempfile, err = ioutil.TempFile("", "gitlab-workhorse-read-all-tempfile")
+	tempfile, err = newUnlinkedTempfile("gitlab-workhorse-read-all-tempfile")
 	if err != nil {
 		return nil, err
 	}
@@ -19,15 +20,120 @@ func ReadAllTempfile(r io.Reader) (tempfile *os.File, err error) {
 		}
 	}()
 
-	if err := os.Remove(tempfile.Name()); err != nil {
+	if _, err := io.Copy(tempfile, r); err != nil {
 		return nil, err
 	}
 
-	if _, err := io.Copy(tempfile, r); err != nil {
+	if _, err := tempfile.Seek(0, 0); err != nil {
 		return nil, err
 	}
 
-	if _, err := tempfile.Seek(0, 0); err != nil {
+	return tempfile, nil
+}
+
+// Spool holds the complete contents of a stream. Small contents are kept in
+// memory, larger contents spill over into an unlinked tempfile.
+type Spool struct {
+	memoryLimit int64
+	buffer      bytes.Buffer
+	file        *os.File
+	size        int64
+	reader      io.Reader
+}
+
+// NewSpool creates an empty Spool that keeps up to memoryLimit bytes in
+// memory. Call Rewind after writing to it to read back its contents.
+func NewSpool(memoryLimit int64) *Spool {
+	return &Spool{memoryLimit: memoryLimit}
+}
+
+// SpoolReader reads r until EOF into a new Spool.
+func SpoolReader(r io.Reader, memoryLimit int64) (*Spool, error) {
+	spool := NewSpool(memoryLimit)
+
+	if _, err := io.Copy(spool, r); err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	if err := spool.Rewind(); err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	return spool, nil
+}
+
+func (s *Spool) Write(p []byte) (n int, err error) {
+	if s.file == nil && int64(s.buffer.Len()+len(p)) <= s.memoryLimit {
+		n, err = s.buffer.Write(p)
+		s.size += int64(n)
+		return n, err
+	}
+
+	if s.file == nil {
+		s.file, err = newUnlinkedTempfile("gitlab-workhorse-spool")
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = s.file.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// Rewind prepares the Spool for reading its contents from the start.
+func (s *Spool) Rewind() error {
+	if s.file == nil {
+		s.reader = bytes.NewReader(s.buffer.Bytes())
+		return nil
+	}
+
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return err
+	}
+
+	s.reader = io.MultiReader(bytes.NewReader(s.buffer.Bytes()), s.file)
+	return nil
+}
+
+func (s *Spool) Read(p []byte) (int, error) {
+	if s.reader == nil {
+		return 0, io.EOF
+	}
+
+	return s.reader.Read(p)
+}
+
+// Close releases the tempfile backing the spool, if any.
+func (s *Spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Close()
+}
+
+// Size returns the total number of bytes written to the spool.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// InMemory tells whether the spool fitted in memory.
+func (s *Spool) InMemory() bool {
+	return s.file == nil
+}
+
+func newUnlinkedTempfile(prefix string) (tempfile *os.File, err error) {
+	tempfile, err = ioutil.TempFile("", prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlink the file right away so that it disappears when we close it
+	if err := os.Remove(tempfile.Name()); err != nil {
+		tempfile.Close()
 		return nil, err
 	}
 
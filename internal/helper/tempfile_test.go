@@ -0,0 +1,44 @@
+package helper
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSpoolReader(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		inMemory bool
+	}{
+		{"", true},
+		{"abc", true},
+		{"abcd", true},
+		{"abcde", false},
+		{"abcdefgh", false},
+	} {
+		spool, err := SpoolReader(strings.NewReader(tc.input), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if spool.InMemory() != tc.inMemory {
+			t.Errorf("%q: expected InMemory() to be %v", tc.input, tc.inMemory)
+		}
+		if spool.Size() != int64(len(tc.input)) {
+			t.Errorf("%q: expected size %d, got %d", tc.input, len(tc.input), spool.Size())
+		}
+
+		output, err := ioutil.ReadAll(spool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != tc.input {
+			t.Errorf("expected %q, got %q", tc.input, output)
+		}
+
+		if err := spool.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
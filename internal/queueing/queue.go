@@ -2,6 +2,7 @@ package queueing
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -123,6 +124,14 @@ type Queue struct {
 	busyCh    chan struct{}
 	waitingCh chan time.Time
 	timeout   time.Duration
+
+	// waiters are the requests blocked in Acquire, in order of arrival
+	waiters      []*waiter
+	waitersMutex sync.Mutex
+}
+
+type waiter struct {
+	since time.Time
 }
 
 // newQueue creates a new queue
@@ -148,11 +157,31 @@ func newQueue(name string, limit, queueLimit uint, timeout time.Duration) *Queue
 	return queue
 }
 
+// NewQueue creates a new queue for callers that need more control than
+// QueueRequests gives them. It returns nil if limit is zero.
+func NewQueue(name string, limit, queueLimit uint, timeout time.Duration) *Queue {
+	if limit == 0 {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	return newQueue(name, limit, queueLimit, timeout)
+}
+
 // Acquire takes one slot from the Queue
 // and returns when a request should be processed
 // it allows up to (limit) of requests running at a time
 // it allows to queue up to (queue-limit) requests
 func (s *Queue) Acquire() (err error) {
+	return s.AcquireWithProgress(0, nil)
+}
+
+// AcquireWithProgress is like Acquire, but if the request has to wait
+// for a slot it calls progress with the position of the request in the
+// queue, right away and then every interval.
+func (s *Queue) AcquireWithProgress(interval time.Duration, progress func(position int)) (err error) {
 	// push item to a queue to claim your own slot (non-blocking)
 	select {
 	case s.waitingCh <- time.Now():
@@ -183,16 +212,69 @@ func (s *Queue) Acquire() (err error) {
 	timer := time.NewTimer(s.timeout)
 	defer timer.Stop()
 
+	w := s.addWaiter()
+	defer s.removeWaiter(w)
+
+	var tick <-chan time.Time
+	if progress != nil {
+		progress(s.position(w))
+
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+	}
+
 	// push item to current processed items (blocking)
-	select {
-	case s.busyCh <- struct{}{}:
-		s.queueingBusy.Inc()
-		return nil
+	for {
+		select {
+		case s.busyCh <- struct{}{}:
+			s.queueingBusy.Inc()
+			return nil
+
+		case <-tick:
+			progress(s.position(w))
 
-	case <-timer.C:
-		s.queueingErrors.WithLabelValues("queueing_timedout").Inc()
-		return ErrQueueingTimedout
+		case <-timer.C:
+			s.queueingErrors.WithLabelValues("queueing_timedout").Inc()
+			return ErrQueueingTimedout
+		}
+	}
+}
+
+func (s *Queue) addWaiter() *waiter {
+	s.waitersMutex.Lock()
+	defer s.waitersMutex.Unlock()
+
+	w := &waiter{since: time.Now()}
+	s.waiters = append(s.waiters, w)
+	return w
+}
+
+func (s *Queue) removeWaiter(waiter *waiter) {
+	s.waitersMutex.Lock()
+	defer s.waitersMutex.Unlock()
+
+	for i, w := range s.waiters {
+		if w == waiter {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// position is 1 for the request that waited longest
+func (s *Queue) position(waiter *waiter) int {
+	s.waitersMutex.Lock()
+	defer s.waitersMutex.Unlock()
+
+	for i, w := range s.waiters {
+		if w == waiter {
+			return i + 1
+		}
 	}
+	return 0
 }
 
 // Release marks the finish of processing of requests
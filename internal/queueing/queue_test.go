@@ -60,3 +60,45 @@ func TestQueueProcessing(t *testing.T) {
 		t.Fatal("we should acquire slot after the previous one finished")
 	}
 }
+
+func TestQueueProgress(t *testing.T) {
+	q := newQueue("queue 4", 1, 2, time.Second)
+	if err := q.Acquire(); err != nil {
+		t.Fatal("we should acquire a new slot")
+	}
+
+	firstWaiting := make(chan struct{})
+	go func() {
+		q.AcquireWithProgress(0, func(int) { close(firstWaiting) })
+	}()
+	<-firstWaiting
+
+	positions := make(chan int, 10)
+	done := make(chan error)
+	go func() {
+		done <- q.AcquireWithProgress(time.Millisecond, func(position int) { positions <- position })
+	}()
+
+	if position := <-positions; position != 2 {
+		t.Fatalf("expected to be second in the queue, got %d", position)
+	}
+
+	// Let the first waiter in, and then the second one
+	q.Release()
+	for position := range positions {
+		if position == 1 {
+			break
+		}
+	}
+	q.Release()
+
+	if err := <-done; err != nil {
+		t.Fatalf("we should acquire a slot, got %v", err)
+	}
+}
+
+func TestQueueWithoutLimit(t *testing.T) {
+	if q := NewQueue("queue 5", 0, 1, time.Second); q != nil {
+		t.Fatal("expected no queue without a limit")
+	}
+}
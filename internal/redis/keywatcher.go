@@ -17,6 +17,8 @@ import (
 var (
 	keyWatcher            = make(map[string][]chan string)
 	keyWatcherMutex       sync.Mutex
+	keyListeners          []keyListener
+	keyListenersMutex     sync.RWMutex
 	redisReconnectTimeout = backoff.Backoff{
 		//These are the defaults
 		Min:    100 * time.Millisecond,
@@ -51,6 +53,13 @@ const (
 	promStatusHit  = "hit"
 )
 
+// keyListener is called for every notification about a key that starts
+// with prefix
+type keyListener struct {
+	prefix   string
+	listener func(key, value string)
+}
+
 // KeyChan holds a key and a channel
 type KeyChan struct {
 	Key  string
@@ -77,6 +86,7 @@ func processInner(conn redis.Conn) error {
 			}
 			key, value := msg[0], msg[1]
 			notifyChanWatchers(key, value)
+			notifyKeyListeners(key, value)
 		case error:
 			helper.LogError(nil, fmt.Errorf("keywatcher: pubsub receive: %v", v))
 			// Intermittent error, return nil so that it doesn't wait before reconnect
@@ -133,6 +143,40 @@ func notifyChanWatchers(key, value string) {
 	}
 }
 
+// ListenKeyPrefix calls listener for every notification about a key that
+// starts with prefix, for as long as gitlab-workhorse runs. Unlike
+// WatchKey it does not look at the current value in Redis.
+func ListenKeyPrefix(prefix string, listener func(key, value string)) {
+	keyListenersMutex.Lock()
+	defer keyListenersMutex.Unlock()
+	keyListeners = append(keyListeners, keyListener{prefix: prefix, listener: listener})
+}
+
+func notifyKeyListeners(key, value string) {
+	keyListenersMutex.RLock()
+	defer keyListenersMutex.RUnlock()
+	for _, l := range keyListeners {
+		if strings.HasPrefix(key, l.prefix) {
+			l.listener(key, value)
+		}
+	}
+}
+
+// Notify tells all gitlab-workhorse processes, including this one, that
+// key has changed to value
+func Notify(key, value string) error {
+	conn := Get()
+	if conn == nil {
+		return fmt.Errorf("keywatcher: could not get connection from pool")
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("PUBLISH", keySubChannel, key+"="+value); err != nil {
+		return fmt.Errorf("keywatcher: redis PUBLISH: %v", err)
+	}
+	return nil
+}
+
 func addKeyChan(kc *KeyChan) {
 	keyWatcherMutex.Lock()
 	defer keyWatcherMutex.Unlock()
@@ -160,3 +160,16 @@ func TestWatchKeyMassivelyParallel(t *testing.T) {
 	processMessages(runTimes, "somethingelse")
 	wg.Wait()
 }
+
+func TestListenKeyPrefix(t *testing.T) {
+	var seen []string
+	ListenKeyPrefix("git:refs:", func(key, value string) {
+		seen = append(seen, key+"="+value)
+	})
+	defer func() { keyListeners = nil }()
+
+	notifyKeyListeners("git:refs:project-1", "1")
+	notifyKeyListeners(runnerKey, "2")
+
+	assert.Equal(t, []string{"git:refs:project-1=1"}, seen)
+}
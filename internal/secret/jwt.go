@@ -11,15 +11,33 @@ var (
 )
 
 func JWTTokenString(claims jwt.Claims) (string, error) {
-	secretBytes, err := Bytes()
+	key, err := SigningKey()
 	if err != nil {
 		return "", fmt.Errorf("secret.JWTTokenString: %v", err)
 	}
 
-	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretBytes)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+
+	tokenString, err := token.SignedString(key.Bytes)
 	if err != nil {
 		return "", fmt.Errorf("secret.JWTTokenString: sign JWT: %v", err)
 	}
 
 	return tokenString, nil
 }
+
+// JWTKeyFunc finds the key to verify an HS256 token with. Tokens without a
+// key ID are verified with the signing key.
+func JWTKeyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return Bytes()
+	}
+
+	return KeyByID(kid)
+}
@@ -1,17 +1,40 @@
 package secret
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
-const numSecretBytes = 32
+const (
+	numSecretBytes = 32
+
+	// How often we look at the secret file to see if it changed
+	statInterval = time.Second
+)
+
+// Key is one HMAC key from the secret file. The first key in the file is
+// used for signing; all keys are accepted for verification.
+type Key struct {
+	ID    string
+	Bytes []byte
+}
 
 type sec struct {
-	path  string
-	bytes []byte
+	path     string
+	keys     []Key
+	modTime  time.Time
+	size     int64
+	lastStat time.Time
 	sync.RWMutex
 }
 
@@ -23,24 +46,77 @@ func SetPath(path string) {
 	theSecret.Lock()
 	defer theSecret.Unlock()
 	theSecret.path = path
-	theSecret.bytes = nil
+	theSecret.keys = nil
+	theSecret.lastStat = time.Time{}
 }
 
-// Lazy access to the HMAC secret key. We must be lazy because if the key
-// is not already there, it will be generated by gitlab-rails, and
-// gitlab-rails is slow.
+// Lazy access to the HMAC secret key used for signing. We must be lazy
+// because if the key is not already there, it will be generated by
+// gitlab-rails, and gitlab-rails is slow.
 func Bytes() ([]byte, error) {
-	if bytes := getBytes(); bytes != nil {
-		return copyBytes(bytes), nil
+	key, err := SigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return key.Bytes, nil
+}
+
+// SigningKey returns the first key from the secret file.
+func SigningKey() (Key, error) {
+	keys, err := Keys()
+	if err != nil {
+		return Key{}, err
+	}
+
+	return keys[0], nil
+}
+
+// Keys returns all keys from the secret file, the signing key first. The
+// file is read again when it has changed on disk.
+func Keys() ([]Key, error) {
+	if keys := getKeys(); keys != nil {
+		return copyKeys(keys), nil
 	}
 
-	return setBytes()
+	return setKeys()
 }
 
-func getBytes() []byte {
+// KeyByID looks up a key by the ID found in a JWT header.
+func KeyByID(id string) ([]byte, error) {
+	keys, err := Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if key.ID == id {
+			return key.Bytes, nil
+		}
+	}
+
+	return nil, fmt.Errorf("secret.KeyByID: unknown key ID %q", id)
+}
+
+// getKeys returns the cached keys, or nil if they are missing or the
+// secret file needs to be looked at again.
+func getKeys() []Key {
 	theSecret.RLock()
 	defer theSecret.RUnlock()
-	return theSecret.bytes
+
+	if time.Since(theSecret.lastStat) >= statInterval {
+		return nil
+	}
+
+	return theSecret.keys
+}
+
+func copyKeys(keys []Key) []Key {
+	out := make([]Key, len(keys))
+	for i, key := range keys {
+		out[i] = Key{ID: key.ID, Bytes: copyBytes(key.Bytes)}
+	}
+	return out
 }
 
 func copyBytes(bytes []byte) []byte {
@@ -49,29 +125,103 @@ func copyBytes(bytes []byte) []byte {
 	return out
 }
 
-func setBytes() ([]byte, error) {
+func setKeys() ([]Key, error) {
 	theSecret.Lock()
 	defer theSecret.Unlock()
 
-	if theSecret.bytes != nil {
-		return theSecret.bytes, nil
+	if theSecret.keys != nil && time.Since(theSecret.lastStat) < statInterval {
+		return copyKeys(theSecret.keys), nil
 	}
 
-	base64Bytes, err := ioutil.ReadFile(theSecret.path)
+	// Also when the file is missing or broken, so that we only try again,
+	// and log, once per statInterval
+	theSecret.lastStat = time.Now()
+	fi, err := os.Stat(theSecret.path)
 	if err != nil {
-		return nil, fmt.Errorf("secret.setBytes: read %q: %v", theSecret.path, err)
+		return keepKeys(fmt.Errorf("secret.setKeys: stat %q: %v", theSecret.path, err))
+	}
+
+	if theSecret.keys != nil && fi.ModTime().Equal(theSecret.modTime) && fi.Size() == theSecret.size {
+		return copyKeys(theSecret.keys), nil
 	}
 
-	secretBytes := make([]byte, base64.StdEncoding.DecodedLen(len(base64Bytes)))
-	n, err := base64.StdEncoding.Decode(secretBytes, base64Bytes)
+	contents, err := ioutil.ReadFile(theSecret.path)
 	if err != nil {
-		return nil, fmt.Errorf("secret.setBytes: decode secret: %v", err)
+		return keepKeys(fmt.Errorf("secret.setKeys: read %q: %v", theSecret.path, err))
 	}
 
-	if n != numSecretBytes {
-		return nil, fmt.Errorf("secret.setBytes: expected %d secretBytes in %s, found %d", numSecretBytes, theSecret.path, n)
+	keys, err := parseKeys(contents)
+	if err != nil {
+		return keepKeys(fmt.Errorf("secret.setKeys: %s: %v", theSecret.path, err))
 	}
 
-	theSecret.bytes = secretBytes
-	return copyBytes(theSecret.bytes), nil
+	theSecret.keys = keys
+	theSecret.modTime = fi.ModTime()
+	theSecret.size = fi.Size()
+	return copyKeys(theSecret.keys), nil
+}
+
+// keepKeys returns the keys we have, if any, instead of err. A secret
+// file that is being replaced may be missing, empty or half-written for
+// a moment. keepKeys must be called with theSecret locked.
+func keepKeys(err error) ([]Key, error) {
+	if theSecret.keys == nil {
+		return nil, err
+	}
+
+	log.Printf("%v; keeping the previous keys", err)
+	return copyKeys(theSecret.keys), nil
+}
+
+// parseKeys reads one base64-encoded key per line, optionally preceded by
+// a key ID and a space. Empty lines and lines starting with '#' are
+// ignored. Keys without an explicit ID get one derived from the key.
+func parseKeys(contents []byte) ([]Key, error) {
+	var keys []Key
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var id string
+		if fields := strings.Fields(line); len(fields) == 2 {
+			id, line = fields[0], fields[1]
+		}
+
+		secretBytes := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		n, err := base64.StdEncoding.Decode(secretBytes, []byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("decode secret: %v", err)
+		}
+
+		if n != numSecretBytes {
+			return nil, fmt.Errorf("expected %d secretBytes, found %d", numSecretBytes, n)
+		}
+		secretBytes = secretBytes[:n]
+
+		if id == "" {
+			id = keyID(secretBytes)
+		}
+
+		keys = append(keys, Key{ID: id, Bytes: secretBytes})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no secret keys found")
+	}
+
+	return keys, nil
+}
+
+// keyID is the first 16 hex digits of the SHA256 hash of the key.
+func keyID(secretBytes []byte) string {
+	sum := sha256.Sum256(secretBytes)
+	return hex.EncodeToString(sum[:8])
 }
@@ -0,0 +1,203 @@
+package secret
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	oldSecret = "+M8OJgJxoxdDRgOR0UT8sDbAgp/63y/XUNE3d8+tawA="
+	newSecret = "W5Xv2V5GJzJb7Lk2g1ILQ6mtnlzhYcIWI2XGuD3WUe0="
+)
+
+func writeSecretFile(t *testing.T, dir string, contents string) string {
+	secretPath := path.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return secretPath
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := parseKeys([]byte("# rotation in progress\nnew " + newSecret + "\n\n" + oldSecret + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	if keys[0].ID != "new" {
+		t.Fatalf("expected explicit key ID, got %q", keys[0].ID)
+	}
+	if keys[1].ID != keyID(keys[1].Bytes) || len(keys[1].ID) != 16 {
+		t.Fatalf("expected derived key ID, got %q", keys[1].ID)
+	}
+}
+
+func TestParseKeysErrors(t *testing.T) {
+	for _, contents := range []string{"", "# nothing\n", "not base64!", "c2hvcnQ="} {
+		if _, err := parseKeys([]byte(contents)); err == nil {
+			t.Errorf("expected error for %q", contents)
+		}
+	}
+}
+
+func TestKeysReloadOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretPath := writeSecretFile(t, dir, oldSecret+"\n")
+	SetPath(secretPath)
+
+	oldKey, err := SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeSecretFile(t, dir, newSecret+"\n"+oldSecret+"\n")
+	// Make sure the change is visible even on file systems with a coarse mtime
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(secretPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	theSecret.Lock()
+	theSecret.lastStat = time.Time{}
+	theSecret.Unlock()
+
+	keys, err := Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys after reload, got %d", len(keys))
+	}
+	if keys[1].ID != oldKey.ID {
+		t.Fatalf("expected old key to remain available for verification")
+	}
+}
+
+func TestKeysKeptOnBrokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretPath := writeSecretFile(t, dir, oldSecret+"\n")
+	SetPath(secretPath)
+
+	oldKey, err := SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, contents := range []string{"", "not base64!\n"} {
+		writeSecretFile(t, dir, contents)
+		future := time.Now().Add(time.Minute)
+		if err := os.Chtimes(secretPath, future, future); err != nil {
+			t.Fatal(err)
+		}
+		theSecret.Lock()
+		theSecret.lastStat = time.Time{}
+		theSecret.Unlock()
+
+		key, err := SigningKey()
+		if err != nil {
+			t.Fatalf("%q: %v", contents, err)
+		}
+		if key.ID != oldKey.ID {
+			t.Fatalf("%q: expected the previous key to be kept", contents)
+		}
+	}
+}
+
+func TestKeysKeptOnMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretPath := writeSecretFile(t, dir, oldSecret+"\n")
+	SetPath(secretPath)
+
+	oldKey, err := SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(secretPath); err != nil {
+		t.Fatal(err)
+	}
+	theSecret.Lock()
+	theSecret.lastStat = time.Time{}
+	theSecret.Unlock()
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	for i := 0; i < 10; i++ {
+		key, err := SigningKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.ID != oldKey.ID {
+			t.Fatal("expected the previous key to be kept")
+		}
+	}
+
+	if lines := strings.Count(logged.String(), "\n"); lines != 1 {
+		t.Fatalf("expected the missing file to be logged once, got %d lines: %q", lines, logged.String())
+	}
+}
+
+func TestJWTTokenStringKeyID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	SetPath(writeSecretFile(t, dir, "current "+newSecret+"\nprevious "+oldSecret+"\n"))
+
+	tokenString, err := JWTTokenString(DefaultClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Parse(tokenString, JWTKeyFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := token.Header["kid"]; kid != "current" {
+		t.Fatalf("expected kid %q, got %v", "current", kid)
+	}
+
+	// Tokens signed with a previous key still verify
+	previous, err := KeyByID("previous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken := jwt.NewWithClaims(jwt.SigningMethodHS256, DefaultClaims)
+	oldToken.Header["kid"] = "previous"
+	oldTokenString, err := oldToken.SignedString(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(oldTokenString, JWTKeyFunc); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,8 +3,16 @@ package senddata
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
 )
 
 type Injecter interface {
@@ -17,18 +25,102 @@ type Prefix string
 
 const HeaderKey = "Gitlab-Workhorse-Send-Data"
 
+// Rails signs payloads for the response it is sending, so their expiry
+// is only seconds away. A token that stays valid much longer than that
+// is dangerous if it leaks.
+const DefaultMaxTokenLifetime = 5 * time.Minute
+
+var (
+	sendDataPayloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_senddata_payloads",
+			Help: "How many senddata payloads have been unpacked, partitioned by injecter and result (signed, unsigned, rejected).",
+		},
+		[]string{"injecter", "result"},
+	)
+
+	errUnsignedPayload = errors.New("unsigned payload not allowed")
+	errMissingExpiry   = errors.New("signed payload has no expiry")
+	errExpiryTooFar    = errors.New("signed payload expires too far in the future")
+
+	// During the migration to signed payloads we still accept unsigned ones
+	allowUnsigned = true
+
+	maxTokenLifetime = DefaultMaxTokenLifetime
+)
+
+func init() {
+	prometheus.MustRegister(sendDataPayloads)
+}
+
+// SetAllowUnsigned controls whether payloads that are not signed with the
+// workhorse secret are accepted.
+func SetAllowUnsigned(allow bool) {
+	allowUnsigned = allow
+}
+
+// SetMaxTokenLifetime sets how far in the future the expiry of signed
+// payloads may be. Zero means there is no limit.
+func SetMaxTokenLifetime(lifetime time.Duration) {
+	maxTokenLifetime = lifetime
+}
+
+// sendDataClaims is the payload of a signed senddata header. Data holds
+// the same JSON object as an unsigned payload.
+type sendDataClaims struct {
+	Data json.RawMessage `json:"data"`
+	jwt.StandardClaims
+}
+
 func (p Prefix) Match(s string) bool {
 	return strings.HasPrefix(s, string(p))
 }
 
 func (p Prefix) Unpack(result interface{}, sendData string) error {
-	jsonBytes, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(sendData, string(p)))
+	payload := strings.TrimPrefix(sendData, string(p))
+
+	// The base64 alphabet has no dots so we can tell JWT payloads apart
+	if strings.Count(payload, ".") == 2 {
+		return p.unpackSigned(result, payload)
+	}
+
+	if !allowUnsigned {
+		sendDataPayloads.WithLabelValues(p.Name(), "rejected").Inc()
+		return errUnsignedPayload
+	}
+
+	jsonBytes, err := base64.URLEncoding.DecodeString(payload)
 	if err != nil {
 		return err
 	}
 	if err := json.Unmarshal([]byte(jsonBytes), result); err != nil {
 		return err
 	}
+	sendDataPayloads.WithLabelValues(p.Name(), "unsigned").Inc()
+	return nil
+}
+
+func (p Prefix) unpackSigned(result interface{}, payload string) error {
+	claims := &sendDataClaims{}
+	if _, err := jwt.ParseWithClaims(payload, claims, secret.JWTKeyFunc); err != nil {
+		sendDataPayloads.WithLabelValues(p.Name(), "rejected").Inc()
+		return fmt.Errorf("verify signed payload: %v", err)
+	}
+
+	if claims.ExpiresAt == 0 {
+		sendDataPayloads.WithLabelValues(p.Name(), "rejected").Inc()
+		return errMissingExpiry
+	}
+
+	if maxTokenLifetime > 0 && time.Unix(claims.ExpiresAt, 0).After(time.Now().Add(maxTokenLifetime)) {
+		sendDataPayloads.WithLabelValues(p.Name(), "rejected").Inc()
+		return errExpiryTooFar
+	}
+
+	if err := json.Unmarshal(claims.Data, result); err != nil {
+		return err
+	}
+	sendDataPayloads.WithLabelValues(p.Name(), "signed").Inc()
 	return nil
 }
 
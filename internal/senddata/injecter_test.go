@@ -0,0 +1,97 @@
+package senddata
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+type testParams struct {
+	RepoPath string
+}
+
+const testPrefix = Prefix("test:")
+
+func unsignedPayload(t *testing.T) string {
+	jsonBytes, err := json.Marshal(testParams{RepoPath: "/repo.git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(testPrefix) + base64.URLEncoding.EncodeToString(jsonBytes)
+}
+
+func signedPayload(t *testing.T, expiresAt int64, key []byte) string {
+	jsonBytes, err := json.Marshal(testParams{RepoPath: "/repo.git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := sendDataClaims{Data: jsonBytes, StandardClaims: jwt.StandardClaims{Issuer: "gitlab", ExpiresAt: expiresAt}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(testPrefix) + token
+}
+
+func TestUnpackSigned(t *testing.T) {
+	testhelper.ConfigureSecret()
+	key, err := secret.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var params testParams
+	if err := testPrefix.Unpack(&params, signedPayload(t, time.Now().Add(time.Minute).Unix(), key)); err != nil {
+		t.Fatal(err)
+	}
+	if params.RepoPath != "/repo.git" {
+		t.Fatalf("expected RepoPath %q, got %q", "/repo.git", params.RepoPath)
+	}
+}
+
+func TestUnpackRejectsBadSignatures(t *testing.T) {
+	testhelper.ConfigureSecret()
+	key, err := secret.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]string{
+		"expired":    signedPayload(t, time.Now().Add(-time.Minute).Unix(), key),
+		"no expiry":  signedPayload(t, 0, key),
+		"far expiry": signedPayload(t, time.Now().Add(DefaultMaxTokenLifetime+time.Minute).Unix(), key),
+		"wrong key":  signedPayload(t, time.Now().Add(time.Minute).Unix(), []byte("not the workhorse secret")),
+		"not a JWT.": string(testPrefix) + "foo.bar.baz",
+	}
+
+	for name, payload := range testCases {
+		var params testParams
+		if err := testPrefix.Unpack(&params, payload); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestUnpackUnsigned(t *testing.T) {
+	defer SetAllowUnsigned(true)
+
+	var params testParams
+	if err := testPrefix.Unpack(&params, unsignedPayload(t)); err != nil {
+		t.Fatal(err)
+	}
+	if params.RepoPath != "/repo.git" {
+		t.Fatalf("expected RepoPath %q, got %q", "/repo.git", params.RepoPath)
+	}
+
+	SetAllowUnsigned(false)
+	if err := testPrefix.Unpack(&params, unsignedPayload(t)); err != errUnsignedPayload {
+		t.Fatalf("expected %v, got %v", errUnsignedPayload, err)
+	}
+}
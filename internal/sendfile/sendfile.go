@@ -13,10 +13,11 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
-const sendFileResponseHeader = "X-Sendfile"
+const HeaderKey = "X-Sendfile"
 
 var (
 	sendFileRequests = prometheus.NewCounterVec(
@@ -88,8 +89,8 @@ func (s *sendFileResponseWriter) WriteHeader(status int) {
 		return
 	}
 
-	if file := s.Header().Get(sendFileResponseHeader); file != "" {
-		s.Header().Del(sendFileResponseHeader)
+	if file := s.Header().Get(HeaderKey); file != "" {
+		s.Header().Del(HeaderKey)
 		// Mark this connection as hijacked
 		s.hijacked = true
 
@@ -105,7 +106,13 @@ func (s *sendFileResponseWriter) WriteHeader(status int) {
 
 func sendFileFromDisk(w http.ResponseWriter, r *http.Request, file string) {
 	log.Printf("Send file %q for %s %q", file, r.Method, helper.ScrubURLParams(r.RequestURI))
-	content, fi, err := helper.OpenFile(file)
+	resolved, err := confinement.Resolve(file)
+	if err != nil {
+		confinement.Fail(w, r, "sendFileFromDisk", err)
+		return
+	}
+
+	content, fi, err := helper.OpenFile(resolved)
 	if err != nil {
 		http.NotFound(w, r)
 		return
@@ -0,0 +1,238 @@
+/*
+In this file we spool request bodies before they are proxied to the
+backend, so that a slow client does not hold on to a Unicorn worker.
+*/
+
+package spooling
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const (
+	DefaultMemoryLimit = 1024 * 1024
+	DefaultMaxSize     = 100 * 1024 * 1024
+	DefaultReadTimeout = time.Minute
+)
+
+var (
+	errRequestTooLarge = errors.New("request body too large")
+	errReadTimeout     = errors.New("timed out reading request body")
+
+	spooledRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_spooled_requests",
+			Help: "How many request bodies have been spooled by gitlab-workhorse before proxying, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+	spooledRequestBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_spooled_request_bytes",
+			Help: "How many request body bytes have been spooled by gitlab-workhorse before proxying.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(spooledRequests)
+	prometheus.MustRegister(spooledRequestBytes)
+}
+
+type requestLimits struct {
+	pattern     *regexp.Regexp
+	maxSize     int64
+	readTimeout time.Duration
+}
+
+type requestSpooler struct {
+	next        http.Handler
+	memoryLimit int64
+	defaults    requestLimits
+	routes      []requestLimits
+}
+
+// SpoolRequests reads the request body completely before handing the
+// request to h. Bodies up to the memory limit in cfg are kept in memory,
+// larger bodies spill over into a tempfile. If cfg is nil h is returned
+// unchanged.
+func SpoolRequests(h http.Handler, cfg *config.RequestSpoolingConfig) http.Handler {
+	if cfg == nil {
+		return h
+	}
+
+	s := &requestSpooler{
+		next:        h,
+		memoryLimit: cfg.MemoryLimit,
+		defaults: requestLimits{
+			maxSize:     cfg.MaxSize,
+			readTimeout: durationOrDefault(cfg.ReadTimeout, DefaultReadTimeout),
+		},
+	}
+	if s.memoryLimit <= 0 {
+		s.memoryLimit = DefaultMemoryLimit
+	}
+	if s.defaults.maxSize <= 0 {
+		s.defaults.maxSize = DefaultMaxSize
+	}
+
+	for _, route := range cfg.Routes {
+		limits := requestLimits{
+			pattern:     regexpMustCompile(route.Pattern),
+			maxSize:     route.MaxSize,
+			readTimeout: durationOrDefault(route.ReadTimeout, s.defaults.readTimeout),
+		}
+		if limits.maxSize <= 0 {
+			limits.maxSize = s.defaults.maxSize
+		}
+		s.routes = append(s.routes, limits)
+	}
+
+	return s
+}
+
+func (s *requestSpooler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil || r.ContentLength == 0 {
+		s.next.ServeHTTP(w, r)
+		return
+	}
+
+	limits := s.limitsFor(r)
+	if r.ContentLength > limits.maxSize {
+		spooledRequests.WithLabelValues("too_large").Inc()
+		helper.RequestEntityTooLarge(w, r, fmt.Errorf("SpoolRequests: Content-Length %d exceeds %d bytes", r.ContentLength, limits.maxSize))
+		return
+	}
+
+	spool, conn, err := s.spoolBody(w, r, limits)
+	switch err {
+	case nil:
+	case errRequestTooLarge:
+		spooledRequests.WithLabelValues("too_large").Inc()
+		helper.RequestEntityTooLarge(w, r, fmt.Errorf("SpoolRequests: body exceeds %d bytes", limits.maxSize))
+		return
+	case errReadTimeout:
+		spooledRequests.WithLabelValues("timeout").Inc()
+		if conn != nil {
+			// The HTTP server no longer owns the connection
+			defer conn.Close()
+			io.WriteString(conn, "HTTP/1.1 408 Request Timeout\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		helper.HTTPError(w, r, "Request Timeout", http.StatusRequestTimeout)
+		return
+	default:
+		helper.Fail500(w, r, fmt.Errorf("SpoolRequests: %v", err))
+		return
+	}
+	defer spool.Close()
+
+	if spool.InMemory() {
+		spooledRequests.WithLabelValues("memory").Inc()
+	} else {
+		spooledRequests.WithLabelValues("tempfile").Inc()
+	}
+	spooledRequestBytes.Add(float64(spool.Size()))
+
+	r.Body.Close()
+	r.Body = spool
+	r.ContentLength = spool.Size()
+	r.TransferEncoding = nil
+
+	s.next.ServeHTTP(w, r)
+}
+
+func (s *requestSpooler) limitsFor(r *http.Request) requestLimits {
+	for _, route := range s.routes {
+		if route.pattern.MatchString(r.URL.Path) {
+			return route
+		}
+	}
+
+	return s.defaults
+}
+
+type spoolResult struct {
+	spool *helper.Spool
+	err   error
+}
+
+// spoolBody returns a hijacked connection along with errReadTimeout if it
+// had to take the connection away from the HTTP server to stop reading
+// the body.
+func (s *requestSpooler) spoolBody(w http.ResponseWriter, r *http.Request, limits requestLimits) (*helper.Spool, net.Conn, error) {
+	resultC := make(chan spoolResult, 1)
+	go func() {
+		spool, err := helper.SpoolReader(io.LimitReader(r.Body, limits.maxSize+1), s.memoryLimit)
+		resultC <- spoolResult{spool, err}
+	}()
+
+	timer := time.NewTimer(limits.readTimeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-resultC:
+		if result.err != nil {
+			return nil, nil, result.err
+		}
+		if result.spool.Size() > limits.maxSize {
+			result.spool.Close()
+			return nil, nil, errRequestTooLarge
+		}
+		return result.spool, nil, nil
+
+	case <-timer.C:
+		// Do not let the reader goroutine outlive the request: stop it,
+		// wait for it and release what it spooled
+		conn := abortBodyRead(w, r)
+		if result := <-resultC; result.spool != nil {
+			result.spool.Close()
+		}
+		return nil, conn, errReadTimeout
+	}
+}
+
+// abortBodyRead makes pending and future reads of the body of r fail.
+// Closing the body of a request received by net/http waits for pending
+// reads, so we hijack the connection instead, which aborts them. This
+// needs w to be the ResponseWriter of the server, or to pass Hijack
+// through to it.
+func abortBodyRead(w http.ResponseWriter, r *http.Request) net.Conn {
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.SetReadDeadline(time.Now())
+			return conn
+		}
+	}
+
+	r.Body.Close()
+	return nil
+}
+
+func durationOrDefault(d *config.TomlDuration, defaultDuration time.Duration) time.Duration {
+	if d == nil || d.Duration <= 0 {
+		return defaultDuration
+	}
+
+	return d.Duration
+}
+
+func regexpMustCompile(pattern string) *regexp.Regexp {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Fatalf("regexpMustCompile: %q %v", pattern, err)
+	}
+	return re
+}
@@ -0,0 +1,149 @@
+package spooling
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func echoHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Body.(*helper.Spool); !ok {
+			t.Fatalf("expected spooled request body, got %T", r.Body)
+		}
+		if r.ContentLength < 0 {
+			t.Fatalf("expected known content length, got %d", r.ContentLength)
+		}
+		io.Copy(w, r.Body)
+	})
+}
+
+func TestSpoolRequestsDisabled(t *testing.T) {
+	body := ioutil.NopCloser(strings.NewReader("abcdefgh"))
+	req := httptest.NewRequest("POST", "/api/v4/foo", body)
+	req.ContentLength = -1
+
+	called := false
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if r.Body != body {
+			t.Error("expected the body to be passed on unspooled")
+		}
+		if r.ContentLength != -1 {
+			t.Errorf("expected the body length to stay unknown, got %d", r.ContentLength)
+		}
+	})
+
+	SpoolRequests(h, nil).ServeHTTP(httptest.NewRecorder(), req)
+	if !called {
+		t.Fatal("expected the handler to be called")
+	}
+}
+
+func TestSpoolRequestBody(t *testing.T) {
+	cfg := &config.RequestSpoolingConfig{MemoryLimit: 4, MaxSize: 1024}
+
+	for _, body := range []string{"abc", "abcdefgh"} {
+		// Hide the length of the body to simulate a chunked request
+		req := httptest.NewRequest("POST", "/api/v4/foo", ioutil.NopCloser(strings.NewReader(body)))
+		req.ContentLength = -1
+		w := httptest.NewRecorder()
+
+		SpoolRequests(echoHandler(t), cfg).ServeHTTP(w, req)
+
+		testhelper.AssertResponseCode(t, w, 200)
+		testhelper.AssertResponseBody(t, w, body)
+	}
+}
+
+func TestSpoolRequestTooLarge(t *testing.T) {
+	cfg := &config.RequestSpoolingConfig{
+		MaxSize: 1024,
+		Routes: []config.RequestSpoolingRoute{
+			{Pattern: `^/api/v4/small`, MaxSize: 4},
+		},
+	}
+	h := SpoolRequests(echoHandler(t), cfg)
+
+	req := httptest.NewRequest("POST", "/api/v4/small", bytes.NewReader([]byte("abcdefgh")))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	testhelper.AssertResponseCode(t, w, 413)
+
+	req = httptest.NewRequest("POST", "/api/v4/small", bytes.NewReader([]byte("abcdefgh")))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	testhelper.AssertResponseCode(t, w, 413)
+
+	req = httptest.NewRequest("POST", "/api/v4/large", bytes.NewReader([]byte("abcdefgh")))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	testhelper.AssertResponseCode(t, w, 200)
+}
+
+func TestSpoolRequestReadTimeout(t *testing.T) {
+	cfg := &config.RequestSpoolingConfig{
+		ReadTimeout: &config.TomlDuration{Duration: time.Millisecond},
+	}
+
+	body, client := io.Pipe()
+	req := httptest.NewRequest("POST", "/api/v4/foo", body)
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	SpoolRequests(echoHandler(t), cfg).ServeHTTP(w, req)
+
+	testhelper.AssertResponseCode(t, w, 408)
+	if _, err := client.Write([]byte("abc")); err != io.ErrClosedPipe {
+		t.Fatalf("expected the body to be closed, got %v", err)
+	}
+}
+
+func TestSpoolRequestReadTimeoutServer(t *testing.T) {
+	cfg := &config.RequestSpoolingConfig{
+		ReadTimeout: &config.TomlDuration{Duration: 10 * time.Millisecond},
+	}
+
+	returned := make(chan struct{})
+	h := SpoolRequests(echoHandler(t), cfg)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		close(returned)
+	}))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send only part of the body and keep the connection open
+	fmt.Fprint(conn, "POST /api/v4/foo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 408 {
+		t.Fatalf("expected status 408, got %d", resp.StatusCode)
+	}
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the handler to return while the client is still connected")
+	}
+}
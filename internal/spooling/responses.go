@@ -0,0 +1,268 @@
+/*
+In this file we spool proxied responses so that the backend can send them
+at full speed, freeing its Unicorn worker, while we serve slow clients from
+the spool.
+*/
+
+package spooling
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
+)
+
+const DefaultResponseMaxSize = 100 * 1024 * 1024
+
+var (
+	spooledResponses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_spooled_responses",
+			Help: "How many proxied responses have been handled by the gitlab-workhorse response spooler, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+	spooledResponseBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_spooled_response_bytes",
+			Help: "How many response body bytes have been spooled by gitlab-workhorse before sending them to the client.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(spooledResponses)
+	prometheus.MustRegister(spooledResponseBytes)
+}
+
+type responseSpooler struct {
+	next        http.Handler
+	memoryLimit int64
+	maxSize     int64
+	bypass      []*regexp.Regexp
+}
+
+// SpoolResponses reads the response generated by h into memory or a
+// tempfile before sending it to the client. Responses that are streamed
+// on purpose, senddata and sendfile responses, and responses larger than
+// the configured maximum size are passed through. If cfg is nil h is
+// returned unchanged.
+func SpoolResponses(h http.Handler, cfg *config.ResponseSpoolingConfig) http.Handler {
+	if cfg == nil {
+		return h
+	}
+
+	s := &responseSpooler{
+		next:        h,
+		memoryLimit: cfg.MemoryLimit,
+		maxSize:     cfg.MaxSize,
+	}
+	if s.memoryLimit <= 0 {
+		s.memoryLimit = DefaultMemoryLimit
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = DefaultResponseMaxSize
+	}
+
+	for _, pattern := range cfg.Bypass {
+		s.bypass = append(s.bypass, regexpMustCompile(pattern))
+	}
+
+	return s
+}
+
+func (s *responseSpooler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "HEAD" || s.isBypassed(r) {
+		spooledResponses.WithLabelValues("bypass").Inc()
+		s.next.ServeHTTP(w, r)
+		return
+	}
+
+	sw := &spoolingResponseWriter{
+		rw:          w,
+		memoryLimit: s.memoryLimit,
+		maxSize:     s.maxSize,
+	}
+	s.next.ServeHTTP(sw, r)
+	sw.finish(r)
+}
+
+func (s *responseSpooler) isBypassed(r *http.Request) bool {
+	for _, pattern := range s.bypass {
+		if pattern.MatchString(r.URL.Path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type spoolingResponseWriter struct {
+	rw          http.ResponseWriter
+	status      int
+	streaming   bool
+	spool       *helper.Spool
+	memoryLimit int64
+	maxSize     int64
+
+	// The first error from the spool. The backend may ignore it, so we
+	// check it again when the backend is done.
+	err error
+}
+
+func (s *spoolingResponseWriter) Header() http.Header {
+	return s.rw.Header()
+}
+
+func (s *spoolingResponseWriter) WriteHeader(status int) {
+	if s.status != 0 {
+		return
+	}
+
+	s.status = status
+	if mustStream(s.Header(), status) {
+		spooledResponses.WithLabelValues("bypass").Inc()
+		s.streaming = true
+		s.rw.WriteHeader(status)
+		return
+	}
+
+	s.spool = helper.NewSpool(s.memoryLimit)
+}
+
+func (s *spoolingResponseWriter) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	if !s.streaming && s.spool.Size()+int64(len(data)) > s.maxSize {
+		spooledResponses.WithLabelValues("too_large").Inc()
+		if err := s.startStreaming(); err != nil {
+			s.err = err
+			return 0, err
+		}
+	}
+
+	if s.streaming {
+		return s.rw.Write(data)
+	}
+
+	n, err := s.spool.Write(data)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+func (s *spoolingResponseWriter) Flush() {
+	if !s.streaming {
+		return
+	}
+
+	if flusher, ok := s.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// startStreaming sends what we have spooled so far to the client and
+// passes all further writes straight through.
+func (s *spoolingResponseWriter) startStreaming() error {
+	defer s.spool.Close()
+
+	if err := s.spool.Rewind(); err != nil {
+		return err
+	}
+
+	s.streaming = true
+	s.rw.WriteHeader(s.status)
+	_, err := io.Copy(s.rw, s.spool)
+	return err
+}
+
+func (s *spoolingResponseWriter) finish(r *http.Request) {
+	if s.status == 0 {
+		return
+	}
+
+	if s.err != nil {
+		err := fmt.Errorf("SpoolResponses: spool response: %v", s.err)
+		if s.streaming {
+			// The client already has the status and part of the body, so
+			// all we can do is to break the connection
+			helper.LogError(r, err)
+			panic(http.ErrAbortHandler)
+		}
+
+		s.spool.Close()
+		s.Header().Del("Content-Length")
+		helper.Fail500(s.rw, r, err)
+		return
+	}
+
+	if s.streaming {
+		return
+	}
+	defer s.spool.Close()
+
+	if err := s.spool.Rewind(); err != nil {
+		helper.Fail500(s.rw, r, fmt.Errorf("SpoolResponses: rewind spool: %v", err))
+		return
+	}
+
+	if s.spool.InMemory() {
+		spooledResponses.WithLabelValues("memory").Inc()
+	} else {
+		spooledResponses.WithLabelValues("tempfile").Inc()
+	}
+	spooledResponseBytes.Add(float64(s.spool.Size()))
+
+	if bodyAllowedForStatus(s.status) {
+		s.Header().Set("Content-Length", strconv.FormatInt(s.spool.Size(), 10))
+	}
+	s.rw.WriteHeader(s.status)
+
+	if _, err := io.Copy(s.rw, s.spool); err != nil {
+		helper.LogError(r, fmt.Errorf("SpoolResponses: copy spooled response: %v", err))
+	}
+}
+
+// mustStream tells whether a response must reach the client as it is
+// being generated, or be seen unmodified by the senddata and sendfile
+// middlewares.
+func mustStream(header http.Header, status int) bool {
+	switch {
+	case status == http.StatusSwitchingProtocols:
+		return true
+	case header.Get(senddata.HeaderKey) != "", header.Get(sendfile.HeaderKey) != "":
+		return true
+	case header.Get(helper.NginxResponseBufferHeader) == "no":
+		return true
+	case helper.IsContentType("text/event-stream", header.Get("Content-Type")):
+		return true
+	}
+
+	return false
+}
+
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
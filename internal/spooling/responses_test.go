@@ -0,0 +1,136 @@
+package spooling
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+// serveSpooled reports whether the backend output reached the client
+// before the backend handler returned.
+func serveSpooled(cfg *config.ResponseSpoolingConfig, path string, backend http.HandlerFunc) (w *httptest.ResponseRecorder, streamed bool) {
+	w = httptest.NewRecorder()
+	h := SpoolResponses(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		backend(rw, r)
+		streamed = w.Body.Len() > 0
+	}), cfg)
+
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w, streamed
+}
+
+func TestSpoolResponse(t *testing.T) {
+	cfg := &config.ResponseSpoolingConfig{MemoryLimit: 4}
+	for _, body := range []string{"abc", "abcdefgh"} {
+		w, streamed := serveSpooled(cfg, "/foo", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(201)
+			fmt.Fprint(w, body)
+		})
+
+		if streamed {
+			t.Fatal("expected response to be spooled")
+		}
+		testhelper.AssertResponseCode(t, w, 201)
+		testhelper.AssertResponseBody(t, w, body)
+		testhelper.AssertResponseWriterHeader(t, w, "Content-Length", fmt.Sprintf("%d", len(body)))
+	}
+}
+
+func TestSpoolResponseTooLarge(t *testing.T) {
+	cfg := &config.ResponseSpoolingConfig{MaxSize: 4}
+	w, streamed := serveSpooled(cfg, "/foo", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "abc")
+		fmt.Fprint(w, "defgh")
+	})
+
+	if !streamed {
+		t.Fatal("expected response to be streamed")
+	}
+	testhelper.AssertResponseCode(t, w, 200)
+	testhelper.AssertResponseBody(t, w, "abcdefgh")
+}
+
+func TestSpoolResponseSpoolFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spooling-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The spool cannot create its tempfile in a directory that is gone
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+
+	cfg := &config.ResponseSpoolingConfig{MemoryLimit: 1}
+	w, _ := serveSpooled(cfg, "/foo", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", "3")
+		w.WriteHeader(201)
+		// Like many handlers we ignore the error
+		fmt.Fprint(w, "abc")
+	})
+
+	testhelper.AssertResponseCode(t, w, 500)
+	if w.Header().Get("Content-Length") == "3" {
+		t.Fatal("expected the Content-Length of the backend to be dropped")
+	}
+}
+
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingResponseWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("client went away")
+}
+
+func TestSpoolResponseFailureWhileStreaming(t *testing.T) {
+	h := SpoolResponses(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "abc")
+		fmt.Fprint(w, "defgh")
+	}), &config.ResponseSpoolingConfig{MaxSize: 4})
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("expected panic with %v, got %v", http.ErrAbortHandler, p)
+		}
+	}()
+	h.ServeHTTP(failingResponseWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/foo", nil))
+}
+
+func TestSpoolResponseBypass(t *testing.T) {
+	cfg := &config.ResponseSpoolingConfig{Bypass: []string{`^/stream`}}
+
+	testCases := []struct {
+		desc    string
+		path    string
+		headers map[string]string
+	}{
+		{"bypass pattern", "/stream", nil},
+		{"senddata", "/foo", map[string]string{senddata.HeaderKey: "git-blob:foo"}},
+		{"sendfile", "/foo", map[string]string{"X-Sendfile": "/foo"}},
+		{"unbuffered", "/foo", map[string]string{"X-Accel-Buffering": "no"}},
+		{"event stream", "/foo", map[string]string{"Content-Type": "text/event-stream"}},
+	}
+
+	for _, tc := range testCases {
+		w, streamed := serveSpooled(cfg, tc.path, func(w http.ResponseWriter, _ *http.Request) {
+			for k, v := range tc.headers {
+				w.Header().Set(k, v)
+			}
+			fmt.Fprint(w, "ok")
+		})
+
+		if !streamed {
+			t.Errorf("%s: expected response to be streamed", tc.desc)
+		}
+		testhelper.AssertResponseBody(t, w, "ok")
+	}
+}
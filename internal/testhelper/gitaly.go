@@ -1,11 +1,13 @@
 package testhelper
 
 import (
+	"crypto/sha1"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 
@@ -24,10 +26,26 @@ type GitalyTestServer struct {
 var (
 	GitalyInfoRefsResponseMock    = strings.Repeat("Mock Gitaly InfoRefsResponse data", 100000)
 	GitalyGetBlobResponseMock     = strings.Repeat("Mock Gitaly GetBlobResponse data", 100000)
+	GitalyCommitDiffPatchMock     = "@@ -1 +1 @@\n" + strings.Repeat("+Mock Gitaly CommitDiffResponse data\n", 1000)
 	GitalyReceivePackResponseMock []byte
 	GitalyUploadPackResponseMock  []byte
 )
 
+type GitalyTreeEntryMock struct {
+	Path string
+	Mode int32
+	Data string
+}
+
+// GitalyTreeMock holds the files of the repository the CommitService mocks
+// serve. Directories are derived from the paths.
+var GitalyTreeMock = []GitalyTreeEntryMock{
+	{Path: "README.md", Mode: 0100644, Data: "Mock Gitaly README\n"},
+	{Path: "doc/index.md", Mode: 0100644, Data: strings.Repeat("Mock Gitaly TreeEntryResponse data\n", 100)},
+	{Path: "doc/api/tree.md", Mode: 0100644, Data: "Mock Gitaly tree API\n"},
+	{Path: "run.sh", Mode: 0100755, Data: "#!/bin/sh\n"},
+}
+
 func init() {
 	var err error
 	if GitalyReceivePackResponseMock, err = ioutil.ReadFile(path.Join(RootDir(), "testdata/receive-pack-fixture.txt")); err != nil {
@@ -173,6 +191,134 @@ func (s *GitalyTestServer) CommitIsAncestor(ctx context.Context, in *pb.CommitIs
 	return nil, nil
 }
 
+func (s *GitalyTestServer) TreeEntry(in *pb.TreeEntryRequest, stream pb.CommitService_TreeEntryServer) error {
+	s.WaitGroup.Add(1)
+	defer s.WaitGroup.Done()
+
+	if err := validateRepository(in.GetRepository()); err != nil {
+		return err
+	}
+
+	entryPath := string(in.GetPath())
+	if gitalyTreeMockDirs()[entryPath] {
+		return stream.Send(&pb.TreeEntryResponse{Type: pb.TreeEntryResponse_TREE, Oid: mockOid(entryPath), Mode: 040000})
+	}
+
+	for _, mock := range GitalyTreeMock {
+		if mock.Path != entryPath {
+			continue
+		}
+
+		data := []byte(mock.Data)
+		if limit := in.GetLimit(); limit > 0 && limit < int64(len(data)) {
+			data = data[:limit]
+		}
+
+		response := &pb.TreeEntryResponse{
+			Type: pb.TreeEntryResponse_BLOB,
+			Oid:  mockOid(mock.Data),
+			Size: int64(len(mock.Data)),
+			Mode: mock.Mode,
+		}
+		_, err := sendBytes(data, 100, func(p []byte) error {
+			response.Data = p
+
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+
+			// Use a new response so we don't send other fields (Size, ...) over and over
+			response = &pb.TreeEntryResponse{}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return s.finalError()
+	}
+
+	// Gitaly answers with an empty entry for paths that do not exist
+	return stream.Send(&pb.TreeEntryResponse{})
+}
+
+func (s *GitalyTestServer) GetTreeEntries(in *pb.GetTreeEntriesRequest, stream pb.CommitService_GetTreeEntriesServer) error {
+	s.WaitGroup.Add(1)
+	defer s.WaitGroup.Done()
+
+	if err := validateRepository(in.GetRepository()); err != nil {
+		return err
+	}
+
+	dir := path.Clean(string(in.GetPath()))
+	var entries []*pb.TreeEntry
+	for subDir := range gitalyTreeMockDirs() {
+		if path.Dir(subDir) == dir {
+			entries = append(entries, &pb.TreeEntry{Oid: mockOid(subDir), Path: []byte(subDir), Type: pb.TreeEntry_TREE, Mode: 040000})
+		}
+	}
+	for _, mock := range GitalyTreeMock {
+		if path.Dir(mock.Path) == dir {
+			entries = append(entries, &pb.TreeEntry{Oid: mockOid(mock.Data), Path: []byte(mock.Path), Type: pb.TreeEntry_BLOB, Mode: mock.Mode})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return string(entries[i].Path) < string(entries[j].Path) })
+
+	// Send one entry per message to exercise the client's batching
+	for _, entry := range entries {
+		if err := stream.Send(&pb.GetTreeEntriesResponse{Entries: []*pb.TreeEntry{entry}}); err != nil {
+			return err
+		}
+	}
+
+	return s.finalError()
+}
+
+func (s *GitalyTestServer) CommitsBetween(in *pb.CommitsBetweenRequest, stream pb.CommitService_CommitsBetweenServer) error {
+	return nil
+}
+
+func (s *GitalyTestServer) CountCommits(ctx context.Context, in *pb.CountCommitsRequest) (*pb.CountCommitsResponse, error) {
+	return nil, nil
+}
+
+func (s *GitalyTestServer) ListFiles(in *pb.ListFilesRequest, stream pb.CommitService_ListFilesServer) error {
+	return nil
+}
+
+func (s *GitalyTestServer) FindCommit(ctx context.Context, in *pb.FindCommitRequest) (*pb.FindCommitResponse, error) {
+	return nil, nil
+}
+
+func (s *GitalyTestServer) CommitStats(ctx context.Context, in *pb.CommitStatsRequest) (*pb.CommitStatsResponse, error) {
+	return nil, nil
+}
+
+func (s *GitalyTestServer) FindAllCommits(in *pb.FindAllCommitsRequest, stream pb.CommitService_FindAllCommitsServer) error {
+	return nil
+}
+
+func (s *GitalyTestServer) FindCommits(in *pb.FindCommitsRequest, stream pb.CommitService_FindCommitsServer) error {
+	return nil
+}
+
+func (s *GitalyTestServer) CommitLanguages(ctx context.Context, in *pb.CommitLanguagesRequest) (*pb.CommitLanguagesResponse, error) {
+	return nil, nil
+}
+
+func (s *GitalyTestServer) RawBlame(in *pb.RawBlameRequest, stream pb.CommitService_RawBlameServer) error {
+	return nil
+}
+
+func (s *GitalyTestServer) LastCommitForPath(ctx context.Context, in *pb.LastCommitForPathRequest) (*pb.LastCommitForPathResponse, error) {
+	return nil, nil
+}
+
+func (s *GitalyTestServer) CommitsByMessage(in *pb.CommitsByMessageRequest, stream pb.CommitService_CommitsByMessageServer) error {
+	return nil
+}
+
 func (s *GitalyTestServer) GetBlob(in *pb.GetBlobRequest, stream pb.BlobService_GetBlobServer) error {
 	s.WaitGroup.Add(1)
 	defer s.WaitGroup.Done()
@@ -207,6 +353,52 @@ func (s *GitalyTestServer) GetBlob(in *pb.GetBlobRequest, stream pb.BlobService_
 	return s.finalError()
 }
 
+func (s *GitalyTestServer) CommitDiff(in *pb.CommitDiffRequest, stream pb.DiffService_CommitDiffServer) error {
+	s.WaitGroup.Add(1)
+	defer s.WaitGroup.Done()
+
+	if err := validateRepository(in.GetRepository()); err != nil {
+		return err
+	}
+
+	response := &pb.CommitDiffResponse{
+		FromPath: []byte("README.md"),
+		ToPath:   []byte("README.md"),
+		FromId:   in.GetLeftCommitId(),
+		ToId:     in.GetRightCommitId(),
+		OldMode:  0100644,
+		NewMode:  0100644,
+	}
+	nSends, err := sendBytes([]byte(GitalyCommitDiffPatchMock), 100, func(p []byte) error {
+		response.RawPatchData = p
+
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+
+		// The header fields only go with the first chunk of a patch
+		response = &pb.CommitDiffResponse{}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if nSends <= 1 {
+		panic("should have sent more than one message")
+	}
+
+	if err := stream.Send(&pb.CommitDiffResponse{EndOfPatch: true}); err != nil {
+		return err
+	}
+
+	return s.finalError()
+}
+
+func (s *GitalyTestServer) CommitDelta(in *pb.CommitDeltaRequest, stream pb.DiffService_CommitDeltaServer) error {
+	return nil
+}
+
 // sendBytes returns the number of times the 'sender' function was called and an error.
 func sendBytes(data []byte, chunkSize int, sender func([]byte) error) (int, error) {
 	i := 0
@@ -233,6 +425,21 @@ func (s *GitalyTestServer) finalError() error {
 	return nil
 }
 
+// gitalyTreeMockDirs returns the directories of GitalyTreeMock
+func gitalyTreeMockDirs() map[string]bool {
+	dirs := make(map[string]bool)
+	for _, mock := range GitalyTreeMock {
+		for dir := path.Dir(mock.Path); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	return dirs
+}
+
+func mockOid(data string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(data)))
+}
+
 func validateRepository(repo *pb.Repository) error {
 	if len(repo.GetStorageName()) == 0 {
 		return fmt.Errorf("missing storage_name: %v", repo)
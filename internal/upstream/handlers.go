@@ -1,39 +1,215 @@
 package upstream
 
 import (
+	"bufio"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
-func contentEncodingHandler(h http.Handler) http.Handler {
+// DefaultMaxDecompressedSize is the largest request body we are willing to
+// decompress unless configured otherwise.
+const DefaultMaxDecompressedSize = 4 * 1024 * 1024 * 1024
+
+// zstdMaxWindowSize bounds the memory a zstd request body may make us
+// allocate. The size of the window is chosen by the client; 'zstd' uses at
+// most 8MB unless told to use long range matching.
+const zstdMaxWindowSize = 64 * 1024 * 1024
+
+var errDecompressedTooLarge = errors.New("decompressed request body too large")
+
+type contentDecoder func(r io.Reader, maxSize int64) (io.ReadCloser, error)
+
+var contentDecoders = map[string]contentDecoder{
+	"gzip":    newGzipReader,
+	"x-gzip":  newGzipReader,
+	"deflate": newDeflateReader,
+	"br":      newBrotliReader,
+	"zstd":    newZstdReader,
+}
+
+func contentEncodingHandler(h http.Handler, maxDecompressedSize int64) http.Handler {
+	if maxDecompressedSize <= 0 {
+		maxDecompressedSize = DefaultMaxDecompressedSize
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var body io.ReadCloser
-		var err error
-
-		// The client request body may have been gzipped.
-		contentEncoding := r.Header.Get("Content-Encoding")
-		switch contentEncoding {
-		case "":
-			body = r.Body
-		case "gzip":
-			body, err = gzip.NewReader(r.Body)
-		default:
-			err = fmt.Errorf("unsupported content encoding: %s", contentEncoding)
+		// The client request body may have been compressed.
+		contentEncoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if contentEncoding == "" || contentEncoding == "identity" {
+			r.Header.Del("Content-Encoding")
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		newDecoder, ok := contentDecoders[contentEncoding]
+		if !ok {
+			helper.LogError(r, fmt.Errorf("contentEncodingHandler: unsupported content encoding: %s", contentEncoding))
+			helper.HTTPError(w, r, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
 		}
 
+		decoder, err := newDecoder(r.Body, maxDecompressedSize)
 		if err != nil {
 			helper.Fail500(w, r, fmt.Errorf("contentEncodingHandler: %v", err))
 			return
 		}
-		defer body.Close()
+		defer decoder.Close()
 
+		body := &decompressedBody{reader: decoder, remaining: maxDecompressedSize}
 		r.Body = body
+		r.ContentLength = -1
 		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
 
-		h.ServeHTTP(w, r)
+		h.ServeHTTP(&decompressedBodyResponseWriter{rw: w, r: r, body: body}, r)
 	})
 }
+
+func newGzipReader(r io.Reader, _ int64) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// HTTP 'deflate' is supposed to be zlib-wrapped, but some clients send a
+// raw deflate stream. Look at the first two bytes to tell them apart.
+func newDeflateReader(r io.Reader, _ int64) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+
+	return flate.NewReader(br), nil
+}
+
+func newBrotliReader(r io.Reader, _ int64) (io.ReadCloser, error) {
+	return ioutil.NopCloser(brotli.NewReader(r)), nil
+}
+
+// The decompressed size is limited by decompressedBody, like for the other
+// encodings. In a stream, WithDecoderMaxMemory only limits the window.
+func newZstdReader(r io.Reader, _ int64) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(zstdMaxWindowSize))
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdReader{decoder.IOReadCloser()}, nil
+}
+
+type zstdReader struct{ io.ReadCloser }
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	n, err := z.ReadCloser.Read(p)
+	if err == zstd.ErrWindowSizeExceeded || err == zstd.ErrDecoderSizeExceeded {
+		err = errDecompressedTooLarge
+	}
+	return n, err
+}
+
+// decompressedBody stops reading once more than the allowed number of bytes
+// have been decompressed.
+type decompressedBody struct {
+	reader    io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (d *decompressedBody) Read(p []byte) (int, error) {
+	if d.remaining <= 0 {
+		// Make sure the body really is larger than the limit
+		var probe [1]byte
+		if n, err := d.reader.Read(probe[:]); n == 0 {
+			return 0, err
+		}
+
+		d.exceeded = true
+		return 0, errDecompressedTooLarge
+	}
+
+	if int64(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+
+	n, err := d.reader.Read(p)
+	d.remaining -= int64(n)
+	if err == errDecompressedTooLarge {
+		d.exceeded = true
+	}
+	return n, err
+}
+
+func (d *decompressedBody) Close() error {
+	return d.reader.Close()
+}
+
+// decompressedBodyResponseWriter turns the error response of a handler
+// that choked on an oversized decompressed body into a 413 response.
+type decompressedBodyResponseWriter struct {
+	rw       http.ResponseWriter
+	r        *http.Request
+	body     *decompressedBody
+	status   int
+	hijacked bool
+}
+
+func (d *decompressedBodyResponseWriter) Header() http.Header {
+	return d.rw.Header()
+}
+
+func (d *decompressedBodyResponseWriter) Write(data []byte) (int, error) {
+	if d.status == 0 {
+		d.WriteHeader(http.StatusOK)
+	}
+	if d.hijacked {
+		return len(data), nil
+	}
+
+	return d.rw.Write(data)
+}
+
+func (d *decompressedBodyResponseWriter) WriteHeader(status int) {
+	if d.status != 0 {
+		return
+	}
+
+	d.status = status
+	if d.body.exceeded && status >= 400 {
+		d.hijacked = true
+		d.Header().Del("Content-Length")
+		helper.RequestEntityTooLarge(d.rw, d.r, fmt.Errorf("contentEncodingHandler: %v", errDecompressedTooLarge))
+		return
+	}
+
+	d.rw.WriteHeader(status)
+}
+
+// Flush lets streaming handlers like git-upload-pack and git-receive-pack
+// send progress while they still read the request body.
+func (d *decompressedBodyResponseWriter) Flush() {
+	if d.status == 0 {
+		d.WriteHeader(http.StatusOK)
+	}
+	if d.hijacked {
+		return
+	}
+
+	if flusher, ok := d.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
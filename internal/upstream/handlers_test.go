@@ -2,14 +2,35 @@ package upstream
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	pb "gitlab.com/gitlab-org/gitaly-proto/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/badgateway"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
 )
 
@@ -30,13 +51,17 @@ func TestGzipEncoding(t *testing.T) {
 	req.Header.Set("Content-Encoding", "gzip")
 
 	contentEncodingHandler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
-		if _, ok := r.Body.(*gzip.Reader); !ok {
-			t.Fatal("Expected gzip reader for body, but it's:", reflect.TypeOf(r.Body))
+		body, ok := r.Body.(*decompressedBody)
+		if !ok {
+			t.Fatal("Expected decompressed body, but it's:", reflect.TypeOf(r.Body))
+		}
+		if _, ok := body.reader.(*gzip.Reader); !ok {
+			t.Fatal("Expected gzip reader for body, but it's:", reflect.TypeOf(body.reader))
 		}
 		if r.Header.Get("Content-Encoding") != "" {
 			t.Fatal("Content-Encoding should be deleted")
 		}
-	})).ServeHTTP(resp, req)
+	}), 0).ServeHTTP(resp, req)
 
 	testhelper.AssertResponseCode(t, resp, 200)
 }
@@ -60,7 +85,7 @@ func TestNoEncoding(t *testing.T) {
 		if r.Header.Get("Content-Encoding") != "" {
 			t.Fatal("Content-Encoding should be deleted")
 		}
-	})).ServeHTTP(resp, req)
+	}), 0).ServeHTTP(resp, req)
 
 	testhelper.AssertResponseCode(t, resp, 200)
 }
@@ -76,7 +101,208 @@ func TestInvalidEncoding(t *testing.T) {
 
 	contentEncodingHandler(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
 		t.Fatal("it shouldn't be executed")
-	})).ServeHTTP(resp, req)
+	}), 0).ServeHTTP(resp, req)
+
+	testhelper.AssertResponseCode(t, resp, 415)
+}
+
+func compressedBody(t *testing.T, encoding string, data []byte) *bytes.Buffer {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "deflate":
+		w = zlib.NewWriter(&b)
+	case "raw-deflate":
+		w, err = flate.NewWriter(&b, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&b)
+	case "zstd":
+		w, err = zstd.NewWriter(&b)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &b
+}
+
+func TestDecodeContentEncodings(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate", "br", "zstd"} {
+		resp := httptest.NewRecorder()
+
+		req, err := http.NewRequest("POST", "http://address/test", compressedBody(t, encoding, []byte("test")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", strings.TrimPrefix(encoding, "raw-"))
+
+		contentEncodingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		}), 0).ServeHTTP(resp, req)
 
-	testhelper.AssertResponseCode(t, resp, 500)
+		testhelper.AssertResponseCode(t, resp, 200)
+		testhelper.AssertResponseBody(t, resp, "test")
+	}
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("0"), 1024)
+
+	for _, encoding := range []string{"gzip", "deflate", "br", "zstd"} {
+		resp := httptest.NewRecorder()
+
+		req, err := http.NewRequest("POST", "http://address/test", compressedBody(t, encoding, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", encoding)
+
+		contentEncodingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := ioutil.ReadAll(r.Body); err != nil {
+				helper.Fail500(w, r, err)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		}), 100).ServeHTTP(resp, req)
+
+		testhelper.AssertResponseCode(t, resp, 413)
+	}
+}
+
+func TestZstdWindowSizeLimit(t *testing.T) {
+	// A zstd frame that asks for a 128MB window: no single segment flag,
+	// window descriptor 2^(10+17), then a last raw block holding "a"
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 17 << 3, 0x09, 0x00, 0x00, 'a'}
+
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "http://address/test", bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "zstd")
+
+	contentEncodingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			helper.Fail500(w, r, err)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}), 0).ServeHTTP(resp, req)
+
+	testhelper.AssertResponseCode(t, resp, 413)
+}
+
+func pktLine(s string) string {
+	if s == "" {
+		return "0000"
+	}
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func startUploadPackGitalyServer(t *testing.T, dir string) string {
+	socketPath := path.Join(dir, "gitaly.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	pb.RegisterSmartHTTPServiceServer(server, testhelper.NewGitalyServer(codes.OK))
+	go server.Serve(listener)
+
+	return "unix://" + socketPath
+}
+
+func TestGzipUploadPackQueueProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-pack-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repoPath := path.Join(dir, "repo.git")
+	if err := os.MkdirAll(path.Join(repoPath, "objects"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	authResponse, err := json.Marshal(&api.Response{
+		RepoPath:     repoPath,
+		GitalyServer: gitaly.Server{Address: startUploadPackGitalyServer(t, dir)},
+		Repository:   pb.Repository{StorageName: "default", RelativePath: "foo/bar.git"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rails := testhelper.TestServerWithHandler(nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", api.ResponseContentType)
+		w.Write(authResponse)
+	})
+	defer rails.Close()
+
+	railsURL := helper.URLMustParse(rails.URL)
+	testhelper.ConfigureSecret()
+	apiClient := api.NewAPI(railsURL, "123", badgateway.TestRoundTripper(railsURL))
+
+	queue := queueing.NewQueue("test_gzip_upload_pack_progress", 1, 1, 10*time.Second)
+	if err := queue.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := httptest.NewServer(contentEncodingHandler(git.UploadPack(apiClient, nil, queue), 0))
+	defer ws.Close()
+
+	want := "want " + strings.Repeat("a", 40) + " multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.17.0\n"
+	body := compressedBody(t, "gzip", []byte(pktLine(want)+pktLine("")+pktLine("done\n")))
+	req, err := http.NewRequest("POST", ws.URL+"/group/project.git/git-upload-pack", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		queue.Release()
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	progress := "0008NAK\n" + pktLine("\x02waiting for a free slot (position 1)...\r")
+	received := make(chan string, 1)
+	go func() {
+		buf := make([]byte, len(progress))
+		n, _ := io.ReadFull(resp.Body, buf)
+		received <- string(buf[:n])
+	}()
+
+	// The request is still queued, so the progress must have been flushed
+	select {
+	case data := <-received:
+		if data != progress {
+			t.Errorf("expected progress %q, got %q", progress, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("progress did not arrive while the request was queued")
+	}
+
+	queue.Release()
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Gitaly mock echoes the request after the repository
+	if !strings.Contains(string(rest), "default\x00foo/bar.git\x00"+pktLine(want)) {
+		t.Fatalf("expected the pack after the progress, got %q", rest)
+	}
 }
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"log"
 	"net/http"
 	"path"
 	"regexp"
@@ -20,6 +21,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/spooling"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/staticpages"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/terminal"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
@@ -96,6 +98,15 @@ func isContentType(contentType string) func(*http.Request) bool {
 	}
 }
 
+// The 'dumb' Git HTTP protocol does not name a service
+func isDumbInfoRefs(r *http.Request) bool {
+	return r.URL.Query().Get("service") == ""
+}
+
+func (u *Upstream) dumbHTTPEnabled(*http.Request) bool {
+	return u.GitDumbHTTP
+}
+
 func (ro *routeEntry) isMatch(cleanedPath string, req *http.Request) bool {
 	if ro.method != "" && req.Method != ro.method {
 		return false
@@ -126,36 +137,57 @@ func (u *Upstream) configureRoutes() {
 		u.Version,
 		u.RoundTripper,
 	)
+	if u.APIAuthorizationCacheTTL > 0 {
+		api.AuthorizationCache = apipkg.NewAuthorizationCache(u.APIAuthorizationCacheTTL)
+	}
+	uploadPackCache, err := git.NewUploadPackCache(u.UploadPackCache)
+	if err != nil {
+		log.Fatal(err)
+	}
+	infoRefsCache := git.NewInfoRefsCache(u.InfoRefsCache, u.Redis != nil)
+	if infoRefsCache != nil && u.Redis != nil {
+		redis.ListenKeyPrefix(git.InfoRefsNotificationPrefix, infoRefsCache.HandleNotification)
+	}
 	static := &staticpages.Static{u.DocumentRoot}
 	proxy := senddata.SendData(
 		sendfile.SendFile(
 			apipkg.Block(
-				proxypkg.NewProxy(
-					u.Backend,
-					u.Version,
-					u.RoundTripper,
+				spooling.SpoolResponses(
+					proxypkg.NewProxy(
+						u.Backend,
+						u.Version,
+						u.RoundTripper,
+					),
+					u.ResponseSpooling,
 				))),
 		git.SendArchive,
+		git.SendBundle,
 		git.SendBlob,
+		git.SendBlobs,
+		git.SendTree,
 		git.SendDiff,
 		git.SendPatch,
 		artifacts.SendEntry,
 	)
 
+	spooledProxy := spooling.SpoolRequests(proxy, u.RequestSpooling)
 	uploadAccelerateProxy := upload.Accelerate(path.Join(u.DocumentRoot, "uploads/tmp"), proxy)
 	ciAPIProxyQueue := queueing.QueueRequests("ci_api_job_requests", uploadAccelerateProxy, u.APILimit, u.APIQueueLimit, u.APIQueueTimeout)
+	uploadPackQueue := queueing.NewQueue("git_upload_pack", u.UploadPackLimit, u.UploadPackQueueLimit, u.UploadPackQueueTimeout)
 	ciAPILongPolling := builds.RegisterHandler(ciAPIProxyQueue, redis.WatchKey, u.APICILongPollingDuration)
 
 	u.Routes = []routeEntry{
 		// Git Clone
-		route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api)),
-		route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api)), isContentType("application/x-git-upload-pack-request")),
-		route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api)), isContentType("application/x-git-receive-pack-request")),
+		route("GET", gitProjectPattern+`info/refs\z`, git.DumbHTTP(api), u.dumbHTTPEnabled, isDumbInfoRefs),
+		route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api, infoRefsCache)),
+		route("GET", gitProjectPattern+`(HEAD|objects/info/packs|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(pack|idx))\z`, git.DumbHTTP(api), u.dumbHTTPEnabled),
+		route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api, uploadPackCache, uploadPackQueue), u.MaxDecompressedSize), isContentType("application/x-git-upload-pack-request")),
+		route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api, u.MaxPushSize, infoRefsCache), u.MaxDecompressedSize), isContentType("application/x-git-receive-pack-request")),
 		route("PUT", gitProjectPattern+`gitlab-lfs/objects/([0-9a-f]{64})/([0-9]+)\z`, lfs.PutStore(api, proxy), isContentType("application/octet-stream")),
 
 		// CI Artifacts
-		route("POST", apiPattern+`v4/jobs/[0-9]+/artifacts\z`, contentEncodingHandler(artifacts.UploadArtifacts(api, proxy))),
-		route("POST", ciAPIPattern+`v1/builds/[0-9]+/artifacts\z`, contentEncodingHandler(artifacts.UploadArtifacts(api, proxy))),
+		route("POST", apiPattern+`v4/jobs/[0-9]+/artifacts\z`, contentEncodingHandler(artifacts.UploadArtifacts(api, proxy), u.MaxDecompressedSize)),
+		route("POST", ciAPIPattern+`v1/builds/[0-9]+/artifacts\z`, contentEncodingHandler(artifacts.UploadArtifacts(api, proxy), u.MaxDecompressedSize)),
 
 		// Terminal websocket
 		wsRoute(projectPattern+`environments/[0-9]+/terminal.ws\z`, terminal.Handler(api)),
@@ -165,8 +197,8 @@ func (u *Upstream) configureRoutes() {
 		route("", ciAPIPattern+`v1/builds/register.json\z`, ciAPILongPolling),
 
 		// Explicitly proxy API requests
-		route("", apiPattern, proxy),
-		route("", ciAPIPattern, proxy),
+		route("", apiPattern, spooledProxy),
+		route("", ciAPIPattern, spooledProxy),
 
 		// Serve assets
 		route(
@@ -182,15 +214,21 @@ func (u *Upstream) configureRoutes() {
 		// To prevent anybody who knows/guesses the URL of a user-uploaded file
 		// from downloading it we make sure requests to /uploads/ do _not_ pass
 		// through static.ServeExisting.
-		route("", `^/uploads/`, static.ErrorPagesUnless(u.DevelopmentMode, proxy)),
+		//
+		// The request spooler must be able to hijack the connection when a
+		// client is too slow, so it goes in front of the error pages.
+		route("", `^/uploads/`, spooling.SpoolRequests(static.ErrorPagesUnless(u.DevelopmentMode, proxy), u.RequestSpooling)),
 
 		// Serve static files or forward the requests
 		route(
 			"", "",
-			static.ServeExisting(
-				u.URLPrefix,
-				staticpages.CacheDisabled,
-				static.DeployPage(static.ErrorPagesUnless(u.DevelopmentMode, uploadAccelerateProxy)),
+			spooling.SpoolRequests(
+				static.ServeExisting(
+					u.URLPrefix,
+					staticpages.CacheDisabled,
+					static.DeployPage(static.ErrorPagesUnless(u.DevelopmentMode, uploadAccelerateProxy)),
+				),
+				u.RequestSpooling,
 			),
 		),
 	}
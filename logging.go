@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/audit"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 
 	"github.com/client9/reopen"
@@ -37,3 +38,20 @@ func startLogging(logFile string) {
 
 	go reopenLogWriter(logWriter, sighup)
 }
+
+func startAuditLogging(auditLogFile string) {
+	if auditLogFile == "" {
+		return
+	}
+
+	file, err := reopen.NewFileWriter(auditLogFile)
+	if err != nil {
+		log.Fatalf("Unable to set audit log: %s", err)
+	}
+	audit.SetOutput(file)
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go reopenLogWriter(file, sighup)
+}
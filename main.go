@@ -25,9 +25,12 @@ import (
 	"time"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/confinement"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -52,7 +55,17 @@ var apiLimit = flag.Uint("apiLimit", 0, "Number of API requests allowed at singl
 var apiQueueLimit = flag.Uint("apiQueueLimit", 0, "Number of API requests allowed to be queued")
 var apiQueueTimeout = flag.Duration("apiQueueDuration", queueing.DefaultTimeout, "Maximum queueing duration of requests")
 var apiCiLongPollingDuration = flag.Duration("apiCiLongPollingDuration", 50, "Long polling duration for job requesting for runners (default 50s - enabled)")
+var maxDecompressedSize = flag.Int64("maxDecompressedSize", upstream.DefaultMaxDecompressedSize, "Maximum size of a compressed request body after decompression")
+var maxPushSize = flag.Int64("maxPushSize", 0, "Maximum size of a 'git push' request body, unless Rails sets one for the project (default 0 - unlimited)")
+var gitUploadPackLimit = flag.Uint("gitUploadPackLimit", 0, "Number of git-upload-pack requests allowed at single time")
+var gitUploadPackQueueLimit = flag.Uint("gitUploadPackQueueLimit", 0, "Number of git-upload-pack requests allowed to be queued")
+var gitUploadPackQueueTimeout = flag.Duration("gitUploadPackQueueDuration", queueing.DefaultTimeout, "Maximum queueing duration of git-upload-pack requests")
+var apiAuthorizationCacheTTL = flag.Duration("apiAuthorizationCacheTTL", 0, "How long to reuse successful authorizations of Git fetches (default 0s - disabled)")
+var allowUnsignedSendData = flag.Bool("allowUnsignedSendData", true, "Accept Gitlab-Workhorse-Send-Data headers that are not signed with the secret key")
+var maxSendDataTokenLifetime = flag.Duration("maxSendDataTokenLifetime", senddata.DefaultMaxTokenLifetime, "Reject signed Gitlab-Workhorse-Send-Data headers that expire further in the future (0 - unlimited)")
+var gitDumbHTTP = flag.Bool("gitDumbHTTP", false, "Serve read-only Git repository access to 'dumb' HTTP clients")
 var logFile = flag.String("logFile", "", "Log file to be used")
+var auditLogFile = flag.String("auditLogFile", "", "Optional: file to write audit records of Git pushes to, one JSON object per line")
 var prometheusListenAddr = flag.String("prometheusListenAddr", "", "Prometheus listening address, e.g. 'localhost:9229'")
 
 func main() {
@@ -70,6 +83,7 @@ func main() {
 	}
 
 	startLogging(*logFile)
+	startAuditLogging(*auditLogFile)
 
 	backendURL, err := parseAuthBackend(*authBackend)
 	if err != nil {
@@ -112,6 +126,8 @@ func main() {
 	}
 
 	secret.SetPath(*secretPath)
+	senddata.SetAllowUnsigned(*allowUnsignedSendData)
+	senddata.SetMaxTokenLifetime(*maxSendDataTokenLifetime)
 	cfg := config.Config{
 		Backend:                  backendURL,
 		Socket:                   *authSocket,
@@ -123,6 +139,13 @@ func main() {
 		APIQueueLimit:            *apiQueueLimit,
 		APIQueueTimeout:          *apiQueueTimeout,
 		APICILongPollingDuration: *apiCiLongPollingDuration,
+		APIAuthorizationCacheTTL: *apiAuthorizationCacheTTL,
+		GitDumbHTTP:              *gitDumbHTTP,
+		MaxDecompressedSize:      *maxDecompressedSize,
+		MaxPushSize:              *maxPushSize,
+		UploadPackLimit:          *gitUploadPackLimit,
+		UploadPackQueueLimit:     *gitUploadPackQueueLimit,
+		UploadPackQueueTimeout:   *gitUploadPackQueueTimeout,
 	}
 
 	if *configFile != "" {
@@ -132,6 +155,26 @@ func main() {
 		}
 
 		cfg.Redis = cfgFromFile.Redis
+		cfg.RequestSpooling = cfgFromFile.RequestSpooling
+		cfg.ResponseSpooling = cfgFromFile.ResponseSpooling
+		cfg.AllowedPaths = cfgFromFile.AllowedPaths
+		cfg.UploadPackCache = cfgFromFile.UploadPackCache
+		cfg.InfoRefsCache = cfgFromFile.InfoRefsCache
+
+		if cfg.AllowedPaths != nil {
+			if err := confinement.SetAllowedRoots(cfg.AllowedPaths.Roots()); err != nil {
+				log.Fatalf("Can not configure allowed paths: %v", err)
+			}
+		}
+
+		if cfgFromFile.Archive != nil {
+			if err := git.SetArchiveCompression(cfgFromFile.Archive); err != nil {
+				log.Fatalf("Can not configure archive compression: %v", err)
+			}
+			if err := git.StartArchiveCacheManager(cfgFromFile.Archive); err != nil {
+				log.Fatalf("Can not start archive cache manager: %v", err)
+			}
+		}
 
 		if cfg.Redis != nil {
 			redis.Configure(cfg.Redis, redis.DefaultDialFunc)
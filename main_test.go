@@ -467,7 +467,7 @@ func TestGetGitDiff(t *testing.T) {
 
 	assert.Equal(t, 200, resp.StatusCode, "GET %q: status code", resp.Request.URL)
 	assert.Equal(t, expectedBody, string(body[:len(expectedBody)]), "GET %q: response body", resp.Request.URL)
-	assert.Equal(t, 155, len(body), "GET %q: body size", resp.Request.URL)
+	assert.Equal(t, 221, len(body), "GET %q: body size", resp.Request.URL)
 	assertNginxResponseBuffering(t, "no", resp, "GET %q: nginx response buffering", resp.Request.URL)
 }
 
@@ -21,15 +21,29 @@ func wrapRaven(h http.Handler) http.Handler {
 
 	raven.DefaultClient.SetRelease(Version)
 
-	return http.HandlerFunc(raven.RecoveryHandler(
-		func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				if p := recover(); p != nil {
-					helper.CleanHeadersForRaven(r)
-					panic(p)
-				}
-			}()
-
-			h.ServeHTTP(w, r)
-		}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Handlers abort responses they cannot finish with
+		// http.ErrAbortHandler. That is not an error worth reporting, and
+		// the server must see it to close the connection.
+		aborted := false
+		raven.RecoveryHandler(
+			func(w http.ResponseWriter, r *http.Request) {
+				defer func() {
+					if p := recover(); p != nil {
+						if p == http.ErrAbortHandler {
+							aborted = true
+							return
+						}
+						helper.CleanHeadersForRaven(r)
+						panic(p)
+					}
+				}()
+
+				h.ServeHTTP(w, r)
+			})(w, r)
+
+		if aborted {
+			panic(http.ErrAbortHandler)
+		}
+	})
 }